@@ -0,0 +1,317 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"github.com/michibiki-io/hems-metrics-go/rollup"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+type Level int
+
+const (
+	OK Level = iota
+	Warning
+	Critical
+)
+
+var levelNames = []string{"ok", "warning", "critical"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Alert is a change of the level of a phase, or a repeat of it.
+type Alert struct {
+	Time     time.Time `json:"time"`
+	Phase    string    `json:"phase"`
+	Level    Level     `json:"level"`
+	Previous Level     `json:"previous"`
+	// Repeated is a notification while the level continues
+	Repeated bool `json:"repeated"`
+	// [A], Threshold is the one of the level, of warning when ok
+	Current   float64 `json:"current_a"`
+	Limit     float64 `json:"limit_a"`
+	Threshold float64 `json:"threshold_a"`
+	Headroom  float64 `json:"headroom_a"`
+}
+
+type phaseState struct {
+	level      Level
+	current    float64
+	notifiedAt time.Time
+	// measured is false when the latest reading does not have the phase
+	measured bool
+}
+
+// Breaker watches the current of each phase against the contract breaker, and notifies
+// the warnings before it trips. It is a prometheus.Collector.
+type Breaker struct {
+	logger     *zap.Logger
+	mqtt       Publisher
+	staleAfter time.Duration
+
+	mutex     sync.Mutex
+	cfg       config.BreakerConfig
+	notifiers []namedNotifier
+	phases    map[string]*phaseState
+	readAt    time.Time
+	alerts    map[string]map[Level]uint64
+	failures  map[string]uint64
+	// closed is true once the queue is closed, a late reading is not evaluated
+	closed bool
+
+	queue chan Alert
+	done  chan struct{}
+
+	limit     *prometheus.Desc
+	threshold *prometheus.Desc
+	headroom  *prometheus.Desc
+	load      *prometheus.Desc
+	level     *prometheus.Desc
+	total     *prometheus.Desc
+	failed    *prometheus.Desc
+}
+
+// NewBreaker starts the notification worker, mqtt is used by notify.mqtt.
+func NewBreaker(l *zap.Logger, cfg config.BreakerConfig, staleAfter time.Duration, mqtt Publisher, namespace string) *Breaker {
+	name := func(name string) string {
+		return prometheus.BuildFQName(namespace, "breaker", name)
+	}
+	b := &Breaker{
+		logger:     l.With(zap.String("component", "breaker")),
+		mqtt:       mqtt,
+		staleAfter: staleAfter,
+		phases:     map[string]*phaseState{},
+		alerts:     map[string]map[Level]uint64{},
+		failures:   map[string]uint64{},
+		queue:      make(chan Alert, 16),
+		done:       make(chan struct{}),
+		limit: prometheus.NewDesc(name("limit_amperes"),
+			"Limit of the contract breaker by phase [A]", []string{"phase"}, nil),
+		threshold: prometheus.NewDesc(name("threshold_amperes"),
+			"Threshold of the warning levels by phase [A]", []string{"phase", "level"}, nil),
+		headroom: prometheus.NewDesc(name("headroom_amperes"),
+			"Current left to the limit by phase, negative over the limit [A]", []string{"phase"}, nil),
+		load: prometheus.NewDesc(name("load_ratio"),
+			"Current per the limit by phase", []string{"phase"}, nil),
+		level: prometheus.NewDesc(name("alert_level"),
+			"Warning level by phase, 0 ok, 1 warning, 2 critical", []string{"phase"}, nil),
+		total: prometheus.NewDesc(name("alerts_total"),
+			"Number of the raised warnings by phase and level", []string{"phase", "level"}, nil),
+		failed: prometheus.NewDesc(name("notification_failures_total"),
+			"Number of the failed notifications by channel", []string{"channel"}, nil),
+	}
+	for _, phase := range config.BreakerPhaseNames {
+		b.phases[phase] = &phaseState{}
+		b.alerts[phase] = map[Level]uint64{}
+	}
+	b.ApplyConfig(cfg)
+
+	go b.run()
+	return b
+}
+
+// ApplyConfig replaces the limits and the channels, the levels are evaluated again by the next reading.
+func (b *Breaker) ApplyConfig(cfg config.BreakerConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.notifiers != nil && reflect.DeepEqual(cfg, b.cfg) {
+		return
+	}
+	b.cfg = cfg
+
+	b.notifiers = []namedNotifier{}
+	if cfg.Notify.Log {
+		b.notifiers = append(b.notifiers, namedNotifier{"log", NewLogNotifier(b.logger)})
+	}
+	if cfg.Notify.MQTT.Enabled && b.mqtt != nil {
+		b.notifiers = append(b.notifiers, namedNotifier{"mqtt", NewMQTTNotifier(b.mqtt, cfg.Notify.MQTT)})
+	}
+	if cfg.Notify.Webhook.Enabled {
+		b.notifiers = append(b.notifiers, namedNotifier{"webhook", NewWebhookNotifier(cfg.Notify.Webhook)})
+	}
+}
+
+// Update evaluates the currents of the reading, the event bus subscriber.
+func (b *Breaker) Update(data *model.HemsData) error {
+	if data == nil {
+		return nil
+	}
+	currents := map[string]float64{}
+	for _, name := range config.BreakerPhaseNames {
+		// the phase which the meter does not measure is not evaluated
+		if current, ok := data.PhaseCurrent(name); ok {
+			currents[name] = rollup.Value(current)
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	cfg := b.cfg
+	if !cfg.Enabled || b.closed {
+		return nil
+	}
+	b.readAt = data.DateTime
+
+	for _, name := range config.BreakerPhaseNames {
+		p := cfg.Phase(name)
+		s := b.phases[name]
+		current, ok := currents[name]
+		s.measured = ok
+		if !ok {
+			continue
+		}
+		level := nextLevel(s.level, current, p, cfg.Hysteresis)
+
+		repeated := false
+		switch {
+		case level != s.level:
+			if level > s.level {
+				b.alerts[name][level]++
+			}
+		case level > OK && cfg.RepeatInterval > 0 && data.DateTime.Sub(s.notifiedAt) >= cfg.RepeatInterval.Duration():
+			repeated = true
+		default:
+			s.current = current
+			continue
+		}
+
+		threshold := p.Warning
+		if level == Critical {
+			threshold = p.Critical
+		}
+		b.enqueue(Alert{
+			Time:      data.DateTime,
+			Phase:     name,
+			Level:     level,
+			Previous:  s.level,
+			Repeated:  repeated,
+			Current:   current,
+			Limit:     p.Limit,
+			Threshold: threshold,
+			Headroom:  rollup.Round(p.Limit - current),
+		})
+		s.level, s.current, s.notifiedAt = level, current, data.DateTime
+	}
+	return nil
+}
+
+// nextLevel rises at once, and a level is kept until the current falls below its threshold by the hysteresis.
+func nextLevel(level Level, current float64, p config.BreakerPhase, hysteresis float64) Level {
+	next := OK
+	if current >= p.Warning {
+		next = Warning
+	}
+	if current >= p.Critical {
+		next = Critical
+	}
+	if level == Critical && current >= p.Critical-hysteresis {
+		return Critical
+	}
+	if level >= Warning && next < Warning && current >= p.Warning-hysteresis {
+		return Warning
+	}
+	return next
+}
+
+// enqueue does not block the evaluation, the alert is dropped when the channels are too slow.
+// Call it in the lock and before Close.
+func (b *Breaker) enqueue(a Alert) {
+	select {
+	case b.queue <- a:
+	default:
+		b.logger.Warn(fmt.Sprintf("notification queue is full, %s alert of %s phase is dropped", a.Level, a.Phase))
+	}
+}
+
+func (b *Breaker) run() {
+	defer close(b.done)
+	for a := range b.queue {
+		b.mutex.Lock()
+		notifiers := b.notifiers
+		b.mutex.Unlock()
+
+		for _, n := range notifiers {
+			if err := n.notifier.Notify(a); err != nil {
+				b.logger.Warn(fmt.Sprintf("notify %s is failed", n.name), zap.Error(err))
+				b.mutex.Lock()
+				b.failures[n.name]++
+				b.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// Close sends the queued alerts and stops the worker. It returns when ctx is done before they
+// are sent, e.g. by a slow webhook, and the worker sends the rest in the background.
+func (b *Breaker) Close(ctx context.Context) error {
+	b.mutex.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mutex.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued alerts are not sent: %w", len(b.queue), ctx.Err())
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (b *Breaker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.limit
+	ch <- b.threshold
+	ch <- b.headroom
+	ch <- b.load
+	ch <- b.level
+	ch <- b.total
+	ch <- b.failed
+}
+
+// Collect implements prometheus.Collector. The series of the currents disappear when the reading is stale.
+func (b *Breaker) Collect(ch chan<- prometheus.Metric) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	cfg := b.cfg
+	if !cfg.Enabled {
+		return
+	}
+	fresh := !b.readAt.IsZero() && (b.staleAfter == 0 || time.Since(b.readAt) <= b.staleAfter)
+
+	for _, name := range config.BreakerPhaseNames {
+		p := cfg.Phase(name)
+		s := b.phases[name]
+		ch <- prometheus.MustNewConstMetric(b.limit, prometheus.GaugeValue, p.Limit, name)
+		ch <- prometheus.MustNewConstMetric(b.threshold, prometheus.GaugeValue, p.Warning, name, Warning.String())
+		ch <- prometheus.MustNewConstMetric(b.threshold, prometheus.GaugeValue, p.Critical, name, Critical.String())
+		for _, level := range []Level{Warning, Critical} {
+			ch <- prometheus.MustNewConstMetric(b.total, prometheus.CounterValue, float64(b.alerts[name][level]), name, level.String())
+		}
+		if fresh && s.measured {
+			ch <- prometheus.MustNewConstMetric(b.headroom, prometheus.GaugeValue, rollup.Round(p.Limit-s.current), name)
+			ch <- prometheus.MustNewConstMetric(b.load, prometheus.GaugeValue, rollup.Round(s.current/p.Limit), name)
+			ch <- prometheus.MustNewConstMetric(b.level, prometheus.GaugeValue, float64(s.level), name)
+		}
+	}
+	for _, n := range b.notifiers {
+		ch <- prometheus.MustNewConstMetric(b.failed, prometheus.CounterValue, float64(b.failures[n.name]), n.name)
+	}
+}
@@ -0,0 +1,97 @@
+package alert
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestCloseWithSlowWebhook(t *testing.T) {
+	received := make(chan struct{}, 16)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cfg := config.Default().Breaker
+	cfg.Enabled = true
+	cfg.ContractAmperes = 30
+	cfg.Notify.Log = false
+	cfg.Notify.Webhook = config.BreakerWebhookNotify{Enabled: true, URL: server.URL, Timeout: config.Duration(time.Minute)}
+	b := NewBreaker(zap.NewNop(), cfg, time.Minute, nil, "hems")
+
+	// critical on both phases, the first alert hangs in the webhook
+	if err := b.Update(model.CreateHemsData(time.Now(), 1, 6000, 290, 290)); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if err := b.Close(ctx); err == nil {
+		t.Error("close returns before the alerts are sent")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("close waits for %s", elapsed)
+	}
+
+	// a late reading after a timed out close, and a second close
+	if err := b.Update(model.CreateHemsData(time.Now(), 1, 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(ctx); err == nil {
+		t.Error("second close returns before the alerts are sent")
+	}
+}
+
+func TestSinglePhaseTwoWire(t *testing.T) {
+	cfg := config.Default().Breaker
+	cfg.Enabled = true
+	cfg.ContractAmperes = 30
+	cfg.Notify.Log = false
+	b := NewBreaker(zap.NewNop(), cfg, time.Minute, nil, "hems")
+	defer b.Close(context.Background())
+
+	// E8 = 00C8 7FFE, 20 A of R phase and no T phase
+	data := model.CreateHemsData(time.Now(), 1, 2000, 200, 0)
+	data.TphaseUnmeasured = true
+	for i := 0; i < 3; i++ {
+		if err := b.Update(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.mutex.Lock()
+	for name, alerts := range b.alerts {
+		for level, n := range alerts {
+			if n > 0 {
+				t.Errorf("%d %s alerts of %s phase", n, level, name)
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	ch := make(chan prometheus.Metric, 64)
+	b.Collect(ch)
+	close(ch)
+	levels := 0
+	for m := range ch {
+		if m.Desc() == b.level {
+			levels++
+		}
+	}
+	if levels != 1 {
+		t.Errorf("alert level of %d phases", levels)
+	}
+}
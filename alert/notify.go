@@ -0,0 +1,106 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"go.uber.org/zap"
+)
+
+// Notifier sends an alert to a channel.
+type Notifier interface {
+	Notify(a Alert) error
+}
+
+// Publisher is the MQTT sink, the topic is relative to its prefix.
+type Publisher interface {
+	Publish(topic string, payload string, retain bool) error
+	Topic(topic string) string
+}
+
+type namedNotifier struct {
+	name     string
+	notifier Notifier
+}
+
+// LogNotifier writes the alerts to the log.
+type LogNotifier struct {
+	logger *zap.Logger
+}
+
+func NewLogNotifier(l *zap.Logger) *LogNotifier {
+	return &LogNotifier{logger: l}
+}
+
+func (n *LogNotifier) Notify(a Alert) error {
+	fields := []zap.Field{
+		zap.String("phase", a.Phase),
+		zap.Float64("current", a.Current),
+		zap.Float64("limit", a.Limit),
+		zap.Float64("headroom", a.Headroom),
+	}
+	if a.Level == OK {
+		n.logger.Info(fmt.Sprintf("%s phase current is back below %.1fA", a.Phase, a.Threshold), fields...)
+		return nil
+	}
+	n.logger.Warn(fmt.Sprintf("%s phase current %.1fA is %s, %.1fA to the breaker limit", a.Phase, a.Current, a.Level, a.Headroom), fields...)
+	return nil
+}
+
+// MQTTNotifier publishes the alerts as json to topic/phase.
+type MQTTNotifier struct {
+	publisher Publisher
+	cfg       config.BreakerMQTTNotify
+}
+
+func NewMQTTNotifier(p Publisher, cfg config.BreakerMQTTNotify) *MQTTNotifier {
+	return &MQTTNotifier{publisher: p, cfg: cfg}
+}
+
+func (n *MQTTNotifier) Notify(a Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return n.publisher.Publish(n.publisher.Topic(n.cfg.Topic+"/"+a.Phase), string(b), n.cfg.Retain)
+}
+
+// WebhookNotifier posts the alerts as json.
+type WebhookNotifier struct {
+	cfg    config.BreakerWebhookNotify
+	client *http.Client
+}
+
+func NewWebhookNotifier(cfg config.BreakerWebhookNotify) *WebhookNotifier {
+	return &WebhookNotifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout.Duration()},
+	}
+}
+
+func (n *WebhookNotifier) Notify(a Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook is failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/michibiki-io/goutils"
+)
+
+// BreakerPhaseNames are the phases of the single-phase three-wire, their currents are EPC E8.
+var BreakerPhaseNames = []string{"r", "t"}
+
+// Phase returns the limit and the thresholds of the phase [A], the defaults are filled.
+func (c BreakerConfig) Phase(name string) BreakerPhase {
+	p := c.Phases.R
+	if name == "t" {
+		p = c.Phases.T
+	}
+	if p.Limit == 0 {
+		p.Limit = float64(c.ContractAmperes)
+	}
+	if p.Warning == 0 {
+		p.Warning = p.Limit * c.Warning
+	}
+	if p.Critical == 0 {
+		p.Critical = p.Limit * c.Critical
+	}
+	return p
+}
+
+func (c *Config) validateBreaker() []string {
+	b := c.Breaker
+	errs := []string{}
+	if b.ContractAmperes <= 0 {
+		errs = append(errs, fmt.Sprintf("breaker.contract_amperes must be positive: %d", b.ContractAmperes))
+	}
+	if b.Warning <= 0 || b.Critical <= 0 || b.Warning >= b.Critical {
+		errs = append(errs, fmt.Sprintf("breaker.warning and critical must be positive, and warning is lower: %v, %v", b.Warning, b.Critical))
+	}
+	if b.Hysteresis < 0 {
+		errs = append(errs, "breaker.hysteresis must not be negative")
+	}
+	if b.RepeatInterval < 0 {
+		errs = append(errs, "breaker.repeat_interval must not be negative")
+	}
+	for _, name := range BreakerPhaseNames {
+		p := b.Phase(name)
+		if p.Limit <= 0 || p.Warning <= 0 || p.Critical <= 0 {
+			errs = append(errs, fmt.Sprintf("breaker.phases.%s limit, warning and critical must be positive", name))
+		} else if p.Warning >= p.Critical {
+			errs = append(errs, fmt.Sprintf("breaker.phases.%s warning must be lower than critical: %v, %v", name, p.Warning, p.Critical))
+		}
+	}
+
+	notify := b.Notify
+	if notify.MQTT.Enabled {
+		if !c.Sinks.MQTT.Enabled {
+			errs = append(errs, "breaker.notify.mqtt needs sinks.mqtt.enabled")
+		}
+		if len(notify.MQTT.Topic) == 0 {
+			errs = append(errs, "breaker.notify.mqtt.topic must not be empty")
+		}
+	}
+	if webhook := notify.Webhook; webhook.Enabled {
+		if u, err := url.Parse(webhook.URL); err != nil || !goutils.StringsContains([]string{"http", "https"}, u.Scheme) {
+			errs = append(errs, fmt.Sprintf("breaker.notify.webhook.url must be http:// or https:// url: %s", webhook.URL))
+		}
+		if webhook.Timeout <= 0 {
+			errs = append(errs, "breaker.notify.webhook.timeout must be positive")
+		}
+	}
+	return errs
+}
@@ -0,0 +1,790 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/michibiki-io/goutils"
+	"github.com/michibiki-io/hems-metrics-go/dongle"
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "<redacted>"
+
+// Duration is a time.Duration which is written as "5s" in yaml.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type Config struct {
+	// File is the path of the loaded config file
+	File string `yaml:"-"`
+
+	// Timezone is an IANA name, used for the log timestamps, the unit time schedule and the rollups
+	Timezone string `yaml:"timezone"`
+
+	Log     LogConfig     `yaml:"log"`
+	Dongle  DongleConfig  `yaml:"dongle"`
+	Meter   MeterConfig   `yaml:"meter"`
+	Polling PollingConfig `yaml:"polling"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	HTTP    HTTPConfig    `yaml:"http"`
+	API     APIConfig     `yaml:"api"`
+	Sinks   SinksConfig   `yaml:"sinks"`
+	Storage StorageConfig `yaml:"storage"`
+	State   StateConfig   `yaml:"state"`
+	Billing BillingConfig `yaml:"billing"`
+	Tariff  TariffConfig  `yaml:"tariff"`
+	Breaker BreakerConfig `yaml:"breaker"`
+}
+
+type LogConfig struct {
+	// Mode is release or debug
+	Mode string `yaml:"mode"`
+	// Format is json, console or logfmt, the default of the mode when empty
+	Format string `yaml:"format"`
+	// Level is the initial level, it can be changed at runtime by the admin endpoint
+	Level string `yaml:"level"`
+}
+
+type DongleConfig struct {
+	// Device is the serial device path, it is auto-discovered when empty
+	Device            string   `yaml:"device"`
+	DeviceGlob        string   `yaml:"device_glob"`
+	Baudrate          int      `yaml:"baudrate"`
+	Parity            string   `yaml:"parity"`
+	ReadTimeout       Duration `yaml:"read_timeout"`
+	ConnectRetryCount int      `yaml:"connect_retry_count"`
+}
+
+type MeterConfig struct {
+	// Bルート認証ID
+	BRouteID     string `yaml:"b_route_id"`
+	BRouteIDFile string `yaml:"b_route_id_file"`
+	// Bルート認証パスワード
+	BRoutePassword     string `yaml:"b_route_password"`
+	BRoutePasswordFile string `yaml:"b_route_password_file"`
+	// CredentialsFile is encrypted with the key in CredentialsKeyFile, see EncryptCredentials
+	CredentialsFile    string `yaml:"credentials_file"`
+	CredentialsKeyFile string `yaml:"credentials_key_file"`
+}
+
+type PollingConfig struct {
+	Interval     Duration `yaml:"interval"`
+	UnitTimeCron string   `yaml:"unit_time_cron"`
+}
+
+type MetricsConfig struct {
+	Path      string `yaml:"path"`
+	Namespace string `yaml:"namespace"`
+	// StaleAfter removes the series of the readings older than it, 0 keeps them forever
+	StaleAfter Duration `yaml:"stale_after"`
+	// Timestamps attaches the time of the meter reading to the samples
+	Timestamps bool `yaml:"timestamps"`
+	// GoCollector and ProcessCollector add the runtime and the process metrics
+	GoCollector      bool `yaml:"go_collector"`
+	ProcessCollector bool `yaml:"process_collector"`
+}
+
+type HTTPConfig struct {
+	Listen string `yaml:"listen"`
+	// AdminListen serves the admin endpoints apart from the metrics, loopback by default. Disabled when empty
+	AdminListen     string   `yaml:"admin_listen"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout"`
+}
+
+type APIConfig struct {
+	// HistorySize is the number of readings kept in memory
+	HistorySize int `yaml:"history_size"`
+	// SlotHistorySize is the number of unit times kept in memory
+	SlotHistorySize int `yaml:"slot_history_size"`
+	// StreamMaxClients is the limit of the SSE and WebSocket clients
+	StreamMaxClients int `yaml:"stream_max_clients"`
+	// StreamBufferSize is the queue of each stream client, the oldest events are dropped when it is full
+	StreamBufferSize int `yaml:"stream_buffer_size"`
+}
+
+// StorageConfig is the on-disk store of the readings.
+type StorageConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	// the retention of each resolution, 0 keeps forever
+	RawRetention    Duration `yaml:"raw_retention"`
+	MinuteRetention Duration `yaml:"minute_retention"`
+	SlotRetention   Duration `yaml:"slot_retention"`
+	// SyncInterval is the fsync of the readings, the slots are synced on every write
+	SyncInterval Duration `yaml:"sync_interval"`
+}
+
+// StateConfig is the controller state which is restored after restart.
+type StateConfig struct {
+	// File is the path of the state, disabled when empty
+	File         string   `yaml:"file"`
+	SaveInterval Duration `yaml:"save_interval"`
+	// MaxAge, an older state is not restored, 0 restores always
+	MaxAge Duration `yaml:"max_age"`
+}
+
+// BillingConfig is the billing period of the contract.
+type BillingConfig struct {
+	// ReadingDay is the meter reading day (検針日), 1-31. The billing period starts on it, 1 is the calendar month.
+	ReadingDay int `yaml:"reading_day"`
+}
+
+// TariffConfig is the price plan, the cost is computed for every unit time.
+type TariffConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Currency string `yaml:"currency"`
+	// ContractAmperes selects the basic charge
+	ContractAmperes int `yaml:"contract_amperes"`
+	// BasicCharges is the basic charge of a billing period by the contract amperes
+	BasicCharges map[int]float64 `yaml:"basic_charges"`
+	// Tiers are the rates per kWh by the energy of the billing period, e.g. 従量電灯B
+	Tiers []TariffTier `yaml:"tiers"`
+	// TimeOfUse are the rates by the time and the day, the first match is used instead of the tiers
+	TimeOfUse []TimeOfUseRate `yaml:"time_of_use"`
+	// FuelCostAdjustment and RenewableSurcharge are per kWh by the meter reading month which ends the billing period, e.g. "2026-10"
+	FuelCostAdjustment map[string]float64 `yaml:"fuel_cost_adjustment"`
+	RenewableSurcharge map[string]float64 `yaml:"renewable_surcharge"`
+	// FeedInRate is per exported kWh
+	FeedInRate float64 `yaml:"feed_in_rate"`
+	// Holidays are the dates (2006-01-02) matched by the time of use days "holiday"
+	Holidays []string `yaml:"holidays"`
+}
+
+type TariffTier struct {
+	// UpTo is the upper bound of the tier [kWh], 0 is unbounded
+	UpTo float64 `yaml:"up_to"`
+	Rate float64 `yaml:"rate"`
+}
+
+type TimeOfUseRate struct {
+	Name string `yaml:"name"`
+	// Start and End are 15:04, empty is the whole day. End before Start is over midnight.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Days are mon ... sun, weekday, weekend and holiday, empty is every day
+	Days []string `yaml:"days"`
+	Rate float64  `yaml:"rate"`
+}
+
+// BreakerConfig warns before the contract breaker trips, by the current of each phase.
+type BreakerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ContractAmperes is the limit of each phase, tariff.contract_amperes when 0
+	ContractAmperes int `yaml:"contract_amperes"`
+	// Warning and Critical are the ratios of the limit
+	Warning  float64 `yaml:"warning"`
+	Critical float64 `yaml:"critical"`
+	// Hysteresis [A], a level is cleared when the current falls below its threshold by it
+	Hysteresis float64 `yaml:"hysteresis"`
+	// RepeatInterval notifies again while a level continues, 0 notifies only the changes
+	RepeatInterval Duration      `yaml:"repeat_interval"`
+	Phases         BreakerPhases `yaml:"phases"`
+	Notify         BreakerNotify `yaml:"notify"`
+}
+
+type BreakerPhases struct {
+	R BreakerPhase `yaml:"r"`
+	T BreakerPhase `yaml:"t"`
+}
+
+// BreakerPhase overrides the limit and the thresholds of a phase [A], 0 is the default.
+type BreakerPhase struct {
+	Limit    float64 `yaml:"limit"`
+	Warning  float64 `yaml:"warning"`
+	Critical float64 `yaml:"critical"`
+}
+
+// BreakerNotify are the channels of the warnings.
+type BreakerNotify struct {
+	Log     bool                 `yaml:"log"`
+	MQTT    BreakerMQTTNotify    `yaml:"mqtt"`
+	Webhook BreakerWebhookNotify `yaml:"webhook"`
+}
+
+// BreakerMQTTNotify publishes the warnings through sinks.mqtt.
+type BreakerMQTTNotify struct {
+	Enabled bool `yaml:"enabled"`
+	// Topic is relative to the topic prefix
+	Topic  string `yaml:"topic"`
+	Retain bool   `yaml:"retain"`
+}
+
+// BreakerWebhookNotify posts the warnings as json.
+type BreakerWebhookNotify struct {
+	Enabled bool   `yaml:"enabled"`
+	URL     string `yaml:"url"`
+	// Headers are added to the request, e.g. Authorization
+	Headers map[string]string `yaml:"headers"`
+	Timeout Duration          `yaml:"timeout"`
+}
+
+type SinksConfig struct {
+	MQTT        MQTTConfig        `yaml:"mqtt"`
+	InfluxDB    InfluxDBConfig    `yaml:"influxdb"`
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+	OTLP        OTLPConfig        `yaml:"otlp"`
+}
+
+type MQTTConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Broker is tcp://, ssl://, ws:// or wss://
+	Broker       string `yaml:"broker"`
+	ClientID     string `yaml:"client_id"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	QoS          byte   `yaml:"qos"`
+	Retain       bool   `yaml:"retain"`
+	// TopicPrefix is prepended to the topics with a slash
+	TopicPrefix          string              `yaml:"topic_prefix"`
+	Topics               MQTTTopics          `yaml:"topics"`
+	TLS                  TLSConfig           `yaml:"tls"`
+	KeepAlive            Duration            `yaml:"keep_alive"`
+	ConnectTimeout       Duration            `yaml:"connect_timeout"`
+	MaxReconnectInterval Duration            `yaml:"max_reconnect_interval"`
+	HomeAssistant        HomeAssistantConfig `yaml:"home_assistant"`
+}
+
+// RemoteWriteConfig is the push of the Prometheus remote_write protocol.
+type RemoteWriteConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	URL     string `yaml:"url"`
+	// basic auth or bearer token
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	PasswordFile    string `yaml:"password_file"`
+	BearerToken     string `yaml:"bearer_token"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	// ExternalLabels are added to every series, e.g. instance
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	BatchSize      int               `yaml:"batch_size"`
+	FlushInterval  Duration          `yaml:"flush_interval"`
+	Timeout        Duration          `yaml:"timeout"`
+	RetryInterval  Duration          `yaml:"retry_interval"`
+	// WALDir keeps the requests until they are accepted
+	WALDir      string    `yaml:"wal_dir"`
+	WALMaxBytes int64     `yaml:"wal_max_bytes"`
+	TLS         TLSConfig `yaml:"tls"`
+}
+
+// OTLPConfig is the export of the OpenTelemetry metrics and the traces of the dongle commands.
+type OTLPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Protocol is grpc or http (http/protobuf)
+	Protocol string `yaml:"protocol"`
+	// Endpoint is host:port, 4317 for grpc and 4318 for http
+	Endpoint string `yaml:"endpoint"`
+	// URLPath is the path of the http metrics endpoint
+	URLPath string `yaml:"url_path"`
+	// Insecure disables tls
+	Insecure       bool              `yaml:"insecure"`
+	Headers        map[string]string `yaml:"headers"`
+	ServiceName    string            `yaml:"service_name"`
+	ExportInterval Duration          `yaml:"export_interval"`
+	Timeout        Duration          `yaml:"timeout"`
+	// Traces exports the spans of the dongle commands
+	Traces bool      `yaml:"traces"`
+	TLS    TLSConfig `yaml:"tls"`
+}
+
+// HomeAssistantConfig is the MQTT discovery of Home Assistant.
+type HomeAssistantConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	// NodeID identifies the device, keep it stable
+	NodeID     string `yaml:"node_id"`
+	DeviceName string `yaml:"device_name"`
+}
+
+// MQTTTopics are relative to the topic prefix, an empty one is not published.
+type MQTTTopics struct {
+	Power         string `yaml:"power"`
+	Current       string `yaml:"current"`
+	RPhaseCurrent string `yaml:"r_phase_current"`
+	TPhaseCurrent string `yaml:"t_phase_current"`
+	PowerFactor   string `yaml:"power_factor"`
+	Energy        string `yaml:"energy"`
+	UnitTime      string `yaml:"unit_time_energy"`
+	// State is the whole reading as json
+	State      string `yaml:"state"`
+	Connection string `yaml:"connection"`
+	// Availability is online / offline, offline is the Last-Will
+	Availability string `yaml:"availability"`
+}
+
+type InfluxDBConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// URL is http(s)://host:8086, or udp://host:8089 for the UDP listener
+	URL string `yaml:"url"`
+	// Version is 1 or 2 of the HTTP write API
+	Version int `yaml:"version"`
+	// v1
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	PasswordFile    string `yaml:"password_file"`
+	// v2
+	Org       string `yaml:"org"`
+	Bucket    string `yaml:"bucket"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+
+	Measurement string `yaml:"measurement"`
+	// Tags are added to every point, the meter serial number is added as "meter"
+	Tags          map[string]string `yaml:"tags"`
+	BatchSize     int               `yaml:"batch_size"`
+	FlushInterval Duration          `yaml:"flush_interval"`
+	Timeout       Duration          `yaml:"timeout"`
+	RetryInterval Duration          `yaml:"retry_interval"`
+	// SpoolDir keeps the batches which could not be written, until the endpoint is back
+	SpoolDir      string    `yaml:"spool_dir"`
+	SpoolMaxBytes int64     `yaml:"spool_max_bytes"`
+	TLS           TLSConfig `yaml:"tls"`
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func Default() *Config {
+	return &Config{
+		Timezone: "Asia/Tokyo",
+		Log: LogConfig{
+			Mode: "release",
+		},
+		Dongle: DongleConfig{
+			Baudrate:          115200,
+			Parity:            "none",
+			ConnectRetryCount: 5,
+		},
+		Polling: PollingConfig{
+			Interval:     Duration(5 * time.Second),
+			UnitTimeCron: "0,30 * * * *",
+		},
+		Metrics: MetricsConfig{
+			Path:       "/metrics",
+			Namespace:  "hems",
+			StaleAfter: Duration(5 * time.Minute),
+		},
+		HTTP: HTTPConfig{
+			Listen:          ":9000",
+			AdminListen:     "127.0.0.1:9001",
+			ShutdownTimeout: Duration(10 * time.Second),
+		},
+		API: APIConfig{
+			HistorySize:      720,
+			SlotHistorySize:  336,
+			StreamMaxClients: 16,
+			StreamBufferSize: 16,
+		},
+		Storage: StorageConfig{
+			Dir:             "data",
+			RawRetention:    Duration(7 * 24 * time.Hour),
+			MinuteRetention: Duration(90 * 24 * time.Hour),
+			SyncInterval:    Duration(time.Minute),
+		},
+		Billing: BillingConfig{
+			ReadingDay: 1,
+		},
+		// 従量電灯B of TEPCO, without tax changes since 2023-06
+		Tariff: TariffConfig{
+			Currency:        "JPY",
+			ContractAmperes: 30,
+			BasicCharges: map[int]float64{
+				10: 311.75, 15: 467.63, 20: 623.50, 30: 935.25, 40: 1247.00, 50: 1558.75, 60: 1870.50,
+			},
+			Tiers: []TariffTier{
+				{UpTo: 120, Rate: 29.80},
+				{UpTo: 300, Rate: 36.40},
+				{Rate: 40.49},
+			},
+		},
+		Breaker: BreakerConfig{
+			Warning:    0.8,
+			Critical:   0.95,
+			Hysteresis: 2,
+			Notify: BreakerNotify{
+				Log: true,
+				MQTT: BreakerMQTTNotify{
+					Topic: "breaker",
+				},
+				Webhook: BreakerWebhookNotify{
+					Timeout: Duration(10 * time.Second),
+				},
+			},
+		},
+		State: StateConfig{
+			File:         "data/state.json",
+			SaveInterval: Duration(time.Minute),
+			MaxAge:       Duration(time.Hour),
+		},
+		Sinks: SinksConfig{
+			MQTT: MQTTConfig{
+				Broker:      "tcp://localhost:1883",
+				ClientID:    "hems-metrics",
+				TopicPrefix: "hems",
+				Topics: MQTTTopics{
+					Power:         "power",
+					Current:       "current",
+					RPhaseCurrent: "current/r",
+					TPhaseCurrent: "current/t",
+					PowerFactor:   "power_factor",
+					Energy:        "energy",
+					UnitTime:      "energy/unit_time",
+					State:         "state",
+					Connection:    "connection",
+					Availability:  "availability",
+				},
+				KeepAlive:            Duration(30 * time.Second),
+				ConnectTimeout:       Duration(10 * time.Second),
+				MaxReconnectInterval: Duration(time.Minute),
+				HomeAssistant: HomeAssistantConfig{
+					DiscoveryPrefix: "homeassistant",
+					NodeID:          "hems_smart_meter",
+					DeviceName:      "Smart Meter",
+				},
+			},
+			InfluxDB: InfluxDBConfig{
+				URL:           "http://localhost:8086",
+				Version:       2,
+				Measurement:   "hems",
+				BatchSize:     100,
+				FlushInterval: Duration(10 * time.Second),
+				Timeout:       Duration(10 * time.Second),
+				RetryInterval: Duration(30 * time.Second),
+				SpoolDir:      "spool/influxdb",
+				SpoolMaxBytes: 64 * 1024 * 1024,
+			},
+			RemoteWrite: RemoteWriteConfig{
+				BatchSize:     500,
+				FlushInterval: Duration(30 * time.Second),
+				Timeout:       Duration(30 * time.Second),
+				RetryInterval: Duration(30 * time.Second),
+				WALDir:        "wal/remote_write",
+				WALMaxBytes:   256 * 1024 * 1024,
+			},
+			OTLP: OTLPConfig{
+				Protocol:       "grpc",
+				Endpoint:       "localhost:4317",
+				URLPath:        "/v1/metrics",
+				ServiceName:    "hems-metrics",
+				ExportInterval: Duration(30 * time.Second),
+				Timeout:        Duration(10 * time.Second),
+			},
+		},
+	}
+}
+
+// Load builds the config from the defaults, the config file, the environment and the flags,
+// in this order of precedence, then validates it.
+func Load(name string, args []string) (*Config, error) {
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := fs.String("config", goutils.GetEnv("CONFIG_FILE", ""), "path to the config file (yaml)")
+	mode := fs.String("mode", "", "log mode, release or debug")
+	device := fs.String("device", "", "serial device of the dongle")
+	listen := fs.String("listen", "", "listen address of the http server")
+	interval := fs.Duration("interval", 0, "polling interval")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	c.File = *file
+
+	if len(*file) > 0 {
+		if err := c.loadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+
+	c.loadEnv()
+
+	// flags
+	if len(*mode) > 0 {
+		c.Log.Mode = *mode
+	}
+	if len(*device) > 0 {
+		c.Dongle.Device = *device
+	}
+	if len(*listen) > 0 {
+		c.HTTP.Listen = *listen
+	}
+	if *interval > 0 {
+		c.Polling.Interval = Duration(*interval)
+	}
+
+	if err := c.loadCredentials(); err != nil {
+		return nil, err
+	}
+
+	// the contract of the tariff
+	if c.Breaker.ContractAmperes == 0 {
+		c.Breaker.ContractAmperes = c.Tariff.ContractAmperes
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// LoadForExport loads the config of the export command. It is validated only for the storage and the export,
+// the meter credentials and the dongle are not required.
+func LoadForExport(name string, args []string) (*Config, error) {
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := fs.String("config", goutils.GetEnv("CONFIG_FILE", ""), "path to the config file (yaml)")
+	dir := fs.String("storage.dir", "", "directory of the storage")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	c.File = *file
+
+	if len(*file) > 0 {
+		if err := c.loadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+
+	c.loadEnv()
+
+	if len(*dir) > 0 {
+		c.Storage.Dir = *dir
+	}
+
+	if err := c.ValidateExport(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) loadFile(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read config file is failed: %w", err)
+	}
+	return c.withoutDefaultMaps(func() error {
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return fmt.Errorf("parse config file %s is failed: %w", file, err)
+		}
+		return nil
+	})
+}
+
+// defaultMaps are the maps which have default values, add a new one here.
+func (c *Config) defaultMaps() []interface{} {
+	return []interface{}{
+		&c.Tariff.BasicCharges,
+	}
+}
+
+// withoutDefaultMaps clears the default maps while f reads the file, so that a map of the file
+// replaces the default one instead of being merged, and strict unmarshal does not reject
+// the keys which are already set. The defaults are restored when the file has no map.
+func (c *Config) withoutDefaultMaps(f func() error) error {
+	defaults := []reflect.Value{}
+	for _, m := range c.defaultMaps() {
+		v := reflect.ValueOf(m).Elem()
+		defaults = append(defaults, reflect.ValueOf(v.Interface()))
+		v.Set(reflect.Zero(v.Type()))
+	}
+	err := f()
+	for i, m := range c.defaultMaps() {
+		if v := reflect.ValueOf(m).Elem(); v.IsNil() {
+			v.Set(defaults[i])
+		}
+	}
+	return err
+}
+
+func (c *Config) loadEnv() {
+	c.Timezone = goutils.GetEnv("TIMEZONE", c.Timezone)
+
+	c.Log.Mode = goutils.GetEnv("MODE", c.Log.Mode)
+	c.Log.Format = goutils.GetEnv("LOG_FORMAT", c.Log.Format)
+	c.Log.Level = goutils.GetEnv("LOG_LEVEL", c.Log.Level)
+
+	c.Dongle.Device = goutils.GetEnv("SERIAL_DEVICE", c.Dongle.Device)
+	c.Dongle.DeviceGlob = goutils.GetEnv("SERIAL_DEVICE_GLOB", c.Dongle.DeviceGlob)
+	c.Dongle.Baudrate = goutils.GetIntEnv("SERIAL_BAUDRATE", c.Dongle.Baudrate)
+	c.Dongle.Parity = goutils.GetEnv("SERIAL_PARITY", c.Dongle.Parity)
+	c.Dongle.ReadTimeout = Duration(time.Duration(goutils.GetIntEnv("SERIAL_READ_TIMEOUT_SECONDS",
+		int(c.Dongle.ReadTimeout.Duration()/time.Second))) * time.Second)
+	c.Dongle.ConnectRetryCount = goutils.GetIntEnv("CONNECT_RETRY_COUNT", c.Dongle.ConnectRetryCount)
+
+	c.Meter.BRouteID = goutils.GetEnv("B_ROUTE_ID", c.Meter.BRouteID)
+	c.Meter.BRoutePassword = goutils.GetEnv("B_ROUTE_PASSWORD", c.Meter.BRoutePassword)
+	c.Meter.BRouteIDFile = goutils.GetEnv("B_ROUTE_ID_FILE", c.Meter.BRouteIDFile)
+	c.Meter.BRoutePasswordFile = goutils.GetEnv("B_ROUTE_PASSWORD_FILE", c.Meter.BRoutePasswordFile)
+	c.Meter.CredentialsFile = goutils.GetEnv("CREDENTIALS_FILE", c.Meter.CredentialsFile)
+	c.Meter.CredentialsKeyFile = goutils.GetEnv("CREDENTIALS_KEY_FILE", c.Meter.CredentialsKeyFile)
+
+	c.Polling.Interval = Duration(time.Duration(goutils.GetIntEnv("REFRESH_SECONDS",
+		int(c.Polling.Interval.Duration()/time.Second))) * time.Second)
+	c.Polling.UnitTimeCron = goutils.GetEnv("POWER_CONSUMPTION_CRON_EXPR_STRING", c.Polling.UnitTimeCron)
+
+	c.Metrics.Path = goutils.GetEnv("METRICS_PATH", c.Metrics.Path)
+	c.Metrics.StaleAfter = Duration(time.Duration(goutils.GetIntEnv("METRICS_STALE_AFTER_SECONDS",
+		int(c.Metrics.StaleAfter.Duration()/time.Second))) * time.Second)
+	c.Metrics.Timestamps = goutils.GetBoolEnv("METRICS_TIMESTAMPS", c.Metrics.Timestamps)
+
+	c.Sinks.MQTT.Enabled = goutils.GetBoolEnv("MQTT_ENABLED", c.Sinks.MQTT.Enabled)
+	c.Sinks.MQTT.Broker = goutils.GetEnv("MQTT_BROKER", c.Sinks.MQTT.Broker)
+	c.Sinks.MQTT.Username = goutils.GetEnv("MQTT_USERNAME", c.Sinks.MQTT.Username)
+	c.Sinks.MQTT.Password = goutils.GetEnv("MQTT_PASSWORD", c.Sinks.MQTT.Password)
+	c.Sinks.MQTT.PasswordFile = goutils.GetEnv("MQTT_PASSWORD_FILE", c.Sinks.MQTT.PasswordFile)
+	c.Sinks.MQTT.HomeAssistant.Enabled = goutils.GetBoolEnv("MQTT_HOME_ASSISTANT_ENABLED", c.Sinks.MQTT.HomeAssistant.Enabled)
+
+	c.Sinks.InfluxDB.Enabled = goutils.GetBoolEnv("INFLUXDB_ENABLED", c.Sinks.InfluxDB.Enabled)
+	c.Sinks.InfluxDB.URL = goutils.GetEnv("INFLUXDB_URL", c.Sinks.InfluxDB.URL)
+	c.Sinks.InfluxDB.Password = goutils.GetEnv("INFLUXDB_PASSWORD", c.Sinks.InfluxDB.Password)
+	c.Sinks.InfluxDB.PasswordFile = goutils.GetEnv("INFLUXDB_PASSWORD_FILE", c.Sinks.InfluxDB.PasswordFile)
+	c.Sinks.InfluxDB.Token = goutils.GetEnv("INFLUXDB_TOKEN", c.Sinks.InfluxDB.Token)
+	c.Sinks.InfluxDB.TokenFile = goutils.GetEnv("INFLUXDB_TOKEN_FILE", c.Sinks.InfluxDB.TokenFile)
+
+	c.Sinks.RemoteWrite.Enabled = goutils.GetBoolEnv("REMOTE_WRITE_ENABLED", c.Sinks.RemoteWrite.Enabled)
+	c.Sinks.RemoteWrite.URL = goutils.GetEnv("REMOTE_WRITE_URL", c.Sinks.RemoteWrite.URL)
+	c.Sinks.RemoteWrite.Username = goutils.GetEnv("REMOTE_WRITE_USERNAME", c.Sinks.RemoteWrite.Username)
+	c.Sinks.RemoteWrite.Password = goutils.GetEnv("REMOTE_WRITE_PASSWORD", c.Sinks.RemoteWrite.Password)
+	c.Sinks.RemoteWrite.PasswordFile = goutils.GetEnv("REMOTE_WRITE_PASSWORD_FILE", c.Sinks.RemoteWrite.PasswordFile)
+	c.Sinks.RemoteWrite.BearerToken = goutils.GetEnv("REMOTE_WRITE_BEARER_TOKEN", c.Sinks.RemoteWrite.BearerToken)
+	c.Sinks.RemoteWrite.BearerTokenFile = goutils.GetEnv("REMOTE_WRITE_BEARER_TOKEN_FILE", c.Sinks.RemoteWrite.BearerTokenFile)
+
+	c.Sinks.OTLP.Enabled = goutils.GetBoolEnv("OTLP_ENABLED", c.Sinks.OTLP.Enabled)
+	c.Sinks.OTLP.Protocol = goutils.GetEnv("OTLP_PROTOCOL", c.Sinks.OTLP.Protocol)
+	c.Sinks.OTLP.Endpoint = goutils.GetEnv("OTLP_ENDPOINT", c.Sinks.OTLP.Endpoint)
+	c.Sinks.OTLP.Insecure = goutils.GetBoolEnv("OTLP_INSECURE", c.Sinks.OTLP.Insecure)
+	c.Sinks.OTLP.Traces = goutils.GetBoolEnv("OTLP_TRACES", c.Sinks.OTLP.Traces)
+
+	c.Storage.Enabled = goutils.GetBoolEnv("STORAGE_ENABLED", c.Storage.Enabled)
+	c.Storage.Dir = goutils.GetEnv("STORAGE_DIR", c.Storage.Dir)
+
+	c.State.File = goutils.GetEnv("STATE_FILE", c.State.File)
+
+	c.Billing.ReadingDay = goutils.GetIntEnv("BILLING_READING_DAY", c.Billing.ReadingDay)
+
+	c.Tariff.Enabled = goutils.GetBoolEnv("TARIFF_ENABLED", c.Tariff.Enabled)
+	c.Tariff.ContractAmperes = goutils.GetIntEnv("TARIFF_CONTRACT_AMPERES", c.Tariff.ContractAmperes)
+
+	c.Breaker.Enabled = goutils.GetBoolEnv("BREAKER_ENABLED", c.Breaker.Enabled)
+	c.Breaker.ContractAmperes = goutils.GetIntEnv("BREAKER_CONTRACT_AMPERES", c.Breaker.ContractAmperes)
+	c.Breaker.Notify.Webhook.Enabled = goutils.GetBoolEnv("BREAKER_WEBHOOK_ENABLED", c.Breaker.Notify.Webhook.Enabled)
+	c.Breaker.Notify.Webhook.URL = goutils.GetEnv("BREAKER_WEBHOOK_URL", c.Breaker.Notify.Webhook.URL)
+
+	c.HTTP.Listen = goutils.GetEnv("LISTEN_ADDRESS", c.HTTP.Listen)
+	c.HTTP.AdminListen = goutils.GetEnv("ADMIN_LISTEN_ADDRESS", c.HTTP.AdminListen)
+	c.HTTP.ShutdownTimeout = Duration(time.Duration(goutils.GetIntEnv("SHUTDOWN_TIMEOUT_SECONDS",
+		int(c.HTTP.ShutdownTimeout.Duration()/time.Second))) * time.Second)
+}
+
+// Location returns the location of the timezone, it is validated on load.
+func (c *Config) Location() *time.Location {
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// DongleConfig converts the dongle section into the config of the dongle package.
+func (c *Config) DongleConfig() dongle.DongleConfig {
+	parity, _ := dongle.ParseParity(c.Dongle.Parity)
+
+	readTimeout := c.Dongle.ReadTimeout.Duration()
+	if readTimeout == 0 {
+		readTimeout = c.Polling.Interval.Duration() * 2
+	}
+
+	return dongle.DongleConfig{
+		SerialDevice:      c.Dongle.Device,
+		DeviceGlob:        c.Dongle.DeviceGlob,
+		Baudrate:          c.Dongle.Baudrate,
+		Parity:            parity,
+		ReadTimeout:       readTimeout,
+		ConnectRetryCount: c.Dongle.ConnectRetryCount,
+	}
+}
+
+// Redacted returns a copy of the config which is safe to print.
+func (c *Config) Redacted() *Config {
+	r := *c
+	if len(r.Meter.BRouteID) > 0 {
+		r.Meter.BRouteID = redacted
+	}
+	if len(r.Meter.BRoutePassword) > 0 {
+		r.Meter.BRoutePassword = redacted
+	}
+	if len(r.Sinks.MQTT.Password) > 0 {
+		r.Sinks.MQTT.Password = redacted
+	}
+	if len(r.Sinks.InfluxDB.Password) > 0 {
+		r.Sinks.InfluxDB.Password = redacted
+	}
+	if len(r.Sinks.InfluxDB.Token) > 0 {
+		r.Sinks.InfluxDB.Token = redacted
+	}
+	if len(r.Sinks.RemoteWrite.Password) > 0 {
+		r.Sinks.RemoteWrite.Password = redacted
+	}
+	if len(r.Sinks.RemoteWrite.BearerToken) > 0 {
+		r.Sinks.RemoteWrite.BearerToken = redacted
+	}
+	// the headers carry the api keys
+	if len(r.Sinks.OTLP.Headers) > 0 {
+		headers := map[string]string{}
+		for k := range r.Sinks.OTLP.Headers {
+			headers[k] = redacted
+		}
+		r.Sinks.OTLP.Headers = headers
+	}
+	if len(r.Breaker.Notify.Webhook.Headers) > 0 {
+		headers := map[string]string{}
+		for k := range r.Breaker.Notify.Webhook.Headers {
+			headers[k] = redacted
+		}
+		r.Breaker.Notify.Webhook.Headers = headers
+	}
+	return &r
+}
+
+func (c *Config) String() string {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return strings.TrimSpace(string(b))
+}
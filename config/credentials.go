@@ -0,0 +1,207 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the placeholders which were the defaults once, never valid for a real meter
+const (
+	placeholderBRouteID       = "0123456789ABCDEF0123456789ABCDEF"
+	placeholderBRoutePassword = "0123456789AB"
+)
+
+// systemd credential names, see systemd.exec(5) LoadCredential=
+const (
+	credentialBRouteID       = "b_route_id"
+	credentialBRoutePassword = "b_route_password"
+)
+
+type credentials struct {
+	BRouteID       string `yaml:"b_route_id"`
+	BRoutePassword string `yaml:"b_route_password"`
+}
+
+// loadCredentials resolves the B-route credentials. The first one found is used:
+// the *_file paths, the systemd credentials directory, the encrypted credentials file
+// and the plain values. The passwords of the sinks are read from their *_file too.
+func (c *Config) loadCredentials() error {
+	m := &c.Meter
+
+	if len(m.CredentialsFile) > 0 {
+		creds, err := readEncryptedCredentials(m.CredentialsFile, m.CredentialsKeyFile)
+		if err != nil {
+			return err
+		}
+		if len(creds.BRouteID) > 0 {
+			m.BRouteID = creds.BRouteID
+		}
+		if len(creds.BRoutePassword) > 0 {
+			m.BRoutePassword = creds.BRoutePassword
+		}
+	}
+
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); len(dir) > 0 {
+		if v, err := readSecretFile(filepath.Join(dir, credentialBRouteID)); err == nil {
+			m.BRouteID = v
+		}
+		if v, err := readSecretFile(filepath.Join(dir, credentialBRoutePassword)); err == nil {
+			m.BRoutePassword = v
+		}
+	}
+
+	if len(m.BRouteIDFile) > 0 {
+		v, err := readSecretFile(m.BRouteIDFile)
+		if err != nil {
+			return fmt.Errorf("read b_route_id_file is failed: %w", err)
+		}
+		m.BRouteID = v
+	}
+	if len(m.BRoutePasswordFile) > 0 {
+		v, err := readSecretFile(m.BRoutePasswordFile)
+		if err != nil {
+			return fmt.Errorf("read b_route_password_file is failed: %w", err)
+		}
+		m.BRoutePassword = v
+	}
+
+	if len(c.Sinks.MQTT.PasswordFile) > 0 {
+		v, err := readSecretFile(c.Sinks.MQTT.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("read sinks.mqtt.password_file is failed: %w", err)
+		}
+		c.Sinks.MQTT.Password = v
+	}
+
+	if len(c.Sinks.InfluxDB.PasswordFile) > 0 {
+		v, err := readSecretFile(c.Sinks.InfluxDB.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("read sinks.influxdb.password_file is failed: %w", err)
+		}
+		c.Sinks.InfluxDB.Password = v
+	}
+	if len(c.Sinks.InfluxDB.TokenFile) > 0 {
+		v, err := readSecretFile(c.Sinks.InfluxDB.TokenFile)
+		if err != nil {
+			return fmt.Errorf("read sinks.influxdb.token_file is failed: %w", err)
+		}
+		c.Sinks.InfluxDB.Token = v
+	}
+
+	if len(c.Sinks.RemoteWrite.PasswordFile) > 0 {
+		v, err := readSecretFile(c.Sinks.RemoteWrite.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("read sinks.remote_write.password_file is failed: %w", err)
+		}
+		c.Sinks.RemoteWrite.Password = v
+	}
+	if len(c.Sinks.RemoteWrite.BearerTokenFile) > 0 {
+		v, err := readSecretFile(c.Sinks.RemoteWrite.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("read sinks.remote_write.bearer_token_file is failed: %w", err)
+		}
+		c.Sinks.RemoteWrite.BearerToken = v
+	}
+
+	return nil
+}
+
+func readSecretFile(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// credentialsKey derives the AES-256 key from the content of the key file.
+func credentialsKey(keyFile string) ([]byte, error) {
+	if len(keyFile) == 0 {
+		return nil, fmt.Errorf("credentials_key_file is not set")
+	}
+	k, err := readSecretFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials_key_file is failed: %w", err)
+	}
+	if len(k) == 0 {
+		return nil, fmt.Errorf("credentials_key_file is empty")
+	}
+	sum := sha256.Sum256([]byte(k))
+	return sum[:], nil
+}
+
+func readEncryptedCredentials(file string, keyFile string) (*credentials, error) {
+	key, err := credentialsKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials_file is failed: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("credentials_file is not base64: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("credentials_file is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt credentials_file is failed, wrong key?")
+	}
+
+	creds := &credentials{}
+	if err := yaml.UnmarshalStrict(plain, creds); err != nil {
+		return nil, fmt.Errorf("parse credentials_file is failed: %w", err)
+	}
+	return creds, nil
+}
+
+// EncryptCredentials writes the credentials encrypted with the key file, to be read by meter.credentials_file.
+func EncryptCredentials(w io.Writer, keyFile string, bRouteID string, bRoutePassword string) error {
+	key, err := credentialsKey(keyFile)
+	if err != nil {
+		return err
+	}
+	plain, err := yaml.Marshal(&credentials{BRouteID: bRouteID, BRoutePassword: bRoutePassword})
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data := gcm.Seal(nonce, nonce, plain, nil)
+	_, err = fmt.Fprintln(w, base64.StdEncoding.EncodeToString(data))
+	return err
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseClock parses 15:04 as the offset from midnight, 24:00 is the end of the day.
+func ParseClock(s string) (time.Duration, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, herr := strconv.Atoi(h)
+	minute, merr := strconv.Atoi(m)
+	if !ok || herr != nil || merr != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("time must be 15:04: %s", s)
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// ParseDays parses the days of a time of use rate, empty is every day including the holidays.
+// A holiday is matched only by holiday, not by its day of the week.
+func ParseDays(days []string) (weekdays [7]bool, holiday bool, err error) {
+	if len(days) == 0 {
+		for i := range weekdays {
+			weekdays[i] = true
+		}
+		return weekdays, true, nil
+	}
+	names := []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	for _, day := range days {
+		switch day = strings.ToLower(day); day {
+		case "weekday":
+			for i := time.Monday; i <= time.Friday; i++ {
+				weekdays[i] = true
+			}
+		case "weekend":
+			weekdays[time.Saturday], weekdays[time.Sunday] = true, true
+		case "holiday":
+			holiday = true
+		default:
+			found := false
+			for i, name := range names {
+				if day == name {
+					weekdays[i] = true
+					found = true
+				}
+			}
+			if !found {
+				return weekdays, false, fmt.Errorf("day must be mon ... sun, weekday, weekend or holiday: %s", day)
+			}
+		}
+	}
+	return weekdays, holiday, nil
+}
+
+func (c *Config) validateTariff() []string {
+	t := c.Tariff
+	errs := []string{}
+	if len(t.BasicCharges) > 0 {
+		if _, ok := t.BasicCharges[t.ContractAmperes]; !ok {
+			errs = append(errs, fmt.Sprintf("tariff.basic_charges has no charge of tariff.contract_amperes: %d", t.ContractAmperes))
+		}
+	}
+	if len(t.Tiers) == 0 && len(t.TimeOfUse) == 0 {
+		errs = append(errs, "tariff needs tiers or time_of_use")
+	}
+	for i, tier := range t.Tiers {
+		last := i == len(t.Tiers)-1
+		if last && tier.UpTo != 0 {
+			errs = append(errs, "the last of tariff.tiers must be unbounded (up_to: 0)")
+		}
+		if !last && (tier.UpTo <= 0 || (i > 0 && tier.UpTo <= t.Tiers[i-1].UpTo)) {
+			errs = append(errs, fmt.Sprintf("tariff.tiers up_to must be increasing: %v", tier.UpTo))
+		}
+	}
+	for _, rate := range t.TimeOfUse {
+		if (len(rate.Start) == 0) != (len(rate.End) == 0) {
+			errs = append(errs, fmt.Sprintf("tariff.time_of_use %s needs both start and end", rate.Name))
+		}
+		for _, s := range []string{rate.Start, rate.End} {
+			if len(s) > 0 {
+				if _, err := ParseClock(s); err != nil {
+					errs = append(errs, fmt.Sprintf("tariff.time_of_use %s: %v", rate.Name, err))
+				}
+			}
+		}
+		if _, _, err := ParseDays(rate.Days); err != nil {
+			errs = append(errs, fmt.Sprintf("tariff.time_of_use %s: %v", rate.Name, err))
+		}
+	}
+	for _, m := range []map[string]float64{t.FuelCostAdjustment, t.RenewableSurcharge} {
+		for month := range m {
+			if _, err := time.Parse("2006-01", month); err != nil {
+				errs = append(errs, fmt.Sprintf("tariff month must be 2006-01: %s", month))
+			}
+		}
+	}
+	for _, day := range t.Holidays {
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			errs = append(errs, fmt.Sprintf("tariff.holidays must be 2006-01-02: %s", day))
+		}
+	}
+	return errs
+}
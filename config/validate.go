@@ -0,0 +1,259 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+	"github.com/michibiki-io/goutils"
+	"github.com/michibiki-io/hems-metrics-go/dongle"
+	"go.uber.org/zap/zapcore"
+)
+
+func (c *Config) Validate() error {
+	errs := []string{}
+
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		errs = append(errs, fmt.Sprintf("timezone is invalid: %v", err))
+	}
+
+	switch strings.ToLower(c.Log.Mode) {
+	case "release", "debug":
+	default:
+		errs = append(errs, fmt.Sprintf("log.mode must be release or debug: %s", c.Log.Mode))
+	}
+	switch strings.ToLower(c.Log.Format) {
+	case "", "json", "console", "logfmt":
+	default:
+		errs = append(errs, fmt.Sprintf("log.format must be json, console or logfmt: %s", c.Log.Format))
+	}
+	if len(c.Log.Level) > 0 {
+		if _, err := zapcore.ParseLevel(c.Log.Level); err != nil {
+			errs = append(errs, fmt.Sprintf("log.level is invalid: %v", err))
+		}
+	}
+
+	if c.Dongle.Baudrate <= 0 {
+		errs = append(errs, fmt.Sprintf("dongle.baudrate must be positive: %d", c.Dongle.Baudrate))
+	}
+	if _, err := dongle.ParseParity(c.Dongle.Parity); err != nil {
+		errs = append(errs, fmt.Sprintf("dongle.parity: %v", err))
+	}
+	if c.Dongle.ReadTimeout < 0 {
+		errs = append(errs, "dongle.read_timeout must not be negative")
+	}
+	if c.Dongle.ConnectRetryCount <= 0 {
+		errs = append(errs, fmt.Sprintf("dongle.connect_retry_count must be positive: %d", c.Dongle.ConnectRetryCount))
+	}
+
+	if len(c.Meter.BRouteID) != 32 || !isHex(c.Meter.BRouteID) {
+		errs = append(errs, fmt.Sprintf("meter.b_route_id must be 32 hex characters: length %d", len(c.Meter.BRouteID)))
+	}
+	if len(c.Meter.BRoutePassword) != 12 {
+		errs = append(errs, fmt.Sprintf("meter.b_route_password must be 12 characters: length %d", len(c.Meter.BRoutePassword)))
+	}
+
+	if c.Meter.BRouteID == placeholderBRouteID || c.Meter.BRoutePassword == placeholderBRoutePassword {
+		errs = append(errs, "meter credentials are the placeholder values, set the B-route ID and password of your contract")
+	}
+
+	if c.Polling.Interval <= 0 {
+		errs = append(errs, "polling.interval must be positive")
+	}
+	if _, err := cronexpr.Parse(c.Polling.UnitTimeCron); err != nil {
+		errs = append(errs, fmt.Sprintf("polling.unit_time_cron is invalid: %v", err))
+	}
+
+	if !strings.HasPrefix(c.Metrics.Path, "/") {
+		errs = append(errs, fmt.Sprintf("metrics.path must start with /: %s", c.Metrics.Path))
+	}
+	if len(c.Metrics.Namespace) == 0 {
+		errs = append(errs, "metrics.namespace must not be empty")
+	}
+	if c.Metrics.StaleAfter < 0 {
+		errs = append(errs, "metrics.stale_after must not be negative")
+	}
+
+	if len(c.HTTP.Listen) == 0 {
+		errs = append(errs, "http.listen must not be empty")
+	}
+	if c.HTTP.ShutdownTimeout <= 0 {
+		errs = append(errs, "http.shutdown_timeout must be positive")
+	}
+
+	if c.API.HistorySize <= 0 {
+		errs = append(errs, fmt.Sprintf("api.history_size must be positive: %d", c.API.HistorySize))
+	}
+	if c.API.SlotHistorySize <= 0 {
+		errs = append(errs, fmt.Sprintf("api.slot_history_size must be positive: %d", c.API.SlotHistorySize))
+	}
+
+	if c.API.StreamMaxClients <= 0 {
+		errs = append(errs, fmt.Sprintf("api.stream_max_clients must be positive: %d", c.API.StreamMaxClients))
+	}
+	if c.API.StreamBufferSize <= 0 {
+		errs = append(errs, fmt.Sprintf("api.stream_buffer_size must be positive: %d", c.API.StreamBufferSize))
+	}
+
+	if storage := c.Storage; storage.Enabled {
+		if len(storage.Dir) == 0 {
+			errs = append(errs, "storage.dir must not be empty")
+		}
+		if storage.RawRetention < 0 || storage.MinuteRetention < 0 || storage.SlotRetention < 0 {
+			errs = append(errs, "storage retentions must not be negative")
+		}
+		if storage.SyncInterval < 0 {
+			errs = append(errs, "storage.sync_interval must not be negative")
+		}
+	}
+
+	if c.Billing.ReadingDay < 1 || c.Billing.ReadingDay > 31 {
+		errs = append(errs, fmt.Sprintf("billing.reading_day must be 1-31: %d", c.Billing.ReadingDay))
+	}
+
+	if c.Tariff.Enabled {
+		errs = append(errs, c.validateTariff()...)
+	}
+
+	if c.Breaker.Enabled {
+		errs = append(errs, c.validateBreaker()...)
+	}
+
+	if c.State.SaveInterval < 0 || c.State.MaxAge < 0 {
+		errs = append(errs, "state.save_interval and state.max_age must not be negative")
+	}
+
+	if mqtt := c.Sinks.MQTT; mqtt.Enabled {
+		if u, err := url.Parse(mqtt.Broker); err != nil || !goutils.StringsContains([]string{"tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss"}, u.Scheme) {
+			errs = append(errs, fmt.Sprintf("sinks.mqtt.broker must be tcp://, ssl://, ws:// or wss:// url: %s", mqtt.Broker))
+		}
+		if len(mqtt.ClientID) == 0 {
+			errs = append(errs, "sinks.mqtt.client_id must not be empty")
+		}
+		if mqtt.QoS > 2 {
+			errs = append(errs, fmt.Sprintf("sinks.mqtt.qos must be 0, 1 or 2: %d", mqtt.QoS))
+		}
+		if ha := mqtt.HomeAssistant; ha.Enabled {
+			if len(ha.DiscoveryPrefix) == 0 || len(ha.NodeID) == 0 {
+				errs = append(errs, "sinks.mqtt.home_assistant.discovery_prefix and node_id must not be empty")
+			}
+			if len(mqtt.Topics.State) == 0 || len(mqtt.Topics.Availability) == 0 {
+				errs = append(errs, "sinks.mqtt.topics.state and availability are required by home_assistant")
+			}
+		}
+	}
+
+	if influx := c.Sinks.InfluxDB; influx.Enabled {
+		u, err := url.Parse(influx.URL)
+		if err != nil || !goutils.StringsContains([]string{"http", "https", "udp"}, u.Scheme) {
+			errs = append(errs, fmt.Sprintf("sinks.influxdb.url must be http://, https:// or udp:// url: %s", influx.URL))
+		} else if u.Scheme != "udp" {
+			switch influx.Version {
+			case 1:
+				if len(influx.Database) == 0 {
+					errs = append(errs, "sinks.influxdb.database is required by version 1")
+				}
+			case 2:
+				if len(influx.Org) == 0 || len(influx.Bucket) == 0 {
+					errs = append(errs, "sinks.influxdb.org and bucket are required by version 2")
+				}
+			default:
+				errs = append(errs, fmt.Sprintf("sinks.influxdb.version must be 1 or 2: %d", influx.Version))
+			}
+		}
+		if len(influx.Measurement) == 0 {
+			errs = append(errs, "sinks.influxdb.measurement must not be empty")
+		}
+		if influx.BatchSize <= 0 || influx.FlushInterval <= 0 || influx.Timeout <= 0 || influx.RetryInterval <= 0 {
+			errs = append(errs, "sinks.influxdb.batch_size, flush_interval, timeout and retry_interval must be positive")
+		}
+	}
+
+	if rw := c.Sinks.RemoteWrite; rw.Enabled {
+		if u, err := url.Parse(rw.URL); err != nil || !goutils.StringsContains([]string{"http", "https"}, u.Scheme) {
+			errs = append(errs, fmt.Sprintf("sinks.remote_write.url must be http:// or https:// url: %s", rw.URL))
+		}
+		if len(rw.Username) > 0 && len(rw.BearerToken) > 0 {
+			errs = append(errs, "sinks.remote_write.username and bearer_token are exclusive")
+		}
+		for name := range rw.ExternalLabels {
+			if !isLabelName(name) {
+				errs = append(errs, fmt.Sprintf("sinks.remote_write.external_labels has invalid label name: %s", name))
+			}
+		}
+		if len(rw.WALDir) == 0 {
+			errs = append(errs, "sinks.remote_write.wal_dir must not be empty")
+		}
+		if rw.BatchSize <= 0 || rw.FlushInterval <= 0 || rw.Timeout <= 0 || rw.RetryInterval <= 0 {
+			errs = append(errs, "sinks.remote_write.batch_size, flush_interval, timeout and retry_interval must be positive")
+		}
+	}
+
+	if otlp := c.Sinks.OTLP; otlp.Enabled {
+		if otlp.Protocol != "grpc" && otlp.Protocol != "http" {
+			errs = append(errs, fmt.Sprintf("sinks.otlp.protocol must be grpc or http: %s", otlp.Protocol))
+		}
+		if _, _, err := net.SplitHostPort(otlp.Endpoint); err != nil {
+			errs = append(errs, fmt.Sprintf("sinks.otlp.endpoint must be host:port: %s", otlp.Endpoint))
+		}
+		if len(otlp.ServiceName) == 0 {
+			errs = append(errs, "sinks.otlp.service_name must not be empty")
+		}
+		if otlp.ExportInterval <= 0 || otlp.Timeout <= 0 {
+			errs = append(errs, "sinks.otlp.export_interval and timeout must be positive")
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config is invalid:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// ValidateExport validates the config of the export command, the storage and the billing periods and the tariff.
+func (c *Config) ValidateExport() error {
+	errs := []string{}
+
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		errs = append(errs, fmt.Sprintf("timezone is invalid: %v", err))
+	}
+	if len(c.Storage.Dir) == 0 {
+		errs = append(errs, "storage.dir must not be empty")
+	}
+	if c.Billing.ReadingDay < 1 || c.Billing.ReadingDay > 31 {
+		errs = append(errs, fmt.Sprintf("billing.reading_day must be 1-31: %d", c.Billing.ReadingDay))
+	}
+	if c.Tariff.Enabled {
+		errs = append(errs, c.validateTariff()...)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config is invalid:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// isLabelName is [a-zA-Z_][a-zA-Z0-9_]* of Prometheus, and not reserved by __
+func isLabelName(s string) bool {
+	if len(s) == 0 || strings.HasPrefix(s, "__") {
+		return false
+	}
+	for i, r := range s {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
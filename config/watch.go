@@ -0,0 +1,60 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Watch reloads the config on SIGHUP and when the config file is modified, and passes
+// the new one to f. An invalid config is reported and the running one is kept.
+func Watch(ctx context.Context, logger *zap.Logger, current *Config, name string, args []string, f func(*Config)) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// the file is polled, so that the symlink swap of a kubernetes configmap is also detected
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	modTime := fileModTime(current.File)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("SIGHUP is received, reload config")
+		case <-t.C:
+			m := fileModTime(current.File)
+			if m.Equal(modTime) {
+				continue
+			}
+			modTime = m
+			logger.Info("config file is modified, reload config")
+		}
+
+		c, err := Load(name, args)
+		if err != nil {
+			logger.Error("reload config is failed, keep the running config", zap.Error(err))
+			continue
+		}
+		current = c
+		f(c)
+	}
+}
+
+func fileModTime(file string) time.Time {
+	if len(file) == 0 {
+		return time.Time{}
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
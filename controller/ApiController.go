@@ -0,0 +1,512 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/export"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"github.com/michibiki-io/hems-metrics-go/rollup"
+	"github.com/michibiki-io/hems-metrics-go/storage"
+	"github.com/michibiki-io/hems-metrics-go/tariff"
+	"github.com/michibiki-io/hems-metrics-go/utility/ring"
+	"go.uber.org/zap"
+)
+
+// json views of the api, see docs/api.md for the schemas
+
+type MeterResponse struct {
+	ManufacturerCode string `json:"manufacturer_code"`
+	SerialNumber     string `json:"serial_number"`
+	DongleVersion    string `json:"dongle_version"`
+}
+
+type ReadingResponse struct {
+	Timestamp           time.Time `json:"timestamp"`
+	CumulativeEnergyKWh float32   `json:"cumulative_energy_kwh"`
+	// CumulativeExportedEnergyKWh is 0 when the meter does not measure the export
+	CumulativeExportedEnergyKWh float32    `json:"cumulative_exported_energy_kwh"`
+	InstantaneousPowerW         int        `json:"instantaneous_power_w"`
+	CurrentA                    float32    `json:"current_a"`
+	RPhaseCurrentA              float32    `json:"r_phase_current_a"`
+	TPhaseCurrentA              float32    `json:"t_phase_current_a"`
+	PowerFactorPercent          float32    `json:"power_factor_percent"`
+	UnitTimeEnergyKWh           float32    `json:"unit_time_energy_kwh"`
+	UnitTimeStart               *time.Time `json:"unit_time_start"`
+	UnitTimeEnd                 *time.Time `json:"unit_time_end"`
+}
+
+type LatestResponse struct {
+	Meter   *MeterResponse   `json:"meter"`
+	Reading *ReadingResponse `json:"reading"`
+}
+
+type ReadingsResponse struct {
+	Meter    *MeterResponse    `json:"meter"`
+	Readings []ReadingResponse `json:"readings"`
+}
+
+type SlotResponse struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	EnergyKWh float32   `json:"energy_kwh"`
+	// CumulativeEnergyKWh is the cumulative energy at the end of the slot
+	CumulativeEnergyKWh float32 `json:"cumulative_energy_kwh"`
+	ExportedKWh         float32 `json:"exported_kwh"`
+}
+
+type SlotsResponse struct {
+	Meter *MeterResponse `json:"meter"`
+	Slots []SlotResponse `json:"slots"`
+}
+
+type HistoryRecordResponse struct {
+	Time time.Time `json:"time"`
+	// End is the end of the slot, 30m only
+	End                 *time.Time `json:"end,omitempty"`
+	CumulativeEnergyKWh float32    `json:"cumulative_energy_kwh"`
+	PowerW              float32    `json:"power_w"`
+	PowerMinW           float32    `json:"power_min_w"`
+	PowerMaxW           float32    `json:"power_max_w"`
+	CurrentA            float32    `json:"current_a"`
+	RPhaseCurrentA      float32    `json:"r_phase_current_a"`
+	TPhaseCurrentA      float32    `json:"t_phase_current_a"`
+	PowerFactorPercent  float32    `json:"power_factor_percent"`
+	EnergyKWh           float32    `json:"energy_kwh"`
+	// ExportedEnergyKWh is the one of the slot for 30m, the cumulative one otherwise
+	ExportedEnergyKWh float32 `json:"exported_energy_kwh"`
+	Count             uint32  `json:"count"`
+}
+
+type HistoryResponse struct {
+	Meter      *MeterResponse          `json:"meter"`
+	Resolution string                  `json:"resolution"`
+	From       time.Time               `json:"from"`
+	To         time.Time               `json:"to"`
+	Records    []HistoryRecordResponse `json:"records"`
+}
+
+type RollupResponse struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	EnergyKWh float64   `json:"energy_kwh"`
+	Slots     int       `json:"slots"`
+}
+
+type RollupsResponse struct {
+	Meter   *MeterResponse   `json:"meter"`
+	Period  string           `json:"period"`
+	Rollups []RollupResponse `json:"rollups"`
+}
+
+type BillResponse struct {
+	Meter    *MeterResponse `json:"meter"`
+	Start    time.Time      `json:"start"`
+	End      time.Time      `json:"end"`
+	Currency string         `json:"currency"`
+	// Slots is the number of the priced unit times
+	Slots              int     `json:"slots"`
+	ImportedKWh        float64 `json:"imported_kwh"`
+	ExportedKWh        float64 `json:"exported_kwh"`
+	BasicCharge        float64 `json:"basic_charge"`
+	EnergyCharge       float64 `json:"energy_charge"`
+	FuelCostAdjustment float64 `json:"fuel_cost_adjustment"`
+	RenewableSurcharge float64 `json:"renewable_surcharge"`
+	FeedInCredit       float64 `json:"feed_in_credit"`
+	Amount             float64 `json:"amount"`
+	ProjectedKWh       float64 `json:"projected_kwh"`
+	ProjectedAmount    float64 `json:"projected_amount"`
+}
+
+type StatusResponse struct {
+	Ready       bool           `json:"ready"`
+	Connected   bool           `json:"connected"`
+	ConnectedAt *time.Time     `json:"connected_at"`
+	LastReadAt  *time.Time     `json:"last_read_at"`
+	LastError   string         `json:"last_error"`
+	LastErrorAt *time.Time     `json:"last_error_at"`
+	Meter       *MeterResponse `json:"meter"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type ApiController struct {
+	logger             *zap.Logger
+	hemsDataController *HemsDataController
+	location           *time.Location
+	readings           *ring.Ring[*model.HemsData]
+	slots              *ring.Ring[model.Slot]
+	rollups            *rollup.Rollups
+	tariff             *tariff.Engine
+	// store and exporter are nil when the storage is disabled
+	store    *storage.Store
+	exporter *export.Exporter
+}
+
+func CreateApiController(l *zap.Logger, cfg *config.Config, hemsDataController *HemsDataController,
+	rollups *rollup.Rollups, tariffEngine *tariff.Engine, store *storage.Store) *ApiController {
+	controller := &ApiController{
+		logger:             l,
+		hemsDataController: hemsDataController,
+		rollups:            rollups,
+		tariff:             tariffEngine,
+		store:              store,
+		location:           cfg.Location(),
+		readings:           ring.NewRing[*model.HemsData](cfg.API.HistorySize),
+		slots:              ring.NewRing[model.Slot](cfg.API.SlotHistorySize),
+	}
+	if store != nil {
+		controller.exporter = export.NewExporter(store, rollups.Calendar(), tariffEngine)
+	}
+	return controller
+}
+
+// Update records the reading, and the slots when unit times are ended.
+func (controller *ApiController) Update(data *model.HemsData) {
+	if data == nil {
+		return
+	}
+
+	for _, slot := range data.Slots {
+		last := controller.slots.Last(1)
+		if len(last) == 0 || slot.End.After(last[0].End) {
+			controller.slots.Push(slot)
+		}
+	}
+	controller.readings.Push(data)
+}
+
+func (controller *ApiController) Route(group *gin.RouterGroup) {
+	group.GET("/readings/latest", controller.latest)
+	group.GET("/readings", controller.recent)
+	group.GET("/slots", controller.slotHistory)
+	group.GET("/history", controller.history)
+	group.GET("/export", controller.export)
+	group.GET("/rollups", controller.rollupHistory)
+	group.GET("/bill", controller.bill)
+	group.GET("/status", controller.status)
+}
+
+func (controller *ApiController) latest(c *gin.Context) {
+	last := controller.readings.Last(1)
+	if len(last) == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "no reading yet"})
+		return
+	}
+	c.JSON(http.StatusOK, LatestResponse{
+		Meter:   controller.meter(),
+		Reading: controller.newReadingResponse(last[0]),
+	})
+}
+
+// Latest returns the latest reading, nil before the first one.
+func (controller *ApiController) Latest() *model.HemsData {
+	last := controller.readings.Last(1)
+	if len(last) == 0 {
+		return nil
+	}
+	return last[0]
+}
+
+// recent returns the last n readings, ?limit=n
+func (controller *ApiController) recent(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "limit must be a positive integer"})
+		return
+	}
+
+	readings := []ReadingResponse{}
+	for _, data := range controller.readings.Last(limit) {
+		readings = append(readings, *controller.newReadingResponse(data))
+	}
+	c.JSON(http.StatusOK, ReadingsResponse{
+		Meter:    controller.meter(),
+		Readings: readings,
+	})
+}
+
+// slotHistory returns the ended unit times, ?limit=n
+func (controller *ApiController) slotHistory(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil || limit < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "limit must be a positive integer"})
+		return
+	}
+
+	slots := []SlotResponse{}
+	if controller.store != nil {
+		// the whole history of the store
+		records, err := controller.store.Query(storage.Slot, time.Time{}, time.Time{})
+		if err != nil {
+			controller.logger.Error("query slots is failed", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if limit > 0 && len(records) > limit {
+			records = records[len(records)-limit:]
+		}
+		for _, record := range records {
+			slots = append(slots, SlotResponse{
+				Start:               record.Time.In(controller.location),
+				End:                 record.End.In(controller.location),
+				EnergyKWh:           record.Energy,
+				CumulativeEnergyKWh: record.CumulativeEnergy,
+				ExportedKWh:         record.ExportedEnergy,
+			})
+		}
+	} else {
+		for _, slot := range controller.slots.Last(limit) {
+			slots = append(slots, SlotResponse{
+				Start:               slot.Start.In(controller.location),
+				End:                 slot.End.In(controller.location),
+				EnergyKWh:           slot.EnergyKWh,
+				CumulativeEnergyKWh: slot.CumulativeKWh,
+				ExportedKWh:         slot.ExportedKWh,
+			})
+		}
+	}
+	c.JSON(http.StatusOK, SlotsResponse{
+		Meter: controller.meter(),
+		Slots: slots,
+	})
+}
+
+// history returns the records of the store, ?resolution=raw|1m|30m&from=RFC3339&to=RFC3339
+// the default range is the last 24 hours
+func (controller *ApiController) history(c *gin.Context) {
+	if controller.store == nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "storage is not enabled"})
+		return
+	}
+
+	resolution, err := storage.ParseResolution(c.DefaultQuery("resolution", string(storage.Minute)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	from, to, err := controller.timeRange(c, 24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	records, err := controller.store.Query(resolution, from, to)
+	if err != nil {
+		controller.logger.Error("query history is failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	response := HistoryResponse{
+		Meter:      controller.meter(),
+		Resolution: string(resolution),
+		From:       from.In(controller.location),
+		To:         to.In(controller.location),
+		Records:    []HistoryRecordResponse{},
+	}
+	for _, record := range records {
+		response.Records = append(response.Records, HistoryRecordResponse{
+			Time:                record.Time.In(controller.location),
+			End:                 controller.timeOrNil(record.End),
+			CumulativeEnergyKWh: record.CumulativeEnergy,
+			PowerW:              record.Power,
+			PowerMinW:           record.PowerMin,
+			PowerMaxW:           record.PowerMax,
+			CurrentA:            record.Current,
+			RPhaseCurrentA:      record.RPhaseCurrent,
+			TPhaseCurrentA:      record.TPhaseCurrent,
+			PowerFactorPercent:  record.PowerFactor,
+			EnergyKWh:           record.Energy,
+			ExportedEnergyKWh:   record.ExportedEnergy,
+			Count:               record.Count,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// export returns the history as a file, ?resolution=raw|1m|30m|daily|monthly&format=csv|jsonl|parquet&from=&to=
+func (controller *ApiController) export(c *gin.Context) {
+	if controller.exporter == nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "storage is not enabled"})
+		return
+	}
+
+	resolution, err := export.ParseResolution(c.DefaultQuery("resolution", string(export.Slot)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	format, err := export.ParseFormat(c.DefaultQuery("format", string(export.CSV)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	from, to, err := controller.timeRange(c, resolution.DefaultSpan())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// written to the buffer first, so that an error is still a json response
+	buffer := &bytes.Buffer{}
+	if err := controller.exporter.Export(buffer, format, resolution, from, to); err != nil {
+		controller.logger.Error("export is failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`,
+		format.Filename(resolution, from, to, controller.location)))
+	c.Data(http.StatusOK, format.ContentType(), buffer.Bytes())
+}
+
+// rollupHistory returns the energy per ?period=day|month|billing, the last ?limit=N ones including the current one
+func (controller *ApiController) rollupHistory(c *gin.Context) {
+	period, err := rollup.ParsePeriod(c.DefaultQuery("period", string(rollup.Day)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil || limit < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "limit must be a positive integer"})
+		return
+	}
+
+	totals := controller.rollups.Totals(period, time.Now())
+	if limit > 0 && len(totals) > limit {
+		totals = totals[len(totals)-limit:]
+	}
+	response := RollupsResponse{
+		Meter:   controller.meter(),
+		Period:  string(period),
+		Rollups: []RollupResponse{},
+	}
+	for _, t := range totals {
+		response.Rollups = append(response.Rollups, RollupResponse{
+			Start:     t.Start.In(controller.location),
+			End:       t.End.In(controller.location),
+			EnergyKWh: t.EnergyKWh,
+			Slots:     t.Slots,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// bill returns the cost of the current billing period, to date and projected
+func (controller *ApiController) bill(c *gin.Context) {
+	b, ok := controller.tariff.Bill(time.Now())
+	if !ok {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "tariff is not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, BillResponse{
+		Meter:              controller.meter(),
+		Start:              b.Start.In(controller.location),
+		End:                b.End.In(controller.location),
+		Currency:           b.Currency,
+		Slots:              b.Slots,
+		ImportedKWh:        rollup.Round(b.ImportedKWh),
+		ExportedKWh:        rollup.Round(b.ExportedKWh),
+		BasicCharge:        rollup.Round(b.BasicCharge),
+		EnergyCharge:       rollup.Round(b.Energy),
+		FuelCostAdjustment: rollup.Round(b.FuelCostAdjustment),
+		RenewableSurcharge: rollup.Round(b.RenewableSurcharge),
+		FeedInCredit:       rollup.Round(b.FeedIn),
+		Amount:             rollup.Round(b.Amount),
+		ProjectedKWh:       rollup.Round(b.ProjectedKWh),
+		ProjectedAmount:    rollup.Round(b.ProjectedAmount),
+	})
+}
+
+// timeRange parses ?from and ?to in RFC3339, or dates (2006-01-02) in the configured timezone.
+// to defaults to now, and from to the span before to.
+func (controller *ApiController) timeRange(c *gin.Context, span time.Duration) (time.Time, time.Time, error) {
+	to := time.Now()
+	if v := c.Query("to"); len(v) > 0 {
+		t, err := controller.parseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		to = t
+	}
+	from := to.Add(-span)
+	if v := c.Query("from"); len(v) > 0 {
+		t, err := controller.parseTime(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+func (controller *ApiController) parseTime(v string) (time.Time, error) {
+	return export.ParseTime(v, controller.location)
+}
+
+func (controller *ApiController) status(c *gin.Context) {
+	c.JSON(http.StatusOK, controller.newStatusResponse(controller.hemsDataController.Status()))
+}
+
+func (controller *ApiController) newStatusResponse(status model.ConnectionStatus) *StatusResponse {
+	return &StatusResponse{
+		Ready:       status.Ready,
+		Connected:   status.Connected,
+		ConnectedAt: controller.timeOrNil(status.ConnectedAt),
+		LastReadAt:  controller.timeOrNil(status.LastReadAt),
+		LastError:   status.LastError,
+		LastErrorAt: controller.timeOrNil(status.LastErrorAt),
+		Meter:       newMeterResponse(status.Meter),
+	}
+}
+
+func (controller *ApiController) meter() *MeterResponse {
+	return newMeterResponse(controller.hemsDataController.Status().Meter)
+}
+
+func newMeterResponse(m *model.MeterInfo) *MeterResponse {
+	if m == nil {
+		return nil
+	}
+	return &MeterResponse{
+		ManufacturerCode: m.ManufacturerCode,
+		SerialNumber:     m.SerialNumber,
+		DongleVersion:    m.DongleVersion,
+	}
+}
+
+func (controller *ApiController) newReadingResponse(data *model.HemsData) *ReadingResponse {
+	return &ReadingResponse{
+		Timestamp:                   data.DateTime.In(controller.location),
+		CumulativeEnergyKWh:         data.CumulativePowerConsumption,
+		CumulativeExportedEnergyKWh: data.CumulativePowerExport,
+		InstantaneousPowerW:         data.InstantaneousPowerConsumption,
+		CurrentA:                    data.Current,
+		RPhaseCurrentA:              data.RphaseCurrent,
+		TPhaseCurrentA:              data.TpahseCurrent,
+		PowerFactorPercent:          data.PowerFactor,
+		UnitTimeEnergyKWh:           data.PowerConsumptionPerUnitTime,
+		UnitTimeStart:               controller.timeOrNil(data.UnitTimeStart),
+		UnitTimeEnd:                 controller.timeOrNil(data.UnitTimeEnd),
+	}
+}
+
+// timeOrNil converts the time into the configured timezone, the zero time is null.
+func (controller *ApiController) timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.In(controller.location)
+	return &t
+}
@@ -3,147 +3,714 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/gorhill/cronexpr"
-	"github.com/michibiki-io/goutils"
+	"github.com/michibiki-io/hems-metrics-go/config"
 	"github.com/michibiki-io/hems-metrics-go/dongle"
+	"github.com/michibiki-io/hems-metrics-go/event"
 	"github.com/michibiki-io/hems-metrics-go/model"
+	"github.com/michibiki-io/hems-metrics-go/state"
 	"go.uber.org/zap"
 )
 
-var cronUnitTime = goutils.GetEnv("POWER_CONSUMPTION_CRON_EXPR_STRING", "0,30 * * * *")
+// HemsDataSource is the dongle side of the controller.
+// *dongle.DongleUtil implements it, and a fake can be injected for testing.
+type HemsDataSource interface {
+	SetConfig(cfg dongle.DongleConfig)
+	Init(ctx context.Context, pwd string, rbID string) (bool, error)
+	Fetch(ctx context.Context, f func(result *model.HemsData)) error
+	FetchHistory(ctx context.Context, t time.Time) ([]model.FixedReading, error)
+	Terminate() error
+	Disconnect()
+	MeterInfo() *model.MeterInfo
+}
 
 type HemsDataController struct {
-	logger          *zap.Logger
-	dongle          *dongle.DongleUtil
-	refreshSecond   time.Duration
-	previousData    *model.HemsData
-	nextCronTime    time.Time
-	hemsDataHandler func(model *model.HemsData)
-	readiness       bool
+	logger   *zap.Logger
+	dongle   HemsDataSource
+	bus      *event.Bus
+	fetching sync.WaitGroup
+	reload   chan struct{}
+
+	// mutex guards the fields below, which are written from the fetch
+	// goroutine, the config reload and read from the http handlers
+	mutex         sync.RWMutex
+	refreshSecond time.Duration
+	unitTimeCron  string
+	cronUnitTime  *cronexpr.Expression
+	location      *time.Location
+	dongleConfig  dongle.DongleConfig
+	meter         config.MeterConfig
+	cancelCollect context.CancelFunc
+	previousData  *model.HemsData
+	nextCronTime  time.Time
+	unitTimeStart time.Time
+	readiness     bool
+	status        model.ConnectionStatus
+
+	// the persisted state, see RestoreState
+	stateConfig config.StateConfig
+	lastData    *model.HemsData
+	savedAt     time.Time
+	// restored is true until the restored state is checked against the first live reading
+	restored bool
+
+	// the cumulative energy at the unit time boundaries, the fixed time values of the meter
+	// and the ones which the ended unit times used instead of them, by unix time
+	fixed map[int64]fixedValue
+	// history is the boundaries to read from the history of the meter, backfilled is the
+	// boundary which it is read for
+	history    []time.Time
+	backfilled time.Time
+}
+
+type fixedValue struct {
+	cumulative float32
+	exported   float32
+	metered    bool
 }
 
-func CreateHemsDataController(l *zap.Logger) *HemsDataController {
+// the meter records the fixed time value a little after the boundary, the unit time waits for it
+const fixedTimeWait = 5 * time.Minute
+
+func CreateHemsDataController(l *zap.Logger, cfg *config.Config, metrics *dongle.Metrics) *HemsDataController {
+	return CreateHemsDataControllerWithSource(l, dongle.NewDongleUtil(l, cfg.DongleConfig(), metrics), cfg)
+}
+
+func CreateHemsDataControllerWithSource(l *zap.Logger, source HemsDataSource, cfg *config.Config) *HemsDataController {
 	return &HemsDataController{
 		logger:        l,
-		dongle:        dongle.NewDongleUtil(l),
-		refreshSecond: time.Duration(goutils.GetIntEnv("REFRESH_SECONDS", 5)) * time.Second,
+		dongle:        source,
+		bus:           event.NewBus(l),
+		reload:        make(chan struct{}, 1),
+		refreshSecond: cfg.Polling.Interval.Duration(),
+		unitTimeCron:  cfg.Polling.UnitTimeCron,
+		cronUnitTime:  cronexpr.MustParse(cfg.Polling.UnitTimeCron),
+		location:      cfg.Location(),
+		dongleConfig:  cfg.DongleConfig(),
+		meter:         cfg.Meter,
+		stateConfig:   cfg.State,
 		previousData:  nil,
 		nextCronTime:  time.Now(),
 		readiness:     false,
+		fixed:         map[int64]fixedValue{},
+	}
+}
+
+// ApplyConfig applies the polling settings to the running collection. The dongle session is
+// restarted only when the connection parameters or the credentials are changed.
+func (controller *HemsDataController) ApplyConfig(cfg *config.Config) {
+	controller.mutex.Lock()
+
+	controller.refreshSecond = cfg.Polling.Interval.Duration()
+	controller.stateConfig = cfg.State
+
+	// the schedule is changed only by its settings, and a boundary which is passed but not
+	// read yet is kept, otherwise two unit times are merged
+	if location := cfg.Location(); cfg.Polling.UnitTimeCron != controller.unitTimeCron || location.String() != controller.location.String() {
+		controller.unitTimeCron = cfg.Polling.UnitTimeCron
+		controller.cronUnitTime = cronexpr.MustParse(cfg.Polling.UnitTimeCron)
+		controller.location = location
+		now := time.Now()
+		if controller.previousData == nil || controller.nextCronTime.After(now) {
+			controller.nextCronTime = controller.cronUnitTime.Next(now.In(location))
+		}
+	}
+
+	restart := false
+	if dongleConfig := cfg.DongleConfig(); dongleConfig != controller.dongleConfig || cfg.Meter != controller.meter {
+		controller.dongleConfig = dongleConfig
+		controller.meter = cfg.Meter
+		restart = true
+	}
+	cancelCollect := controller.cancelCollect
+
+	controller.mutex.Unlock()
+
+	// wake up the collection to reset the ticker
+	select {
+	case controller.reload <- struct{}{}:
+	default:
+	}
+
+	if restart && cancelCollect != nil {
+		controller.logger.Info("dongle config is changed, restart the session")
+		cancelCollect()
 	}
 }
 
-func (controller *HemsDataController) Initialize(ctx context.Context, pwd string, rbID string) error {
+func (controller *HemsDataController) Initialize(ctx context.Context) error {
 
 	// main cancel context
 	ictx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	controller.mutex.RLock()
+	dongleConfig := controller.dongleConfig
+	meter := controller.meter
+	controller.mutex.RUnlock()
+
 	// init dongle
-	if _, err := controller.dongle.Init(ictx, pwd, rbID); err != nil {
-		controller.logger.Fatal("init dongle is failed")
+	controller.dongle.SetConfig(dongleConfig)
+	if _, err := controller.dongle.Init(ictx, meter.BRoutePassword, meter.BRouteID); err != nil {
+		controller.logger.Error("init dongle is failed", zap.Error(err))
+		controller.setError(err)
 		return err
 	} else {
+		controller.mutex.Lock()
+		controller.status.Connected = true
+		controller.status.ConnectedAt = time.Now()
+		controller.status.Meter = controller.checkMeter(controller.dongle.MeterInfo())
+		controller.mutex.Unlock()
+		controller.notifyStatus()
 		return nil
 	}
 }
 
-func (controller *HemsDataController) RegistHandler(handler func(model *model.HemsData)) {
-	if handler != nil {
-		controller.hemsDataHandler = handler
-	}
+func (controller *HemsDataController) setError(err error) {
+	controller.mutex.Lock()
+	controller.status.LastError = err.Error()
+	controller.status.LastErrorAt = time.Now()
+	controller.mutex.Unlock()
+	controller.notifyStatus()
+}
+
+// notifyStatus publishes the current status, call it outside of the lock.
+func (controller *HemsDataController) notifyStatus() {
+	status := controller.Status()
+	controller.bus.Publish(event.Event{Status: &status})
+}
+
+// Status returns the connection status of the dongle.
+func (controller *HemsDataController) Status() model.ConnectionStatus {
+	controller.mutex.RLock()
+	defer controller.mutex.RUnlock()
+	status := controller.status
+	status.Ready = controller.readiness
+	return status
+}
+
+// Bus is where the readings and the status changes are published, the sinks subscribe to it.
+func (controller *HemsDataController) Bus() *event.Bus {
+	return controller.bus
 }
 
 func (controller *HemsDataController) Collect(ctx context.Context) error {
 
-	// main cancel context
+	// main cancel context, also canceled by ApplyConfig
 	ictx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	controller.mutex.Lock()
+	controller.cancelCollect = cancel
+	controller.mutex.Unlock()
+
 	// get data routine
 	err := controller.doCollect(ictx)
 
-	// disconnect
+	// end the PANA session once the port is free, otherwise the meter
+	// refuses a new join for minutes
+	if controller.waitFetching(controller.interval()) {
+		controller.dongle.Terminate()
+	}
+
+	// disconnect, this also unblocks a fetch which is still reading the port
 	controller.dongle.Disconnect()
 
+	// wait for the in-flight fetch before the dongle is initialized again
+	controller.fetching.Wait()
+
+	controller.mutex.Lock()
+	controller.readiness = false
+	controller.cancelCollect = nil
+	controller.status.Connected = false
+	controller.mutex.Unlock()
+
+	if err != nil && ctx.Err() == nil {
+		controller.setError(err)
+	} else {
+		controller.notifyStatus()
+	}
+
 	return err
 }
 
+func (controller *HemsDataController) interval() time.Duration {
+	controller.mutex.RLock()
+	defer controller.mutex.RUnlock()
+	return controller.refreshSecond
+}
+
+// waitFetching waits for the in-flight fetch up to timeout and reports whether it finished.
+func (controller *HemsDataController) waitFetching(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		controller.fetching.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (controller *HemsDataController) Readiness() bool {
+	controller.mutex.RLock()
+	defer controller.mutex.RUnlock()
 	return controller.readiness
 }
 
 func (controller *HemsDataController) doCollect(ctx context.Context) error {
 
-	var err error = nil
-
 	ictx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// sync channel
-	sync := make(chan string, 2)
-
-	// next
-	controller.nextCronTime = cronexpr.MustParse(cronUnitTime).Next(time.Now())
-
-	// call one
-	cctx, ccancel := controller.fetch(ictx, sync)
-	defer ccancel()
+	// next, the pending boundary is kept when the unit time is resumed
+	controller.mutex.Lock()
+	if controller.previousData == nil {
+		controller.nextCronTime = controller.cronUnitTime.Next(time.Now().In(controller.location))
+	}
+	controller.mutex.Unlock()
 
-	t := time.NewTicker(controller.refreshSecond)
+	t := time.NewTicker(controller.interval())
 	defer t.Stop()
 
-Default:
 	for {
-		select {
-		case <-sync:
-			cctx, ccancel = controller.fetch(ictx, sync)
-			defer ccancel()
-		case <-t.C:
-			sync <- "fetch"
-		case <-cctx.Done():
-			err = fmt.Errorf("read from dongle is timeout.")
-			controller.logger.Error(err.Error())
-			break Default
+		// only one command is in flight on the serial port at a time
+		if err := controller.fetch(ictx); err != nil {
+			return err
+		}
+		if err := controller.backfill(ictx); err != nil {
+			return err
+		}
+
+	Wait:
+		for {
+			select {
+			case <-t.C:
+				break Wait
+			case <-controller.reload:
+				t.Reset(controller.interval())
+			case <-ictx.Done():
+				return ictx.Err()
+			}
 		}
 	}
+}
 
-	return err
+func (controller *HemsDataController) fetch(ctx context.Context) error {
+	return controller.command(ctx, func(cctx context.Context) {
+		controller.dongle.Fetch(cctx, controller.HemsDataHandler)
+	})
 }
 
-func (controller *HemsDataController) fetch(ctx context.Context, sync chan string) (context.Context, context.CancelFunc) {
-	cctx, ccancel := context.WithTimeout(ctx, controller.refreshSecond*2)
-	go controller.dongle.Fetch(cctx, controller.HemsDataHandler, sync)
-	return cctx, ccancel
+// backfill reads the fixed time values which the meter recorded while no reading was done, once per unit time.
+func (controller *HemsDataController) backfill(ctx context.Context) error {
+	controller.mutex.Lock()
+	missing := controller.history
+	controller.history = nil
+	if len(missing) > 0 {
+		controller.backfilled = controller.nextCronTime
+	}
+	controller.mutex.Unlock()
+
+	for _, t := range missing {
+		controller.mutex.RLock()
+		_, ok := controller.fixed[t.Unix()]
+		controller.mutex.RUnlock()
+		if ok {
+			// read with the other boundary of the day
+			continue
+		}
+
+		var readings []model.FixedReading
+		var historyErr error
+		if err := controller.command(ctx, func(cctx context.Context) {
+			readings, historyErr = controller.dongle.FetchHistory(cctx, t)
+		}); err != nil {
+			return err
+		}
+		if historyErr != nil {
+			controller.logger.Warn(fmt.Sprintf("get history of %s is failed", t.In(controller.location).Format(time.RFC3339)), zap.Error(historyErr))
+			continue
+		}
+		controller.mutex.Lock()
+		for _, r := range readings {
+			controller.addFixed(r)
+		}
+		controller.mutex.Unlock()
+	}
+	return nil
+}
+
+// command runs f with the port up to interval()*2, only one command is in flight on the port.
+func (controller *HemsDataController) command(ctx context.Context, f func(ctx context.Context)) error {
+	cctx, ccancel := context.WithTimeout(ctx, controller.interval()*2)
+	defer ccancel()
+
+	done := make(chan struct{})
+	controller.fetching.Add(1)
+	go func() {
+		defer controller.fetching.Done()
+		defer close(done)
+		f(cctx)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-cctx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := fmt.Errorf("read from dongle is timeout.")
+		controller.logger.Error(err.Error())
+		return err
+	}
 }
 
 func (controller *HemsDataController) HemsDataHandler(result *model.HemsData) {
-	if result != nil {
-		if controller.previousData == nil {
-			controller.previousData = result
-		} else if result.DateTime.After(controller.nextCronTime) {
-			powerConsumptionPerUnitTime := result.CumulativePowerConsumption -
-				controller.previousData.CumulativePowerConsumption
-			result.PowerConsumptionPerUnitTime = powerConsumptionPerUnitTime
-			controller.previousData = result
-			controller.nextCronTime = cronexpr.MustParse(cronUnitTime).Next(result.DateTime)
-		} else {
-			result.PowerConsumptionPerUnitTime =
-				controller.previousData.PowerConsumptionPerUnitTime
-		}
-		controller.logger.Debug(fmt.Sprintf("WH: %v [kWh]", result.CumulativePowerConsumption))
-		controller.logger.Debug(fmt.Sprintf("W: %v [W]", result.InstantaneousPowerConsumption))
-		controller.logger.Debug(fmt.Sprintf("A: %v [A]", result.Current))
-		controller.logger.Debug(fmt.Sprintf("PF: %v [%%]", result.PowerFactor))
-		controller.logger.Debug(fmt.Sprintf("WH(last 30min): %v [kwh]", result.PowerConsumptionPerUnitTime))
-
-		if controller.hemsDataHandler != nil {
-			controller.hemsDataHandler(result)
-		}
-		controller.readiness = true
-	} else {
+	controller.mutex.Lock()
+
+	if result == nil {
+		changed := controller.readiness
 		controller.readiness = false
+		controller.mutex.Unlock()
+		if changed {
+			controller.notifyStatus()
+		}
+		return
+	}
+
+	if controller.restored {
+		controller.restored = false
+		if err := controller.checkRestored(result); err != nil {
+			controller.logger.Warn("restored state is discarded", zap.Error(err))
+			controller.discardRestored(result.DateTime)
+		}
+	}
+	if result.Fixed != nil {
+		controller.addFixed(*result.Fixed)
+	}
+
+	boundary := false
+	if controller.previousData == nil {
+		controller.previousData = result
+		// the first unit time is partial
+		controller.unitTimeStart = result.DateTime
+	} else if result.DateTime.After(controller.nextCronTime) && controller.unitTimeEnded(result) {
+		// a unit time per boundary, several ones when readings were missed
+		result.Slots = controller.slots(result)
+		last := result.Slots[len(result.Slots)-1]
+		result.PowerConsumptionPerUnitTime = last.EnergyKWh
+		result.UnitTimeStart = last.Start
+		result.UnitTimeEnd = last.End
+		controller.unitTimeStart = last.End
+		controller.previousData = result
+		controller.nextCronTime = controller.cronUnitTime.Next(result.DateTime.In(controller.location))
+		boundary = true
+	} else {
+		result.PowerConsumptionPerUnitTime =
+			controller.previousData.PowerConsumptionPerUnitTime
+		result.UnitTimeStart = controller.previousData.UnitTimeStart
+		result.UnitTimeEnd = controller.previousData.UnitTimeEnd
+	}
+	changed := !controller.readiness
+	controller.readiness = true
+	controller.status.LastReadAt = result.DateTime
+	controller.lastData = result
+
+	// the boundaries are saved at once, the other readings every save_interval
+	var s *state.State
+	if boundary || time.Since(controller.savedAt) >= controller.stateConfig.SaveInterval.Duration() {
+		s = controller.snapshot()
+	}
+
+	controller.mutex.Unlock()
+
+	controller.saveState(s)
+
+	controller.logger.Debug(fmt.Sprintf("WH: %v [kWh]", result.CumulativePowerConsumption))
+	controller.logger.Debug(fmt.Sprintf("W: %v [W]", result.InstantaneousPowerConsumption))
+	controller.logger.Debug(fmt.Sprintf("A: %v [A]", result.Current))
+	controller.logger.Debug(fmt.Sprintf("PF: %v [%%]", result.PowerFactor))
+	controller.logger.Debug(fmt.Sprintf("WH(last 30min): %v [kwh]", result.PowerConsumptionPerUnitTime))
+
+	// publish outside of the lock, the subscribers have their own queues
+	controller.bus.Publish(event.Event{Reading: result})
+	if changed {
+		controller.notifyStatus()
+	}
+}
+
+// RestoreState loads the persisted state, and returns the last reading to show it until the first live one.
+// The restored unit time is checked against the first live reading, and against the meter after the join.
+func (controller *HemsDataController) RestoreState() (*model.HemsData, error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	cfg := controller.stateConfig
+	if len(cfg.File) == 0 {
+		return nil, nil
+	}
+	s, err := state.Load(cfg.File)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if s.LastReading == nil {
+		return nil, nil
+	}
+	if age := time.Since(s.LastReading.DateTime); cfg.MaxAge > 0 && age > cfg.MaxAge.Duration() {
+		return nil, fmt.Errorf("state is too old: %s", age.Round(time.Second))
+	}
+
+	if s.Baseline != nil && !s.NextCronTime.IsZero() {
+		controller.previousData = s.Baseline
+		controller.unitTimeStart = s.UnitTimeStart
+		controller.nextCronTime = s.NextCronTime
+		controller.restored = true
+	}
+	controller.lastData = s.LastReading
+	controller.status.LastReadAt = s.LastReading.DateTime
+	controller.status.Meter = s.Meter
+
+	controller.logger.Info(fmt.Sprintf("state is restored, last reading at %s, next unit time at %s",
+		s.LastReading.DateTime.In(controller.location).Format(time.RFC3339),
+		s.NextCronTime.In(controller.location).Format(time.RFC3339)))
+
+	return s.LastReading, nil
+}
+
+// checkRestored is the sanity check of the restored unit time against the first live reading.
+func (controller *HemsDataController) checkRestored(result *model.HemsData) error {
+	if controller.previousData == nil {
+		// already discarded by checkMeter
+		return nil
+	}
+	if result.DateTime.Before(controller.previousData.DateTime) {
+		return fmt.Errorf("reading at %s is before the restored one", result.DateTime.Format(time.RFC3339))
+	}
+	if result.CumulativePowerConsumption < controller.previousData.CumulativePowerConsumption {
+		// the meter is replaced or reset
+		return fmt.Errorf("cumulative energy %v [kWh] is less than the restored %v [kWh]",
+			result.CumulativePowerConsumption, controller.previousData.CumulativePowerConsumption)
+	}
+	if maxAge := controller.stateConfig.MaxAge.Duration(); maxAge > 0 && result.DateTime.Sub(controller.previousData.DateTime) > maxAge+controller.unitTime() {
+		return fmt.Errorf("restored unit time started at %s is too old", controller.unitTimeStart.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// discardRestored drops the restored unit time, the boundary of it is already past, so the next one is from now.
+func (controller *HemsDataController) discardRestored(now time.Time) {
+	controller.previousData = nil
+	controller.unitTimeStart = time.Time{}
+	controller.nextCronTime = controller.cronUnitTime.Next(now.In(controller.location))
+	controller.restored = false
+	controller.fixed = map[int64]fixedValue{}
+}
+
+// addFixed records the fixed time value of the meter, the one which an ended unit time used is kept.
+func (controller *HemsDataController) addFixed(r model.FixedReading) {
+	if _, ok := controller.fixed[r.Time.Unix()]; !ok && !r.Partial {
+		controller.fixed[r.Time.Unix()] = fixedValue{cumulative: r.CumulativeKWh, exported: r.ExportKWh, metered: true}
+	}
+}
+
+// boundaries returns the start of the current unit time and the boundaries passed by t.
+func (controller *HemsDataController) boundaries(t time.Time) []time.Time {
+	b := []time.Time{controller.unitTimeStart}
+	for next := controller.nextCronTime; !next.IsZero() && !next.After(t); next = controller.cronUnitTime.Next(next) {
+		b = append(b, next)
+	}
+	return b
+}
+
+// isBoundary is false for the start of the partial unit time after a start.
+func (controller *HemsDataController) isBoundary(t time.Time) bool {
+	return controller.cronUnitTime.Next(t.In(controller.location).Add(-time.Second)).Equal(t)
+}
+
+// isFixedTime reports whether the meter records the fixed time value at the boundary t, :00 and :30.
+func (controller *HemsDataController) isFixedTime(t time.Time) bool {
+	return controller.isBoundary(t) && t.Truncate(30*time.Minute).Equal(t)
+}
+
+// unitTimeEnded reports whether the reading ends the passed unit times. When the meter has the fixed
+// time values and the last boundary is a fixed time, it waits for the value of it up to fixedTimeWait,
+// and for a read of the history of the missed ones. The unit times are from the readings around
+// the boundaries without them.
+func (controller *HemsDataController) unitTimeEnded(result *model.HemsData) bool {
+	if result.Fixed == nil {
+		return true
+	}
+	boundaries := controller.boundaries(result.DateTime)
+	last := boundaries[len(boundaries)-1]
+	if !controller.isFixedTime(last) {
+		return true
+	}
+	if _, ok := controller.fixed[last.Unix()]; !ok && result.DateTime.Sub(last) < fixedTimeWait {
+		return false
+	}
+	if controller.backfilled.Equal(controller.nextCronTime) {
+		return true
+	}
+	missing := []time.Time{}
+	for _, t := range boundaries[:len(boundaries)-1] {
+		if _, ok := controller.fixed[t.Unix()]; !ok && controller.isFixedTime(t) {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) == 0 {
+		return true
+	}
+	controller.history = missing
+	return false
+}
+
+// slots splits the passed boundaries into the unit times. The cumulative energy at a boundary is the fixed
+// time value of the meter, or interpolated by time between the known ones when the meter did not record it,
+// and the interpolated one is kept for the next unit time so that the unit times sum up to the meter.
+func (controller *HemsDataController) slots(result *model.HemsData) []model.Slot {
+	boundaries := controller.boundaries(result.DateTime)
+
+	start, ok := controller.fixed[boundaries[0].Unix()]
+	if !ok {
+		start = fixedValue{
+			cumulative: controller.previousData.CumulativePowerConsumption,
+			exported:   controller.previousData.CumulativePowerExport,
+		}
+	}
+	type point struct {
+		t time.Time
+		v fixedValue
+	}
+	points := []point{{boundaries[0], start}}
+	for _, t := range boundaries[1:] {
+		if v, ok := controller.fixed[t.Unix()]; ok {
+			points = append(points, point{t, v})
+		}
+	}
+	now := fixedValue{cumulative: result.CumulativePowerConsumption, exported: result.CumulativePowerExport}
+	points = append(points, point{result.DateTime, now})
+	interpolate := func(t time.Time) fixedValue {
+		for i := 1; i < len(points); i++ {
+			if p, q := points[i-1], points[i]; !q.t.Before(t) {
+				if !q.t.After(p.t) {
+					return fixedValue{cumulative: q.v.cumulative, exported: q.v.exported}
+				}
+				r := float32(t.Sub(p.t)) / float32(q.t.Sub(p.t))
+				return fixedValue{
+					cumulative: p.v.cumulative + (q.v.cumulative-p.v.cumulative)*r,
+					exported:   p.v.exported + (q.v.exported-p.v.exported)*r,
+				}
+			}
+		}
+		return now
+	}
+
+	slots := []model.Slot{}
+	estimated := 0
+	for i, t := range boundaries[1:] {
+		end, ok := controller.fixed[t.Unix()]
+		if !ok {
+			end = interpolate(t)
+			controller.fixed[t.Unix()] = end
+		}
+		slot := model.Slot{
+			Start:         boundaries[i],
+			End:           t,
+			EnergyKWh:     end.cumulative - start.cumulative,
+			CumulativeKWh: end.cumulative,
+			ExportedKWh:   end.exported - start.exported,
+			Metered:       start.metered && end.metered,
+		}
+		if !slot.Metered && controller.isFixedTime(slot.Start) && controller.isFixedTime(slot.End) {
+			estimated++
+		}
+		slots = append(slots, slot)
+		start = end
+	}
+	if result.Fixed != nil && estimated > 0 {
+		controller.logger.Warn(fmt.Sprintf("%d of %d unit times are not recorded by the meter, they are estimated from the readings", estimated, len(slots)))
+	}
+
+	// the older ones are not used anymore
+	last := boundaries[len(boundaries)-1].Unix()
+	for t := range controller.fixed {
+		if t < last {
+			delete(controller.fixed, t)
+		}
+	}
+	return slots
+}
+
+// unitTime is the length of a unit time, e.g. 30 minutes.
+func (controller *HemsDataController) unitTime() time.Duration {
+	next := controller.cronUnitTime.Next(controller.nextCronTime)
+	if next.IsZero() {
+		return 0
+	}
+	return next.Sub(controller.nextCronTime)
+}
+
+// checkMeter discards the restored unit time when the joined meter is not the one of the state.
+// The cached identity is kept when the meter did not answer it.
+func (controller *HemsDataController) checkMeter(meter *model.MeterInfo) *model.MeterInfo {
+	cached := controller.status.Meter
+	if meter == nil || cached == nil {
+		return meter
+	}
+	if len(meter.ManufacturerCode) == 0 {
+		// the properties could not be read, the same meter is assumed
+		m := *cached
+		m.DongleVersion = meter.DongleVersion
+		return &m
+	}
+	if controller.restored && (meter.ManufacturerCode != cached.ManufacturerCode || meter.SerialNumber != cached.SerialNumber) {
+		controller.logger.Warn(fmt.Sprintf("meter is changed from %s/%s to %s/%s, restored state is discarded",
+			cached.ManufacturerCode, cached.SerialNumber, meter.ManufacturerCode, meter.SerialNumber))
+		controller.discardRestored(time.Now())
+	}
+	return meter
+}
+
+// SaveState persists the state now, e.g. at shutdown.
+func (controller *HemsDataController) SaveState() {
+	controller.mutex.Lock()
+	s := controller.snapshot()
+	controller.mutex.Unlock()
+	controller.saveState(s)
+}
+
+// snapshot is the current state, nil when there is nothing to save. Call it in the lock.
+func (controller *HemsDataController) snapshot() *state.State {
+	if len(controller.stateConfig.File) == 0 || controller.lastData == nil {
+		return nil
+	}
+	controller.savedAt = time.Now()
+	return &state.State{
+		LastReading:   controller.lastData,
+		Baseline:      controller.previousData,
+		UnitTimeStart: controller.unitTimeStart,
+		NextCronTime:  controller.nextCronTime,
+		Meter:         controller.status.Meter,
+	}
+}
+
+func (controller *HemsDataController) saveState(s *state.State) {
+	if s == nil {
+		return
+	}
+	controller.mutex.RLock()
+	file := controller.stateConfig.File
+	controller.mutex.RUnlock()
+	if err := state.Save(file, s); err != nil {
+		controller.logger.Warn("save state is failed", zap.Error(err))
 	}
 }
@@ -0,0 +1,449 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/dongle"
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+// fakeSource is a dongle which answers a reading per fetch, or hangs until the fetch times out.
+type fakeSource struct {
+	hang bool
+	// history is the fixed time values of the meter, nil fails the history
+	history []model.FixedReading
+
+	fetches     int32
+	inFlight    int32
+	maxInFlight int32
+	terminated  int32
+	energy      int64 // [0.1 kWh]
+}
+
+func (f *fakeSource) SetConfig(cfg dongle.DongleConfig) {}
+
+func (f *fakeSource) Init(ctx context.Context, pwd string, rbID string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeSource) Fetch(ctx context.Context, handler func(result *model.HemsData)) error {
+	n := atomic.AddInt32(&f.inFlight, 1)
+	defer atomic.AddInt32(&f.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&f.maxInFlight, max, n) {
+			break
+		}
+	}
+	atomic.AddInt32(&f.fetches, 1)
+
+	if f.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	energy := atomic.AddInt64(&f.energy, 1)
+	handler(model.CreateHemsData(time.Now(), float32(energy)*0.1, 600, 30, 30))
+	return nil
+}
+
+func (f *fakeSource) FetchHistory(ctx context.Context, t time.Time) ([]model.FixedReading, error) {
+	if f.history == nil {
+		return nil, fmt.Errorf("history is not supported")
+	}
+	return f.history, nil
+}
+
+func (f *fakeSource) Terminate() error {
+	atomic.AddInt32(&f.terminated, 1)
+	return nil
+}
+
+func (f *fakeSource) Disconnect() {}
+
+func (f *fakeSource) MeterInfo() *model.MeterInfo {
+	return &model.MeterInfo{ManufacturerCode: "000016", SerialNumber: "1"}
+}
+
+func newTestController(t *testing.T, source HemsDataSource, interval time.Duration) *HemsDataController {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Polling.Interval = config.Duration(interval)
+	cfg.State.File = ""
+	c := CreateHemsDataControllerWithSource(zap.NewNop(), source, cfg)
+	t.Cleanup(func() {
+		c.Bus().Close(context.Background())
+	})
+	return c
+}
+
+// poll queries the readiness and the status like the http handlers until stop is closed.
+func poll(c *HemsDataController, stop <-chan struct{}, wg *sync.WaitGroup) {
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.Readiness()
+				c.Status()
+				time.Sleep(10 * time.Microsecond)
+			}
+		}()
+	}
+}
+
+func TestCollectWhileQueried(t *testing.T) {
+	source := &fakeSource{}
+	c := newTestController(t, source, 10*time.Millisecond)
+
+	readings := int32(0)
+	c.Bus().SubscribeReading("test", event.DefaultOptions, func(data *model.HemsData) error {
+		atomic.AddInt32(&readings, 1)
+		return nil
+	})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	poll(c, stop, &wg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	collected := make(chan error)
+	go func() {
+		collected <- c.Collect(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.Readiness() || atomic.LoadInt32(&source.fetches) < 20 {
+		if time.Now().After(deadline) {
+			t.Fatal("collection is not ready")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status := c.Status(); !status.Ready || !status.Connected || status.Meter == nil {
+		t.Errorf("status is not ready: %+v", status)
+	}
+
+	cancel()
+	if err := <-collected; err != context.Canceled {
+		t.Errorf("collect returns %v", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	if max := atomic.LoadInt32(&source.maxInFlight); max != 1 {
+		t.Errorf("%d fetches are in flight at a time", max)
+	}
+	if atomic.LoadInt32(&source.terminated) != 1 {
+		t.Error("session is not terminated")
+	}
+	if status := c.Status(); status.Ready || status.Connected {
+		t.Errorf("status is ready after the collection: %+v", status)
+	}
+	if atomic.LoadInt32(&readings) == 0 {
+		t.Error("no reading is published")
+	}
+}
+
+func TestConcurrentHandler(t *testing.T) {
+	c := newTestController(t, &fakeSource{}, time.Second)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	poll(c, stop, &wg)
+
+	// the readings of the fetch goroutines which overlap, e.g. a timed out one and the next one
+	var handlers sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		handlers.Add(1)
+		go func(i int) {
+			defer handlers.Done()
+			for j := 0; j < 100; j++ {
+				c.HemsDataHandler(model.CreateHemsData(start.Add(time.Duration(i*100+j)*time.Second), float32(j), 600, 30, 30))
+				if j%10 == 0 {
+					c.HemsDataHandler(nil)
+				}
+			}
+		}(i)
+	}
+	handlers.Wait()
+	close(stop)
+	wg.Wait()
+
+	c.HemsDataHandler(model.CreateHemsData(time.Now(), 1, 600, 30, 30))
+	if !c.Readiness() {
+		t.Error("not ready after a reading")
+	}
+	c.HemsDataHandler(nil)
+	if c.Readiness() {
+		t.Error("ready after a failed reading")
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	source := &fakeSource{hang: true}
+	interval := 20 * time.Millisecond
+	c := newTestController(t, source, interval)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	poll(c, stop, &wg)
+
+	ctx := context.Background()
+	if err := c.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	err := c.Collect(ctx)
+	elapsed := time.Since(started)
+	close(stop)
+	wg.Wait()
+
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("collect returns %v", err)
+	}
+	// interval()*2 for the fetch
+	if elapsed < interval*2 {
+		t.Errorf("timeout after %s", elapsed)
+	}
+	if atomic.LoadInt32(&source.inFlight) != 0 {
+		t.Error("fetch is still in flight after the collection")
+	}
+	status := c.Status()
+	if status.Ready || status.Connected || !strings.Contains(status.LastError, "timeout") {
+		t.Errorf("status after the timeout: %+v", status)
+	}
+}
+
+func TestApplyConfigKeepsBoundary(t *testing.T) {
+	c := newTestController(t, &fakeSource{}, time.Second)
+	cfg := config.Default()
+	cfg.State.File = ""
+
+	c.HemsDataHandler(model.CreateHemsData(time.Now().Add(-time.Hour), 1, 600, 30, 30))
+	pending := time.Now().Add(-time.Minute)
+	c.mutex.Lock()
+	c.nextCronTime = pending
+	c.mutex.Unlock()
+
+	// other settings
+	cfg.Sinks.MQTT.Enabled = true
+	c.ApplyConfig(cfg)
+	if c.nextCronTime != pending {
+		t.Errorf("boundary is moved to %s by the mqtt settings", c.nextCronTime)
+	}
+
+	// the passed boundary is read by the next reading even when the schedule is changed
+	cfg.Polling.UnitTimeCron = "0 * * * *"
+	c.ApplyConfig(cfg)
+	if c.nextCronTime != pending {
+		t.Errorf("pending boundary is moved to %s", c.nextCronTime)
+	}
+
+	c.mutex.Lock()
+	c.nextCronTime = time.Now().Add(time.Minute)
+	c.mutex.Unlock()
+	cfg.Polling.UnitTimeCron = "0,15,30,45 * * * *"
+	c.ApplyConfig(cfg)
+	if next := c.cronUnitTime.Next(time.Now()); !c.nextCronTime.Equal(next) {
+		t.Errorf("boundary is %s, not the next one of the new schedule %s", c.nextCronTime, next)
+	}
+}
+
+func TestDiscardRestored(t *testing.T) {
+	c := newTestController(t, &fakeSource{}, time.Second)
+	now := time.Now()
+
+	restore := func() {
+		c.mutex.Lock()
+		c.previousData = model.CreateHemsData(now.Add(-3*time.Hour), 100, 600, 30, 30)
+		c.unitTimeStart = now.Add(-3 * time.Hour)
+		c.nextCronTime = now.Add(-2 * time.Hour)
+		c.restored = true
+		c.status.Meter = &model.MeterInfo{ManufacturerCode: "000016", SerialNumber: "1"}
+		c.mutex.Unlock()
+	}
+
+	// the meter is reset, the cumulative energy is less than the restored one
+	restore()
+	first := model.CreateHemsData(now, 10, 600, 30, 30)
+	c.HemsDataHandler(first)
+	if c.previousData != first || !c.unitTimeStart.Equal(now) {
+		t.Errorf("unit time starts at %s, not at the first reading", c.unitTimeStart)
+	}
+	if next := c.cronUnitTime.Next(now.In(c.location)); !c.nextCronTime.Equal(next) {
+		t.Errorf("boundary is %s, not %s", c.nextCronTime, next)
+	}
+
+	second := model.CreateHemsData(c.nextCronTime.Add(time.Second), 11, 600, 30, 30)
+	c.HemsDataHandler(second)
+	if !second.UnitTimeStart.Equal(now) || !second.UnitTimeEnd.After(second.UnitTimeStart) {
+		t.Errorf("slot is from %s to %s", second.UnitTimeStart, second.UnitTimeEnd)
+	}
+
+	// another meter is joined
+	restore()
+	c.checkMeter(&model.MeterInfo{ManufacturerCode: "000016", SerialNumber: "2"})
+	if c.previousData != nil || c.restored || !c.unitTimeStart.IsZero() || !c.nextCronTime.After(now) {
+		t.Errorf("restored state is kept, boundary %s", c.nextCronTime)
+	}
+}
+
+func TestMeteredSlots(t *testing.T) {
+	source := &fakeSource{}
+	c := newTestController(t, source, time.Second)
+	at := func(hour int, min int) time.Time {
+		return time.Date(2026, 10, 18, hour, min, 0, 0, c.location)
+	}
+	reading := func(hour int, min int, cumulative float32, fixedHour int, fixedMin int, fixed float32) *model.HemsData {
+		data := model.CreateHemsData(at(hour, min), cumulative, 600, 30, 30)
+		data.Fixed = &model.FixedReading{Time: at(fixedHour, fixedMin), CumulativeKWh: fixed}
+		c.HemsDataHandler(data)
+		return data
+	}
+	check := func(data *model.HemsData, expected ...model.Slot) {
+		t.Helper()
+		if len(data.Slots) != len(expected) {
+			t.Fatalf("%d slots at %s, not %d", len(data.Slots), data.DateTime, len(expected))
+		}
+		for i, slot := range data.Slots {
+			e := expected[i]
+			if !slot.Start.Equal(e.Start) || !slot.End.Equal(e.End) || math.Abs(float64(slot.EnergyKWh-e.EnergyKWh)) > 1e-3 || slot.Metered != e.Metered {
+				t.Errorf("slot %d is %+v, not %+v", i, slot, e)
+			}
+		}
+		if len(expected) == 0 {
+			return
+		}
+		if last := data.Slots[len(data.Slots)-1]; data.PowerConsumptionPerUnitTime != last.EnergyKWh || !data.UnitTimeEnd.Equal(last.End) {
+			t.Errorf("unit time of the reading is not the last slot: %+v", data)
+		}
+	}
+
+	reading(11, 50, 100.5, 11, 30, 100)
+	c.mutex.Lock()
+	c.nextCronTime = at(12, 0)
+	c.mutex.Unlock()
+
+	// the meter has not recorded 12:00 yet
+	check(reading(12, 1, 101.2, 11, 30, 100))
+	// the partial first unit time is up to the fixed time value
+	check(reading(12, 2, 101.3, 12, 0, 101), model.Slot{Start: at(11, 50), End: at(12, 0), EnergyKWh: 0.5})
+
+	// 12:30 and 13:00 are missed, they are read from the history
+	check(reading(13, 40, 105, 13, 30, 104.8))
+	if len(c.history) != 2 || !c.history[0].Equal(at(12, 30)) || !c.history[1].Equal(at(13, 0)) {
+		t.Fatalf("history of %v is read", c.history)
+	}
+	source.history = []model.FixedReading{{Time: at(12, 30), CumulativeKWh: 102}, {Time: at(13, 0), CumulativeKWh: 103.5}}
+	if err := c.backfill(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(reading(13, 41, 105.1, 13, 30, 104.8),
+		model.Slot{Start: at(12, 0), End: at(12, 30), EnergyKWh: 1, Metered: true},
+		model.Slot{Start: at(12, 30), End: at(13, 0), EnergyKWh: 1.5, Metered: true},
+		model.Slot{Start: at(13, 0), End: at(13, 30), EnergyKWh: 1.3, Metered: true})
+
+	// the history is not read, the missed ones are split by time
+	source.history = nil
+	check(reading(15, 10, 108.2, 15, 0, 108))
+	if err := c.backfill(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(reading(15, 11, 108.3, 15, 0, 108),
+		model.Slot{Start: at(13, 30), End: at(14, 0), EnergyKWh: 3.2 / 3},
+		model.Slot{Start: at(14, 0), End: at(14, 30), EnergyKWh: 3.2 / 3},
+		model.Slot{Start: at(14, 30), End: at(15, 0), EnergyKWh: 3.2 / 3})
+
+	// the meter does not record 15:30 in time, the readings around it are used
+	check(reading(15, 34, 108.9, 15, 0, 108))
+	end := reading(15, 36, 109, 15, 0, 108)
+	check(end, model.Slot{Start: at(15, 0), End: at(15, 30), EnergyKWh: 1 * 30 / 36.0})
+	// and kept when it is recorded later, the unit times sum up to the meter
+	check(reading(16, 1, 110, 16, 0, 109.9), model.Slot{Start: at(15, 30), End: at(16, 0), EnergyKWh: 109.9 - end.Slots[0].CumulativeKWh})
+}
+
+func TestUnitTimeOffFixedTime(t *testing.T) {
+	cfg := config.Default()
+	cfg.Polling.Interval = config.Duration(time.Second)
+	cfg.Polling.UnitTimeCron = "15,45 * * * *"
+	cfg.State.File = ""
+	c := CreateHemsDataControllerWithSource(zap.NewNop(), &fakeSource{}, cfg)
+	t.Cleanup(func() {
+		c.Bus().Close(context.Background())
+	})
+	at := func(hour int, min int) time.Time {
+		return time.Date(2026, 10, 18, hour, min, 0, 0, c.location)
+	}
+	reading := func(hour int, min int, cumulative float32, fixedHour int, fixedMin int) *model.HemsData {
+		data := model.CreateHemsData(at(hour, min), cumulative, 600, 30, 30)
+		data.Fixed = &model.FixedReading{Time: at(fixedHour, fixedMin), CumulativeKWh: cumulative}
+		c.HemsDataHandler(data)
+		return data
+	}
+
+	reading(11, 50, 100, 11, 30)
+	c.mutex.Lock()
+	c.nextCronTime = at(12, 15)
+	c.mutex.Unlock()
+
+	// the meter does not record the boundaries, the unit times end without waiting or the history
+	if data := reading(12, 16, 101, 12, 0); len(data.Slots) != 1 || !data.UnitTimeEnd.Equal(at(12, 15)) {
+		t.Errorf("unit time is not ended: %+v", data)
+	}
+	if data := reading(13, 50, 104, 13, 30); len(data.Slots) != 3 || !data.UnitTimeEnd.Equal(at(13, 45)) {
+		t.Errorf("unit times are not ended: %+v", data)
+	}
+	if len(c.history) > 0 {
+		t.Errorf("history of %v is read", c.history)
+	}
+}
+
+func TestExportedSlots(t *testing.T) {
+	c := newTestController(t, &fakeSource{}, time.Second)
+	at := func(hour int, min int) time.Time {
+		return time.Date(2026, 10, 18, hour, min, 0, 0, c.location)
+	}
+	reading := func(hour int, min int, cumulative float32, export float32, fixed model.FixedReading) *model.HemsData {
+		data := model.CreateHemsData(at(hour, min), cumulative, 600, 30, 30)
+		data.CumulativePowerExport = export
+		data.Fixed = &fixed
+		c.HemsDataHandler(data)
+		return data
+	}
+
+	reading(11, 50, 100, 10, model.FixedReading{Time: at(11, 30), CumulativeKWh: 99.8, ExportKWh: 9.9})
+	c.mutex.Lock()
+	c.nextCronTime = at(12, 0)
+	c.mutex.Unlock()
+
+	// the export of 12:00 is not recorded yet
+	if data := reading(12, 1, 100.3, 10.5, model.FixedReading{Time: at(12, 0), CumulativeKWh: 100.2, Partial: true}); len(data.Slots) != 0 {
+		t.Errorf("unit time is ended without the export: %+v", data.Slots)
+	}
+	data := reading(12, 2, 100.3, 10.5, model.FixedReading{Time: at(12, 0), CumulativeKWh: 100.2, ExportKWh: 10.4})
+	if len(data.Slots) != 1 || math.Abs(float64(data.Slots[0].EnergyKWh-0.2)) > 1e-3 || math.Abs(float64(data.Slots[0].ExportedKWh-0.4)) > 1e-3 {
+		t.Errorf("partial slot %+v", data.Slots)
+	}
+	data = reading(12, 31, 100.6, 11.1, model.FixedReading{Time: at(12, 30), CumulativeKWh: 100.5, ExportKWh: 11})
+	if len(data.Slots) != 1 || !data.Slots[0].Metered || math.Abs(float64(data.Slots[0].EnergyKWh-0.3)) > 1e-3 || math.Abs(float64(data.Slots[0].ExportedKWh-0.6)) > 1e-3 {
+		t.Errorf("slot %+v", data.Slots)
+	}
+}
@@ -1,74 +1,272 @@
 package controller
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"github.com/michibiki-io/hems-metrics-go/config"
 	"github.com/michibiki-io/hems-metrics-go/model"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
+// the windows of the max / min / avg of power and current
+var peakWindows = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute}
+
+var (
+	powerBuckets   = []float64{100, 200, 300, 500, 750, 1000, 1500, 2000, 3000, 4000, 5000, 6000, 8000}
+	currentBuckets = []float64{1, 2, 3, 5, 7.5, 10, 15, 20, 25, 30, 40, 50, 60}
+)
+
+// MetricsController is a prometheus.Collector of the latest reading, on its own registry.
+// The values are read at scrape time, so that nothing is reported before the first reading
+// and the series of the readings disappear when they are stale.
 type MetricsController struct {
-	logger                        *zap.Logger
-	cumulativePowerConsumption    prometheus.Gauge
-	powerConsumptionPerUnitTime   prometheus.Gauge
-	instantaneousPowerConsumption prometheus.Gauge
-	current                       prometheus.Gauge
-	powerFactor                   prometheus.Gauge
+	logger     *zap.Logger
+	staleAfter time.Duration
+	timestamps bool
+	registry   *prometheus.Registry
+
+	mutex  sync.RWMutex
+	latest *model.HemsData
+	// readings of the longest peak window
+	recent []*model.HemsData
+
+	// every polled sample, regardless of the scrape interval
+	powerHistogram   prometheus.Histogram
+	currentHistogram *prometheus.HistogramVec
+
+	energyImported                *prometheus.Desc
+	energyExported                *prometheus.Desc
+	cumulativePowerConsumption    *prometheus.Desc
+	powerConsumptionPerUnitTime   *prometheus.Desc
+	instantaneousPowerConsumption *prometheus.Desc
+	current                       *prometheus.Desc
+	powerFactor                   *prometheus.Desc
+	lastSuccessfulRead            *prometheus.Desc
+	powerWindow                   *prometheus.Desc
+	currentWindow                 *prometheus.Desc
 }
 
-func CreateMetricsController(l *zap.Logger) *MetricsController {
-	c := MetricsController{
-		logger: l,
-		cumulativePowerConsumption: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: "hems",
-			Name:      "cumulative_power_consumption",
-			Help:      "Cumulative Power Consumption [kWh]",
-		}),
-		powerConsumptionPerUnitTime: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: "hems",
-			Name:      "latest_cumulative_power_consumption_per_unit_time",
-			Help:      "Latest Cumulative Power Consumption per Unit time [kWh]",
-		}),
-		instantaneousPowerConsumption: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: "hems",
-			Name:      "instantaneous_power_consumption",
-			Help:      "Instantaneous Power Consumption [W]",
-		}),
-		current: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: "hems",
-			Name:      "current",
-			Help:      "Current [A]",
-		}),
-		powerFactor: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: "hems",
-			Name:      "power_factor",
-			Help:      "Power Factor [%]",
+func CreateMetricsController(l *zap.Logger, cfg config.MetricsConfig) *MetricsController {
+	name := func(name string) string {
+		return prometheus.BuildFQName(cfg.Namespace, "", name)
+	}
+
+	c := &MetricsController{
+		logger:     l,
+		staleAfter: cfg.StaleAfter.Duration(),
+		timestamps: cfg.Timestamps,
+		registry:   prometheus.NewRegistry(),
+		energyImported: prometheus.NewDesc(name("energy_imported_kwh_total"),
+			"Cumulative imported energy [kWh]", nil, nil),
+		energyExported: prometheus.NewDesc(name("energy_exported_kwh_total"),
+			"Cumulative exported energy [kWh], 0 when the meter does not measure it", nil, nil),
+		cumulativePowerConsumption: prometheus.NewDesc(name("cumulative_power_consumption"),
+			"Cumulative Power Consumption [kWh], deprecated by energy_imported_kwh_total", nil, nil),
+		powerConsumptionPerUnitTime: prometheus.NewDesc(name("latest_cumulative_power_consumption_per_unit_time"),
+			"Latest Cumulative Power Consumption per Unit time [kWh]", nil, nil),
+		instantaneousPowerConsumption: prometheus.NewDesc(name("instantaneous_power_consumption"),
+			"Instantaneous Power Consumption [W]", nil, nil),
+		current: prometheus.NewDesc(name("current"),
+			"Current [A]", nil, nil),
+		powerFactor: prometheus.NewDesc(name("power_factor"),
+			"Power Factor [%]", nil, nil),
+		lastSuccessfulRead: prometheus.NewDesc(name("last_successful_read_timestamp_seconds"),
+			"Unix time of the last successful read from the meter", nil, nil),
+		powerWindow: prometheus.NewDesc(name("power_window_watts"),
+			"Max / min / avg of the instantaneous power in the window [W]", []string{"window", "stat"}, nil),
+		currentWindow: prometheus.NewDesc(name("current_window_amperes"),
+			"Max / min / avg of the current per phase in the window [A]", []string{"phase", "window", "stat"}, nil),
+		powerHistogram: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:                   cfg.Namespace,
+			Name:                        "power_watts",
+			Help:                        "Distribution of the polled instantaneous power [W]",
+			Buckets:                     powerBuckets,
+			NativeHistogramBucketFactor: 1.1,
 		}),
+		currentHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:                   cfg.Namespace,
+			Name:                        "current_amperes",
+			Help:                        "Distribution of the polled current per phase [A]",
+			Buckets:                     currentBuckets,
+			NativeHistogramBucketFactor: 1.1,
+		}, []string{"phase"}),
 	}
 
-	prometheus.MustRegister(c.cumulativePowerConsumption,
-		c.powerConsumptionPerUnitTime,
-		c.instantaneousPowerConsumption,
-		c.current,
-		c.powerFactor)
+	c.registry.MustRegister(c, c.powerHistogram, c.currentHistogram)
+	if cfg.GoCollector {
+		c.registry.MustRegister(collectors.NewGoCollector())
+	}
+	if cfg.ProcessCollector {
+		c.registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+
+	return c
+}
+
+// Registry is the registry of the metrics endpoint, for the other collectors.
+func (controller *MetricsController) Registry() *prometheus.Registry {
+	return controller.registry
+}
 
-	return &c
+// Restore sets the reading restored from the state, it is not recorded in the histograms and the windows.
+func (controller *MetricsController) Restore(model *model.HemsData) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if controller.latest == nil {
+		controller.latest = model
+	}
 }
 
 func (controller *MetricsController) Update(model *model.HemsData) {
 
-	if model != nil {
-		controller.cumulativePowerConsumption.Set(float64(model.CumulativePowerConsumption))
-		controller.powerConsumptionPerUnitTime.Set(float64(model.PowerConsumptionPerUnitTime))
-		controller.instantaneousPowerConsumption.Set(float64(model.InstantaneousPowerConsumption))
-		controller.current.Set(float64(model.Current))
-		controller.powerFactor.Set(float64(model.PowerFactor))
+	if model == nil {
+		return
+	}
+
+	controller.powerHistogram.Observe(float64(model.InstantaneousPowerConsumption))
+	for _, phase := range []string{"r", "t"} {
+		if current, ok := model.PhaseCurrent(phase); ok {
+			controller.currentHistogram.WithLabelValues(phase).Observe(float64(current))
+		}
+	}
+
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	controller.latest = model
+
+	// drop the readings out of the longest window
+	controller.recent = append(controller.recent, model)
+	oldest := model.DateTime.Add(-peakWindows[len(peakWindows)-1])
+	i := 0
+	for i < len(controller.recent) && controller.recent[i].DateTime.Before(oldest) {
+		i++
+	}
+	controller.recent = controller.recent[i:]
+}
+
+// Describe implements prometheus.Collector.
+func (controller *MetricsController) Describe(ch chan<- *prometheus.Desc) {
+	ch <- controller.energyImported
+	ch <- controller.energyExported
+	ch <- controller.cumulativePowerConsumption
+	ch <- controller.powerConsumptionPerUnitTime
+	ch <- controller.instantaneousPowerConsumption
+	ch <- controller.current
+	ch <- controller.powerFactor
+	ch <- controller.lastSuccessfulRead
+	ch <- controller.powerWindow
+	ch <- controller.currentWindow
+}
+
+// Collect implements prometheus.Collector, the snapshot of the latest reading.
+func (controller *MetricsController) Collect(ch chan<- prometheus.Metric) {
+	controller.mutex.RLock()
+	data := controller.latest
+	recent := controller.recent
+	controller.mutex.RUnlock()
+
+	if data == nil {
+		return
+	}
+
+	// kept when stale, to alert on no data
+	ch <- prometheus.MustNewConstMetric(controller.lastSuccessfulRead, prometheus.GaugeValue,
+		float64(data.DateTime.UnixNano())/1e9)
+
+	if controller.staleAfter > 0 && time.Since(data.DateTime) > controller.staleAfter {
+		return
+	}
+
+	// the counter is the meter value itself, it goes back only when the meter is replaced
+	// and prometheus takes it as a counter reset
+	controller.collect(ch, data, controller.energyImported, prometheus.CounterValue, float64(data.CumulativePowerConsumption))
+	controller.collect(ch, data, controller.energyExported, prometheus.CounterValue, float64(data.CumulativePowerExport))
+	controller.collect(ch, data, controller.cumulativePowerConsumption, prometheus.GaugeValue, float64(data.CumulativePowerConsumption))
+	controller.collect(ch, data, controller.powerConsumptionPerUnitTime, prometheus.GaugeValue, float64(data.PowerConsumptionPerUnitTime))
+	controller.collect(ch, data, controller.instantaneousPowerConsumption, prometheus.GaugeValue, float64(data.InstantaneousPowerConsumption))
+	controller.collect(ch, data, controller.current, prometheus.GaugeValue, float64(data.Current))
+	controller.collect(ch, data, controller.powerFactor, prometheus.GaugeValue, float64(data.PowerFactor))
+
+	now := time.Now()
+	for _, window := range peakWindows {
+		label := windowLabel(window)
+		since := now.Add(-window)
+		controller.collectWindow(ch, recent, since, controller.powerWindow, func(d *model.HemsData) (float64, bool) {
+			return float64(d.InstantaneousPowerConsumption), true
+		}, label)
+		for _, phase := range []string{"r", "t"} {
+			phase := phase
+			controller.collectWindow(ch, recent, since, controller.currentWindow, func(d *model.HemsData) (float64, bool) {
+				current, ok := d.PhaseCurrent(phase)
+				return float64(current), ok
+			}, phase, label)
+		}
+	}
+}
+
+// collectWindow reports max / min / avg of the readings since, nothing when there is no reading.
+// The reading is skipped when value returns false.
+func (controller *MetricsController) collectWindow(ch chan<- prometheus.Metric, recent []*model.HemsData, since time.Time,
+	desc *prometheus.Desc, value func(*model.HemsData) (float64, bool), labels ...string) {
+
+	n := 0
+	sum, max, min := 0.0, 0.0, 0.0
+	for _, d := range recent {
+		if d.DateTime.Before(since) {
+			continue
+		}
+		v, ok := value(d)
+		if !ok {
+			continue
+		}
+		if n == 0 || v > max {
+			max = v
+		}
+		if n == 0 || v < min {
+			min = v
+		}
+		sum += v
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, max, append(labels, "max")...)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, min, append(labels, "min")...)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, sum/float64(n), append(labels, "avg")...)
+}
+
+// windowLabel is 1m, 5m, 30m
+func windowLabel(d time.Duration) string {
+	if d%time.Minute == 0 {
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+func (controller *MetricsController) collect(ch chan<- prometheus.Metric, data *model.HemsData,
+	desc *prometheus.Desc, valueType prometheus.ValueType, value float64) {
+
+	m := prometheus.MustNewConstMetric(desc, valueType, value)
+	if controller.timestamps {
+		m = prometheus.NewMetricWithTimestamp(data.DateTime, m)
 	}
+	ch <- m
 }
 
-func CreatePrometheusHandler() gin.HandlerFunc {
-	h := promhttp.Handler()
+// CreatePrometheusHandler serves the registry, in OpenMetrics when the scraper accepts it.
+func (controller *MetricsController) CreatePrometheusHandler() gin.HandlerFunc {
+	h := promhttp.HandlerFor(controller.registry, promhttp.HandlerOpts{
+		Registry:          controller.registry,
+		EnableOpenMetrics: true,
+	})
 
 	return func(c *gin.Context) {
 		h.ServeHTTP(c.Writer, c.Request)
@@ -0,0 +1,241 @@
+package controller
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+const (
+	streamEventReading = "reading"
+	streamEventStatus  = "status"
+	streamEventPing    = "ping"
+
+	streamPingInterval = 15 * time.Second
+	streamWriteTimeout = 10 * time.Second
+)
+
+type StreamEvent struct {
+	Type    string           `json:"type"`
+	Reading *ReadingResponse `json:"reading,omitempty"`
+	Status  *StatusResponse  `json:"status,omitempty"`
+}
+
+// streamClient has its own queue, so that a slow client never blocks the others nor the polling.
+type streamClient struct {
+	events  chan *StreamEvent
+	dropped int
+}
+
+// StreamController pushes the readings and the status changes over Server-Sent Events and WebSocket.
+type StreamController struct {
+	logger        *zap.Logger
+	apiController *ApiController
+	maxClients    int
+	bufferSize    int
+	upgrader      websocket.Upgrader
+
+	mutex   sync.Mutex
+	clients map[*streamClient]struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func CreateStreamController(l *zap.Logger, cfg config.APIConfig, apiController *ApiController) *StreamController {
+	return &StreamController{
+		logger:        l,
+		apiController: apiController,
+		maxClients:    cfg.StreamMaxClients,
+		bufferSize:    cfg.StreamBufferSize,
+		upgrader: websocket.Upgrader{
+			// dashboards are served from anywhere
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients: map[*streamClient]struct{}{},
+		closed:  make(chan struct{}),
+	}
+}
+
+// Close ends the streams, the http server waits for them on shutdown.
+func (controller *StreamController) Close() {
+	controller.once.Do(func() {
+		close(controller.closed)
+	})
+}
+
+func (controller *StreamController) Route(group *gin.RouterGroup) {
+	group.GET("/stream", controller.sse)
+	group.GET("/stream/ws", controller.websocket)
+}
+
+// Update pushes the reading to the clients.
+func (controller *StreamController) Update(data *model.HemsData) {
+	if data == nil {
+		return
+	}
+	controller.broadcast(&StreamEvent{
+		Type:    streamEventReading,
+		Reading: controller.apiController.newReadingResponse(data),
+	})
+}
+
+// UpdateStatus pushes the connection status to the clients.
+func (controller *StreamController) UpdateStatus(status model.ConnectionStatus) {
+	controller.broadcast(&StreamEvent{
+		Type:   streamEventStatus,
+		Status: controller.apiController.newStatusResponse(status),
+	})
+}
+
+func (controller *StreamController) broadcast(event *StreamEvent) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	for client := range controller.clients {
+		client.push(event)
+	}
+}
+
+// push never blocks, the oldest event is dropped when the queue is full.
+func (client *streamClient) push(event *StreamEvent) {
+	for {
+		select {
+		case client.events <- event:
+			return
+		default:
+		}
+		select {
+		case <-client.events:
+			client.dropped++
+		default:
+		}
+	}
+}
+
+func (controller *StreamController) subscribe() *streamClient {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	if len(controller.clients) >= controller.maxClients {
+		return nil
+	}
+	client := &streamClient{events: make(chan *StreamEvent, controller.bufferSize)}
+	controller.clients[client] = struct{}{}
+
+	// the current state first
+	client.push(&StreamEvent{
+		Type:   streamEventStatus,
+		Status: controller.apiController.newStatusResponse(controller.apiController.hemsDataController.Status()),
+	})
+	if latest := controller.apiController.Latest(); latest != nil {
+		client.push(&StreamEvent{
+			Type:    streamEventReading,
+			Reading: controller.apiController.newReadingResponse(latest),
+		})
+	}
+
+	return client
+}
+
+func (controller *StreamController) unsubscribe(client *streamClient) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	delete(controller.clients, client)
+	if client.dropped > 0 {
+		controller.logger.Debug("stream client was slow", zap.Int("dropped", client.dropped))
+	}
+}
+
+func (controller *StreamController) sse(c *gin.Context) {
+	client := controller.subscribe()
+	if client == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "too many stream clients"})
+		return
+	}
+	defer controller.unsubscribe(client)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-client.events:
+			c.SSEvent(event.Type, event)
+			return true
+		case t := <-ping.C:
+			c.SSEvent(streamEventPing, t.Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		case <-controller.closed:
+			return false
+		}
+	})
+}
+
+func (controller *StreamController) websocket(c *gin.Context) {
+	client := controller.subscribe()
+	if client == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "too many stream clients"})
+		return
+	}
+	defer controller.unsubscribe(client)
+
+	conn, err := controller.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		controller.logger.Debug("websocket upgrade is failed", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	// the client sends nothing, read to notice the close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case event := <-client.events:
+			b, err := json.Marshal(event)
+			if err != nil {
+				controller.logger.Error("marshal stream event is failed", zap.Error(err))
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-controller.closed:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutdown"), time.Now().Add(streamWriteTimeout))
+			return
+		}
+	}
+}
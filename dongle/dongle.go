@@ -4,29 +4,25 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"runtime"
 	"strings"
 	"time"
 
-	"github.com/michibiki-io/goutils"
 	"github.com/michibiki-io/hems-metrics-go/utility/constant"
 	"github.com/tarm/serial"
 	"go.uber.org/zap"
 )
 
-func NewDongle(logger *zap.Logger) *Dongle {
+func NewDongle(logger *zap.Logger, cfg DongleConfig) *Dongle {
 	d := &Dongle{
-		logger:   logger,
-		Baudrate: 115200,
+		logger:       logger,
+		Baudrate:     cfg.Baudrate,
+		Parity:       cfg.Parity,
+		ReadTimeout:  cfg.ReadTimeout,
+		SerialDevice: cfg.SerialDevice,
 	}
 
-	switch runtime.GOOS {
-	case "darwin":
-		// mac
-		d.SerialDevice = "/dev/tty.usbserial-A103BTKQ"
-	default:
-		// raspberry pi.
-		d.SerialDevice = "/dev/ttyUSB0"
+	if len(d.SerialDevice) == 0 {
+		d.SerialDevice = defaultSerialDevice()
 	}
 
 	return d
@@ -34,16 +30,20 @@ func NewDongle(logger *zap.Logger) *Dongle {
 
 type Dongle struct {
 	Baudrate     int
+	Parity       serial.Parity
+	ReadTimeout  time.Duration
 	SerialDevice string
 	Port         *serial.Port
 	logger       *zap.Logger
+	metrics      *Metrics
 }
 
 func (b *Dongle) Connect() error {
 	c := &serial.Config{
 		Name:        b.SerialDevice,
 		Baud:        b.Baudrate,
-		ReadTimeout: time.Duration(goutils.GetIntEnv("REFRESH_SECONDS", 5) * 2),
+		Parity:      b.Parity,
+		ReadTimeout: b.ReadTimeout,
 	}
 	s, err := serial.OpenPort(c)
 	if err != nil {
@@ -54,7 +54,9 @@ func (b *Dongle) Connect() error {
 }
 
 func (b *Dongle) Close() {
-	b.Port.Close()
+	if b.Port != nil {
+		b.Port.Close()
+	}
 }
 
 func (b *Dongle) SKVER() (string, error) {
@@ -76,11 +78,21 @@ func (b *Dongle) SKVER() (string, error) {
 func (b *Dongle) write(s string) error {
 	_, err := b.Port.Write([]byte(s))
 	if err != nil {
+		b.metrics.serialError("write")
 		return err
 	}
 	return nil
 }
 
+// scanErr records the read error which ended the scanner, the read timeout is not an error.
+func (b *Dongle) scanErr(scanner *bufio.Scanner) error {
+	err := scanner.Err()
+	if err != nil {
+		b.metrics.serialError("read")
+	}
+	return err
+}
+
 func (b *Dongle) flush() error {
 	err := b.Port.Flush()
 	if err != nil {
@@ -100,7 +112,7 @@ func (b *Dongle) readUntilOK() ([]string, error) {
 			break
 		}
 	}
-	return reply, nil
+	return reply, b.scanErr(scanner)
 }
 
 func (b *Dongle) SKSETPWD(pwd string) error {
@@ -120,6 +132,32 @@ func (b *Dongle) SKSETRBID(rbid string) error {
 	return nil
 }
 
+// SKTERM ends the PANA session, so the meter accepts a new join right away.
+func (b *Dongle) SKTERM() error {
+	err := b.write("SKTERM\r\n")
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(b.Port)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		l := scanner.Text()
+		b.logger.Debug(l)
+		if strings.Contains(l, "FAIL ") {
+			return fmt.Errorf("Failed to SKTERM. %s", l)
+		}
+		// EVENT 27 = session terminated, EVENT 28 = terminate request timed out
+		if strings.Contains(l, "EVENT 27 ") {
+			break
+		}
+		if strings.Contains(l, "EVENT 28 ") {
+			b.metrics.timeout("SKTERM")
+			return fmt.Errorf("SKTERM is timeout")
+		}
+	}
+	return b.scanErr(scanner)
+}
+
 type PAN struct {
 	Channel     string
 	ChannelPage string
@@ -189,6 +227,7 @@ func (b *Dongle) SKSCAN(ctx context.Context, duration int) (*PAN, error) {
 	case res := <-scanCh:
 		return &res, nil
 	case <-skscanCtx.Done():
+		b.metrics.timeout("SKSCAN")
 		return nil, fmt.Errorf("SKSCAN is timeout")
 	}
 }
@@ -213,11 +252,13 @@ func (b *Dongle) SKLL64(addr string) (string, error) {
 	reader := bufio.NewReader(b.Port)
 	r, _, err := reader.ReadLine()
 	if err != nil {
+		b.metrics.serialError("read")
 		return "", err
 	}
 	b.logger.Debug(string(r))
 	r, _, err = reader.ReadLine()
 	if err != nil {
+		b.metrics.serialError("read")
 		return "", err
 	}
 	b.logger.Debug(string(r))
@@ -237,10 +278,17 @@ func (b *Dongle) SKJOIN(ipv6Addr string) error {
 		if strings.Contains(l, "FAIL ") {
 			return fmt.Errorf("Failed to SKJOIN. %s", l)
 		}
+		// EVENT 24 = PANA authentication failed
+		if strings.Contains(l, "EVENT 24 ") {
+			return fmt.Errorf("SKJOIN is failed. %s", l)
+		}
 		if strings.Contains(l, "EVENT 25 ") {
 			break
 		}
 	}
+	if err := b.scanErr(scanner); err != nil {
+		return err
+	}
 	if scanner.Scan() {
 		b.logger.Debug(scanner.Text())
 	}
@@ -251,8 +299,10 @@ func (b *Dongle) SKSENDTO(handle, ipAddr, port, sec string, data []byte) (string
 	s := fmt.Sprintf("SKSENDTO %s %s %s %s %.4X ", handle, ipAddr, port, sec, len(data))
 	d := append([]byte(s), data[:]...)
 	d = append(d, []byte("\r\n")[:]...)
+	start := time.Now()
 	_, err := b.Port.Write(d)
 	if err != nil {
+		b.metrics.serialError("write")
 		return "", err
 	}
 	reader := bufio.NewReader(b.Port)
@@ -262,12 +312,20 @@ func (b *Dongle) SKSENDTO(handle, ipAddr, port, sec string, data []byte) (string
 		if l != "" {
 			b.logger.Debug("[RESPONSE] >> " + l)
 		}
+		b.metrics.event(l)
 		if strings.Contains(l, "FAIL ") {
 			return "", fmt.Errorf("Failed to SKSENDTO. %s", l)
 		}
 		if strings.Contains(l, "ERXUDP ") {
+			b.metrics.sendto(start)
+			b.metrics.erxudp(l)
 			return l, nil
 		}
 	}
+	if err := b.scanErr(scanner); err != nil {
+		return "", err
+	}
+	// no response until the read timeout
+	b.metrics.timeout("SKSENDTO")
 	return "", nil
 }
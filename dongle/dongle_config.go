@@ -0,0 +1,130 @@
+package dongle
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/utility/constant"
+	"github.com/tarm/serial"
+	"go.uber.org/zap"
+)
+
+type DongleConfig struct {
+	// SerialDevice is the device path, it is auto-discovered when empty
+	SerialDevice string
+	// DeviceGlob narrows the auto-discovery, e.g. /dev/serial/by-id/*Rohm*
+	DeviceGlob        string
+	Baudrate          int
+	Parity            serial.Parity
+	ReadTimeout       time.Duration
+	ConnectRetryCount int
+}
+
+func ParseParity(s string) (serial.Parity, error) {
+	switch strings.ToLower(s) {
+	case "", "n", "none":
+		return serial.ParityNone, nil
+	case "o", "odd":
+		return serial.ParityOdd, nil
+	case "e", "even":
+		return serial.ParityEven, nil
+	case "m", "mark":
+		return serial.ParityMark, nil
+	case "s", "space":
+		return serial.ParitySpace, nil
+	default:
+		return serial.ParityNone, fmt.Errorf("unsupported parity: %s", s)
+	}
+}
+
+func defaultSerialDevice() string {
+	switch runtime.GOOS {
+	case "darwin":
+		// mac
+		return "/dev/tty.usbserial-A103BTKQ"
+	default:
+		// raspberry pi.
+		return "/dev/ttyUSB0"
+	}
+}
+
+func candidateDevices(cfg DongleConfig) []string {
+	patterns := []string{cfg.DeviceGlob}
+	if len(cfg.DeviceGlob) == 0 {
+		switch runtime.GOOS {
+		case "darwin":
+			patterns = []string{"/dev/tty.usbserial-*"}
+		default:
+			patterns = []string{"/dev/serial/by-id/*", "/dev/ttyUSB*", "/dev/ttyACM*"}
+		}
+	}
+
+	// by-id links and their targets are the same port, probe it once
+	seen := map[string]bool{}
+	devices := []string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, m := range matches {
+			real, err := filepath.EvalSymlinks(m)
+			if err != nil {
+				real = m
+			}
+			if !seen[real] {
+				seen[real] = true
+				devices = append(devices, m)
+			}
+		}
+	}
+	return devices
+}
+
+// DiscoverDevice probes the candidate ports with SKVER and returns the first one which answers.
+func DiscoverDevice(logger *zap.Logger, cfg DongleConfig) (string, error) {
+	candidates := candidateDevices(cfg)
+	for _, device := range candidates {
+		v, err := probeDevice(logger, cfg, device)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("probe %s is failed: %v", device, err))
+			continue
+		}
+		logger.Info(fmt.Sprintf("dongle found at %s, version %s", device, v))
+		return device, nil
+	}
+	return "", fmt.Errorf("dongle is not found in %v", candidates)
+}
+
+func probeDevice(logger *zap.Logger, cfg DongleConfig, device string) (string, error) {
+	c := cfg
+	c.SerialDevice = device
+	c.ReadTimeout = time.Second / 2
+
+	d := NewDongle(logger, c)
+	if err := d.Connect(); err != nil {
+		return "", err
+	}
+	// closing the port also unblocks SKVER on timeout
+	defer d.Close()
+
+	type result struct {
+		version string
+		err     error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		v, err := d.SKVER()
+		ch <- result{v, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.version, r.err
+	case <-time.After(time.Duration(constant.ProbeTimeoutSecond) * time.Second):
+		return "", fmt.Errorf("SKVER is timeout")
+	}
+}
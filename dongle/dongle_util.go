@@ -2,44 +2,70 @@ package dongle
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/michibiki-io/goutils"
 	"github.com/michibiki-io/hems-metrics-go/model"
 	"github.com/michibiki-io/hems-metrics-go/utility/constant"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
-func NewDongleUtil(l *zap.Logger) *DongleUtil {
+// NewDongleUtil creates the util, metrics may be nil.
+func NewDongleUtil(l *zap.Logger, cfg DongleConfig, metrics *Metrics) *DongleUtil {
 	return &DongleUtil{
-		logger: l,
+		logger:  l,
+		config:  cfg,
+		metrics: metrics,
 	}
 }
 
 type DongleUtil struct {
 	logger   *zap.Logger
+	config   DongleConfig
+	device   string
 	dongle   *Dongle
 	ipv6addr string
+	joined   bool
+	version  string
+	meter    *model.MeterInfo
+	metrics  *Metrics
+	// export is true when the meter measures the exported energy
+	export bool
+}
+
+// SetConfig replaces the config, it is used from the next Init.
+func (du *DongleUtil) SetConfig(cfg DongleConfig) {
+	if cfg != du.config {
+		du.config = cfg
+		du.device = ""
+	}
 }
 
 func (du *DongleUtil) Init(ctx context.Context, pwd string, rbID string) (bool, error) {
 
 	// dongle init retry count
-	connectRetryCount := goutils.GetIntEnv("CONNECT_RETRY_COUNT", 5)
+	connectRetryCount := du.config.ConnectRetryCount
 
 	// init result
 	result := false
 	var err error = nil
 
 	for counter := 0; counter < connectRetryCount; counter++ {
-		err = du.doInit(ctx, pwd, rbID, constant.MinimumSkscanDurationSeoncds+counter)
+		initCtx, end := command(ctx, "dongle.init", attribute.Int("attempt", counter+1))
+		err = du.doInit(initCtx, pwd, rbID, constant.MinimumSkscanDurationSeoncds+counter)
+		end(err)
 		if err == nil {
 			result = true
 			break
 		}
+		// release the port of the failed attempt
+		du.Disconnect()
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
 	return result, err
@@ -47,12 +73,38 @@ func (du *DongleUtil) Init(ctx context.Context, pwd string, rbID string) (bool,
 
 func (du *DongleUtil) doInit(ctx context.Context, pwd string, rbID string, duration int) error {
 
-	d := NewDongle(du.logger)
-	du.dongle = d       // TODO
 	logger := du.logger // TODO
 
-	logger.Info("Connect...")
-	d.Connect()
+	// the configured device, or the discovered one
+	if len(du.device) == 0 {
+		du.device = du.config.SerialDevice
+	}
+	if len(du.device) == 0 {
+		if device, err := DiscoverDevice(logger, du.config); err != nil {
+			logger.Warn(err.Error())
+		} else {
+			du.device = device
+		}
+	}
+
+	cfg := du.config
+	cfg.SerialDevice = du.device
+	d := NewDongle(logger, cfg)
+	d.metrics = du.metrics
+	du.dongle = d // TODO
+	du.joined = false
+
+	logger.Info(fmt.Sprintf("Connect %s...", d.SerialDevice))
+	_, end := command(ctx, "connect", attribute.String("device", d.SerialDevice))
+	err := d.Connect()
+	end(err)
+	if err != nil {
+		du.metrics.serialError("open")
+		logger.Error("Connect is failed", zap.Error(err))
+		// discover again on next try, the dongle may be re-plugged
+		du.device = ""
+		return err
+	}
 	logger.Info("Connect OK.")
 	//defer d.Close()
 
@@ -61,48 +113,69 @@ func (du *DongleUtil) doInit(ctx context.Context, pwd string, rbID string, durat
 	logger.Debug("Wait complete.")
 
 	logger.Debug("SKVER...")
+	_, end = command(ctx, "SKVER")
 	v, err := d.SKVER()
+	end(err)
 	logger.Debug(fmt.Sprintf("SKVER Response : %s", v))
 	if err != nil {
 		logger.Error("SKVER is failed")
 		return err
 	}
 	logger.Info("SKVER OK.")
+	du.version = v
+	du.metrics.version(v)
 
+	logger.Debug("SKSETPWD...")
+	_, end = command(ctx, "SKSETPWD")
 	err = d.SKSETPWD(pwd)
+	end(err)
 	if err != nil {
 		logger.Error("SKSETPWD is failed")
 		return err
 	}
 
+	logger.Debug("SKSETRBID...")
+	_, end = command(ctx, "SKSETRBID")
 	err = d.SKSETRBID(rbID)
+	end(err)
 	if err != nil {
 		logger.Error("SKSETRBID is failed")
 		return err
 	}
 
 	logger.Debug("SKSCAN...")
-	pan, err := d.SKSCAN(ctx, duration)
+	scanCtx, end := command(ctx, "SKSCAN", attribute.Int("duration", duration))
+	scanStart := time.Now()
+	pan, err := d.SKSCAN(scanCtx, duration)
+	end(err)
+	du.metrics.scan(scanStart, err)
 	logger.Debug(fmt.Sprintf("%#v\n", pan))
 	if err != nil {
 		logger.Error("SKSCAN is failed")
 		return err
 	}
+	du.metrics.pan(pan.LQI)
 
+	_, end = command(ctx, "SKSREG", attribute.String("register", "S2"))
 	err = d.SKSREG("S2", pan.Channel)
+	end(err)
 	if err != nil {
 		logger.Error("SKSREG S2 is failed")
 		return err
 	}
 
 	logger.Debug("Set PanID to S3 register...")
+	_, end = command(ctx, "SKSREG", attribute.String("register", "S3"))
 	err = d.SKSREG("S3", pan.PanID)
+	end(err)
 	if err != nil {
 		logger.Error("SKSREG S3 is failed")
 		return err
 	}
 	logger.Debug("Get IPv6 Addr with SKLL64...")
+	_, end = command(ctx, "SKLL64")
 	ipv6Addr, err := d.SKLL64(pan.Addr)
+	end(err)
 	du.ipv6addr = ipv6Addr // TODO
 	if err != nil {
 		logger.Error("get IPv6 Address is failed")
@@ -111,178 +184,346 @@ func (du *DongleUtil) doInit(ctx context.Context, pwd string, rbID string, durat
 
 	logger.Debug("IPv6 Addr is " + ipv6Addr)
 	logger.Debug("SKJOIN...")
+	_, end = command(ctx, "SKJOIN")
 	err = d.SKJOIN(ipv6Addr)
+	end(err)
+	du.metrics.join(err)
 	if err != nil {
 		logger.Error("SKJOIN is failed")
 		return err
 	}
+	du.joined = true
+
+	// meter identity, not fatal
+	if m, err := du.fetchMeterInfo(ctx); err != nil {
+		logger.Warn("get meter info is failed", zap.Error(err))
+		du.meter = &model.MeterInfo{DongleVersion: du.version}
+	} else {
+		du.meter = m
+	}
+
+	return nil
+}
+
+// MeterInfo returns the identity of the joined meter, nil before Init.
+func (du *DongleUtil) MeterInfo() *model.MeterInfo {
+	return du.meter
+}
+
+func (du *DongleUtil) fetchMeterInfo(ctx context.Context) (*model.MeterInfo, error) {
+
+	du.logger.Debug("get meter info...")
+	_, end := command(ctx, "SKSENDTO", attribute.String("request", "meter_info"))
+	r, err := du.dongle.SKSENDTO("1", du.ipv6addr, "0E1A", "1", getRequest(0x8A, 0x8D))
+	end(err)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := du.readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	// 0x72 = Get_Res, 0x52 = Get_SNA when a property is not supported
+	if frame.SEOJ != smartMeterEOJ || (frame.ESV != "72" && frame.ESV != "52") {
+		du.metrics.malformed("seoj_esv")
+		return nil, fmt.Errorf("data is invalid, seoj:%v, ESV:%v", frame.SEOJ, frame.ESV)
+	}
+
+	m := &model.MeterInfo{
+		ManufacturerCode: frame.Properties["8A"],
+		SerialNumber:     asciiString(frame.Properties["8D"]),
+		DongleVersion:    du.version,
+	}
+	du.logger.Info(fmt.Sprintf("meter manufacturer: %s, serial number: %s", m.ManufacturerCode, m.SerialNumber))
+
+	return m, nil
+}
+
+// Terminate ends the PANA session if joined. The port must not be in use by Fetch.
+func (du *DongleUtil) Terminate() error {
+
+	if du.dongle == nil || !du.joined {
+		return nil
+	}
+
+	du.logger.Info("SKTERM...")
+	_, end := command(context.Background(), "SKTERM")
+	err := du.dongle.SKTERM()
+	end(err)
+	du.joined = false
+	if err != nil {
+		du.logger.Warn("SKTERM is failed", zap.Error(err))
+		return err
+	}
+	du.logger.Info("SKTERM OK.")
 
 	return nil
 }
 
 func (du *DongleUtil) Disconnect() {
 
-	du.dongle.Close()
+	if du.dongle != nil {
+		du.dongle.Close()
+	}
 
 }
 
-var b = []byte{0x10, 0x81, 0x00, 0x01, 0x05, 0xFF, 0x01, 0x02, 0x88, 0x01, 0x62, 0x05, 0xE1, 0x00, 0xE0, 0x00, 0xD7, 0x00, 0xE7, 0x00, 0xE8, 0x00}
+var b = getRequest(0xE1, 0xE0, 0xD7, 0xE7, 0xE8, 0xEA, 0xE3, 0xEB)
 
-func (du *DongleUtil) Fetch(ctx context.Context, f func(result *model.HemsData), queue chan string) error {
+func (du *DongleUtil) Fetch(ctx context.Context, f func(result *model.HemsData)) error {
 
 	logger := du.logger // TODO
 
 	logger.Debug("SKSENDTO...")
+	_, end := command(ctx, "SKSENDTO", attribute.String("request", "reading"))
 	r, err := du.dongle.SKSENDTO("1", du.ipv6addr, "0E1A", "1", b)
+	end(err)
 	if err != nil {
 		logger.Error("error", zap.Any("err", err))
 		f(nil)
 		return err
 	}
-	a := strings.Split(r, " ")
-	if len(a) != 9 {
-		errmsg := fmt.Sprintf("data length is invalid: %d", len(a))
-		logger.Warn(errmsg)
+	if len(r) == 0 {
+		// counted as the timeout of SKSENDTO
 		f(nil)
-		return fmt.Errorf(errmsg)
+		return fmt.Errorf("no response to SKSENDTO")
 	}
-	if a[7] != "0024" {
-		logger.Warn(fmt.Sprintf("%s is not 0024. invalid data ? :", a[7]))
+	frame, err := du.readFrame(r)
+	if err != nil {
+		logger.Warn("response is invalid", zap.Error(err))
+		f(nil)
+		return err
+	}
+	// 0x52 = Get_SNA when a property is not supported, e.g. the export
+	if frame.SEOJ != smartMeterEOJ || (frame.ESV != "72" && frame.ESV != "52") {
+		du.metrics.malformed("seoj_esv")
+		logger.Warn(fmt.Sprintf("data is invalid, seoj:%v, ESV:%v", frame.SEOJ, frame.ESV))
 		f(nil)
 		return nil
 	}
-	res := a[8]
-
-	// check data
-	seoj := res[8 : 8+6]
-	ESV := res[20 : 20+2]
-
-	if seoj == "028801" && ESV == "72" {
-
-		sigdigit := 0
-		unitnum := float32(1.0)
-		pos := 24
-		cumulative_power_consumption_base := 0
-		cumulative_power_consumption := float32(0.0)
-		instantaneous_power_consumption := 0
-		instantaneous_current_r_phase := 0
-		instantaneous_current_t_phase := 0
-
-		for pos < len(res) {
-
-			// epc
-			epc := res[pos : pos+2]
-
-			// pdc
-			pdc := res[pos+2 : pos+4]
-			datalen, err := strconv.ParseUint(pdc, 16, 0)
-			if err != nil {
-				continue
-			}
-
-			// edt
-			edt := res[pos+4 : pos+4+int(datalen)*2]
-
-			// log
-			logger.Debug(fmt.Sprintf("%s / %s / %s", epc, pdc, edt))
-
-			pos = pos + 4 + int(datalen)*2
-
-			if epc == "D7" {
-				// D7 = 有効桁数
-				if tmp, err := strconv.ParseInt(edt, 16, 0); err != nil {
-					logger.Warn(fmt.Sprintf("data %s is invalid: %s", epc, edt))
-				} else {
-					sigdigit = int(tmp)
-				}
-
-			} else if epc == "E1" {
-				// E1 = 単位
-				if edt == "00" {
-					unitnum = 1.0
-				} else if edt == "01" {
-					unitnum = 0.1
-				} else if edt == "02" {
-					unitnum = 0.01
-				} else if edt == "03" {
-					unitnum = 0.001
-				} else if edt == "04" {
-					unitnum = 0.0001
-				} else if edt == "0A" {
-					unitnum = 10.0
-				} else if edt == "0B" {
-					unitnum = 100.0
-				} else if edt == "0C" {
-					unitnum = 1000.0
-				} else if edt == "0D" {
-					unitnum = 10000.0
-				} else {
-					logger.Warn(fmt.Sprintf("data %s is invalid: %s", epc, edt))
-				}
-			} else if epc == "E0" {
-				// E0 = 積算電力
-				if tmp, err := strconv.ParseInt(edt, 16, 0); err != nil {
-					logger.Warn(fmt.Sprintf("data %s is invalid: %s", epc, edt))
-				} else {
-					cumulative_power_consumption_base = int(tmp)
-				}
-
-			} else if epc == "E7" {
-				// E7 = 瞬間消費電力
-				if tmp, err := strconv.ParseInt(edt, 16, 0); err != nil {
-					logger.Warn(fmt.Sprintf("data %s is invalid: %s", epc, edt))
-				} else {
-					instantaneous_power_consumption = int(tmp)
-				}
-			} else if epc == "E8" {
-				// E8 = 瞬間消費電流
-				if tmp, err := strconv.ParseInt(edt[0:len(edt)/2], 16, 16); err != nil {
-					logger.Warn(fmt.Sprintf("data %s is invalid: %s", epc, edt[0:len(edt)/2]))
-				} else {
-					instantaneous_current_r_phase = int(tmp)
-				}
-				if tmp, err := strconv.ParseInt(edt[len(edt)/2:], 16, 16); err != nil {
-					logger.Warn(fmt.Sprintf("data %s is invalid: %s", epc, edt[len(edt)/2:]))
-				} else {
-					instantaneous_current_t_phase = int(tmp)
-				}
-			}
+
+	sigdigit := 0
+	unitnum := float32(1.0)
+	cumulative_power_consumption_base := 0
+	instantaneous_power_consumption := 0
+	instantaneous_current_r_phase := 0
+	instantaneous_current_t_phase := 0
+
+	for epc, edt := range frame.Properties {
+		logger.Debug(fmt.Sprintf("%s / %s", epc, edt))
+		if len(edt) == 0 {
+			// not supported
+			delete(frame.Properties, epc)
 		}
+	}
 
-		cumulative_power_consumption = float32(cumulative_power_consumption_base) * unitnum
-
-		// str_cumulative_power_consumption := fmt.Sprintf("%f", cumulative_power_consumption)
-		// if unitnum < 1 {
-		// 	if tmp, err := strconv.ParseFloat(str_cumulative_power_consumption[0:sigdigit+1], 0); err == nil {
-		// 		cumulative_power_consumption = float32(tmp)
-		// 	}
-		// }
-
-		// result structure
-		result := model.CreateHemsData(time.Now(),
-			cumulative_power_consumption,
-			instantaneous_power_consumption,
-			instantaneous_current_r_phase, instantaneous_current_t_phase)
-
-		logger.Debug(fmt.Sprintf("sigdigit: %v", sigdigit))
-		logger.Debug(fmt.Sprintf("WH: %v [kWh]", result.CumulativePowerConsumption))
-		logger.Debug(fmt.Sprintf("W: %v [W]", result.InstantaneousPowerConsumption))
-		logger.Debug(fmt.Sprintf("A: %v [A], R phase: %v [A], T phase: %v [A]", result.Current, result.RphaseCurrent, result.TpahseCurrent))
-		logger.Debug(fmt.Sprintf("PF: %v [%%]", result.PowerFactor))
-
-		select {
-		case <-ctx.Done():
-			f(nil)
-			return nil
-		default:
-			f(result) // output
+	// D7 = 有効桁数
+	if edt, ok := frame.Properties["D7"]; ok {
+		if tmp, err := strconv.ParseInt(edt, 16, 0); err != nil {
+			logger.Warn(fmt.Sprintf("data D7 is invalid: %s", edt))
+		} else {
+			sigdigit = int(tmp)
 		}
+	}
 
+	// E1 = 単位
+	if edt, ok := frame.Properties["E1"]; ok {
+		if u, ok := energyUnits[edt]; ok {
+			unitnum = u
+		} else {
+			logger.Warn(fmt.Sprintf("data E1 is invalid: %s", edt))
+		}
+	}
+
+	// E0 = 積算電力, E7 = 瞬間消費電力, a reading without them is not published.
+	// 0 of the cumulative energy looks like a reset of the meter.
+	present := true
+	if edt, ok := frame.Properties["E0"]; !ok {
+		logger.Warn("data E0 is missing")
+		present = false
+	} else if tmp, err := strconv.ParseInt(edt, 16, 0); err != nil {
+		logger.Warn(fmt.Sprintf("data E0 is invalid: %s", edt))
+		present = false
 	} else {
-		logger.Warn(fmt.Sprintf("data is invalid, seoj:%v, ESV:%v", seoj, ESV))
+		cumulative_power_consumption_base = int(tmp)
+	}
+	if edt, ok := frame.Properties["E7"]; !ok {
+		logger.Warn("data E7 is missing")
+		present = false
+	} else if tmp, err := strconv.ParseInt(edt, 16, 0); err != nil {
+		logger.Warn(fmt.Sprintf("data E7 is invalid: %s", edt))
+		present = false
+	} else {
+		instantaneous_power_consumption = int(tmp)
+	}
+	if !present {
 		f(nil)
 		return nil
 	}
 
+	// E8 = 瞬間電流 (R相, T相), a phase is not published without it
+	r_phase_measured, t_phase_measured := false, false
+	if edt, ok := frame.Properties["E8"]; ok {
+		if tmp, measured, err := phaseCurrent(edt[0 : len(edt)/2]); err != nil {
+			logger.Warn(fmt.Sprintf("data E8 is invalid: %s", edt[0:len(edt)/2]))
+		} else {
+			instantaneous_current_r_phase, r_phase_measured = tmp, measured
+		}
+		if tmp, measured, err := phaseCurrent(edt[len(edt)/2:]); err != nil {
+			logger.Warn(fmt.Sprintf("data E8 is invalid: %s", edt[len(edt)/2:]))
+		} else {
+			instantaneous_current_t_phase, t_phase_measured = tmp, measured
+		}
+	}
+
+	cumulative_power_consumption := float32(cumulative_power_consumption_base) * unitnum
+
+	// result structure
+	result := model.CreateHemsData(time.Now(),
+		cumulative_power_consumption,
+		instantaneous_power_consumption,
+		instantaneous_current_r_phase, instantaneous_current_t_phase)
+	result.RphaseUnmeasured = !r_phase_measured
+	result.TphaseUnmeasured = !t_phase_measured
+
+	// EA = 定時積算電力量
+	if edt, ok := frame.Properties["EA"]; ok {
+		if fixed, err := fixedReading(edt, unitnum); err != nil {
+			logger.Warn(fmt.Sprintf("data EA is invalid: %s", edt))
+		} else {
+			result.Fixed = fixed
+		}
+	}
+
+	// E3 = 積算電力量 逆方向
+	if edt, ok := frame.Properties["E3"]; ok {
+		if v, ok, err := cumulativeValue(edt, unitnum); err != nil {
+			logger.Warn(fmt.Sprintf("data E3 is invalid: %s", edt))
+		} else if ok {
+			result.CumulativePowerExport = v
+			du.export = true
+		}
+	}
+
+	// EB = 定時積算電力量 逆方向, the one at the time of EA
+	if result.Fixed != nil && du.export {
+		if reverse, err := fixedReading(frame.Properties["EB"], unitnum); err == nil && reverse != nil && reverse.Time.Equal(result.Fixed.Time) {
+			result.Fixed.ExportKWh = reverse.CumulativeKWh
+		} else {
+			result.Fixed.Partial = true
+		}
+	}
+
+	logger.Debug(fmt.Sprintf("sigdigit: %v", sigdigit))
+	logger.Debug(fmt.Sprintf("WH: %v [kWh]", result.CumulativePowerConsumption))
+	logger.Debug(fmt.Sprintf("WH export: %v [kWh]", result.CumulativePowerExport))
+	logger.Debug(fmt.Sprintf("W: %v [W]", result.InstantaneousPowerConsumption))
+	logger.Debug(fmt.Sprintf("A: %v [A], R phase: %v [A], T phase: %v [A]", result.Current, result.RphaseCurrent, result.TpahseCurrent))
+	logger.Debug(fmt.Sprintf("PF: %v [%%]", result.PowerFactor))
+
+	select {
+	case <-ctx.Done():
+		f(nil)
+		return nil
+	default:
+		f(result) // output
+	}
+
 	return nil
 }
+
+// FetchHistory reads the fixed time values of the day of t from the history of the meter (EPC E5 and E2).
+// The port must not be in use by Fetch.
+func (du *DongleUtil) FetchHistory(ctx context.Context, t time.Time) ([]model.FixedReading, error) {
+
+	if du.dongle == nil || !du.joined {
+		return nil, fmt.Errorf("dongle is not joined")
+	}
+	day := historyDay(t, time.Now())
+	if day < 0 || day > maxHistoryDay {
+		return nil, fmt.Errorf("history of %s is not kept", t.In(meterLocation).Format("2006-01-02"))
+	}
+
+	du.logger.Debug(fmt.Sprintf("get history of %d days ago...", day))
+	frame, err := du.request(ctx, "history_day", setRequest(0xE5, byte(day)))
+	if err != nil {
+		return nil, err
+	}
+	// 0x71 = Set_Res
+	if frame.SEOJ != smartMeterEOJ || frame.ESV != "71" {
+		du.metrics.malformed("seoj_esv")
+		return nil, fmt.Errorf("data is invalid, seoj:%v, ESV:%v", frame.SEOJ, frame.ESV)
+	}
+
+	frame, err = du.request(ctx, "history", getRequest(0xE1, 0xE2, 0xE4))
+	if err != nil {
+		return nil, err
+	}
+	if frame.SEOJ != smartMeterEOJ || (frame.ESV != "72" && frame.ESV != "52") {
+		du.metrics.malformed("seoj_esv")
+		return nil, fmt.Errorf("data is invalid, seoj:%v, ESV:%v", frame.SEOJ, frame.ESV)
+	}
+	unit, ok := energyUnits[frame.Properties["E1"]]
+	if !ok {
+		return nil, fmt.Errorf("data E1 is invalid: %s", frame.Properties["E1"])
+	}
+	now := time.Now()
+	readings, err := historyReadings(frame.Properties["E2"], unit, now)
+	if err != nil {
+		return nil, fmt.Errorf("data E2 is invalid: %w", err)
+	}
+	if !du.export {
+		return readings, nil
+	}
+
+	// E4 = 積算電力量計測値履歴 逆方向
+	exports := map[int64]float32{}
+	if reverse, err := historyReadings(frame.Properties["E4"], unit, now); err != nil {
+		du.logger.Warn("data E4 is invalid", zap.Error(err))
+	} else {
+		for _, r := range reverse {
+			exports[r.Time.Unix()] = r.CumulativeKWh
+		}
+	}
+	for i := range readings {
+		if v, ok := exports[readings[i].Time.Unix()]; ok {
+			readings[i].ExportKWh = v
+		} else {
+			readings[i].Partial = true
+		}
+	}
+	return readings, nil
+}
+
+// request sends the frame to the meter and reads the response.
+func (du *DongleUtil) request(ctx context.Context, name string, data []byte) (*echonetFrame, error) {
+	_, end := command(ctx, "SKSENDTO", attribute.String("request", name))
+	r, err := du.dongle.SKSENDTO("1", du.ipv6addr, "0E1A", "1", data)
+	end(err)
+	if err != nil {
+		return nil, err
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no response to SKSENDTO")
+	}
+	return du.readFrame(r)
+}
+
+// readFrame parses the ECHONET Lite frame of the ERXUDP response, and counts the malformed one.
+func (du *DongleUtil) readFrame(line string) (*echonetFrame, error) {
+	data, err := erxudpData(line)
+	if err != nil {
+		if errors.Is(err, errDataLength) {
+			du.metrics.malformed("data_length")
+		} else {
+			du.metrics.malformed("erxudp")
+		}
+		return nil, err
+	}
+	frame, err := parseEchonetFrame(data)
+	if err != nil {
+		du.metrics.malformed("echonet_frame")
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,204 @@
+package dongle
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/model"
+)
+
+// 低圧スマート電力量メータ
+const smartMeterEOJ = "028801"
+
+// スマートメーターの時刻は日本時間
+var meterLocation = time.FixedZone("JST", 9*60*60)
+
+// the cumulative energy which is not recorded yet
+const noValue = "FFFFFFFE"
+
+// ECHONET Lite frame from the ERXUDP data, hex encoded
+type echonetFrame struct {
+	SEOJ       string
+	ESV        string
+	Properties map[string]string
+}
+
+func parseEchonetFrame(res string) (*echonetFrame, error) {
+	// EHD(4) TID(4) SEOJ(6) DEOJ(6) ESV(2) OPC(2)
+	if len(res) < 24 {
+		return nil, fmt.Errorf("frame is too short: %d", len(res))
+	}
+
+	frame := &echonetFrame{
+		SEOJ:       res[8 : 8+6],
+		ESV:        res[20 : 20+2],
+		Properties: map[string]string{},
+	}
+
+	pos := 24
+	for pos+4 <= len(res) {
+		epc := res[pos : pos+2]
+		datalen, err := strconv.ParseUint(res[pos+2:pos+4], 16, 0)
+		if err != nil {
+			return nil, fmt.Errorf("pdc of %s is invalid: %s", epc, res[pos+2:pos+4])
+		}
+		end := pos + 4 + int(datalen)*2
+		if end > len(res) {
+			return nil, fmt.Errorf("edt of %s is truncated", epc)
+		}
+		frame.Properties[epc] = res[pos+4 : end]
+		pos = end
+	}
+
+	return frame, nil
+}
+
+var errDataLength = errors.New("data length does not match")
+
+// erxudpData returns the data of the ERXUDP line, the DATALEN and the DATA are the last fields of both
+// BP35A1: ERXUDP SENDER DEST RPORT LPORT SENDERLLA SECURED DATALEN DATA
+// BP35C0: ERXUDP SENDER DEST RPORT LPORT SENDERLLA RSSI SECURED SIDE DATALEN DATA
+func erxudpData(line string) (string, error) {
+	a := strings.Split(strings.TrimSpace(line), " ")
+	if len(a) != 9 && len(a) != 11 {
+		return "", fmt.Errorf("number of the fields is invalid: %d", len(a))
+	}
+	data := a[len(a)-1]
+	if n, err := strconv.ParseUint(a[len(a)-2], 16, 16); err != nil || int(n)*2 != len(data) {
+		return "", fmt.Errorf("%w: %s, %d bytes", errDataLength, a[len(a)-2], len(data)/2)
+	}
+	return data, nil
+}
+
+// 積算電力量単位 (EPC E1)
+var energyUnits = map[string]float32{
+	"00": 1.0,
+	"01": 0.1,
+	"02": 0.01,
+	"03": 0.001,
+	"04": 0.0001,
+	"0A": 10.0,
+	"0B": 100.0,
+	"0C": 1000.0,
+	"0D": 10000.0,
+}
+
+// getRequest builds the Get (ESV 0x62) frame to the smart meter for the properties.
+func getRequest(epcs ...byte) []byte {
+	// EHD, TID, SEOJ = コントローラ, DEOJ = 低圧スマート電力量メータ, ESV, OPC
+	b := []byte{0x10, 0x81, 0x00, 0x01, 0x05, 0xFF, 0x01, 0x02, 0x88, 0x01, 0x62, byte(len(epcs))}
+	for _, epc := range epcs {
+		b = append(b, epc, 0x00)
+	}
+	return b
+}
+
+// setRequest builds the SetC (ESV 0x61) frame to the smart meter for a property.
+func setRequest(epc byte, edt ...byte) []byte {
+	return append([]byte{0x10, 0x81, 0x00, 0x01, 0x05, 0xFF, 0x01, 0x02, 0x88, 0x01, 0x61, 0x01, epc, byte(len(edt))}, edt...)
+}
+
+// phaseCurrent converts a half of E8 [0.1A], false when the phase is not measured.
+// 0x7FFE is 計測値なし (T相 of 単相2線式), 0x7FFF and 0x8000 are overflow and underflow.
+func phaseCurrent(edt string) (int, bool, error) {
+	v, err := strconv.ParseUint(edt, 16, 16)
+	if err != nil {
+		return 0, false, err
+	}
+	switch v {
+	case 0x7FFE, 0x7FFF, 0x8000:
+		return 0, false, nil
+	}
+	return int(int16(uint16(v))), true, nil
+}
+
+// cumulativeValue converts the cumulative energy [kWh], false when it is not recorded.
+func cumulativeValue(edt string, unit float32) (float32, bool, error) {
+	if edt == noValue {
+		return 0, false, nil
+	}
+	v, err := strconv.ParseUint(edt, 16, 32)
+	if err != nil {
+		return 0, false, err
+	}
+	return float32(v) * unit, true, nil
+}
+
+// fixedReading parses EA, the date and time YYYY MM DD hh mm ss and the cumulative energy.
+// It is nil when the meter has not recorded it yet.
+func fixedReading(edt string, unit float32) (*model.FixedReading, error) {
+	if len(edt) != 22 {
+		return nil, fmt.Errorf("length is invalid: %d", len(edt))
+	}
+	d := [6]int{}
+	for i, r := range [][2]int{{0, 4}, {4, 6}, {6, 8}, {8, 10}, {10, 12}, {12, 14}} {
+		v, err := strconv.ParseUint(edt[r[0]:r[1]], 16, 16)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = int(v)
+	}
+	v, ok, err := cumulativeValue(edt[14:], unit)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &model.FixedReading{
+		Time:          time.Date(d[0], time.Month(d[1]), d[2], d[3], d[4], d[5], 0, meterLocation),
+		CumulativeKWh: v,
+	}, nil
+}
+
+// the meter keeps the history of today and the 99 days before
+const maxHistoryDay = 99
+
+// historyDay is the day of t for E5, 0 is today of the meter and 1 is yesterday.
+func historyDay(t time.Time, now time.Time) int {
+	t, now = t.In(meterLocation), now.In(meterLocation)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, meterLocation)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, meterLocation)
+	return int(today.Sub(day).Hours() / 24)
+}
+
+// historyReadings parses E2, the day of the history and the 48 cumulative energies from 00:00 of the day.
+// The day is counted back from today of the meter.
+func historyReadings(edt string, unit float32, now time.Time) ([]model.FixedReading, error) {
+	if len(edt) != 4+48*8 {
+		return nil, fmt.Errorf("length is invalid: %d", len(edt))
+	}
+	day, err := strconv.ParseUint(edt[0:4], 16, 16)
+	if err != nil {
+		return nil, err
+	}
+	now = now.In(meterLocation)
+	date := time.Date(now.Year(), now.Month(), now.Day()-int(day), 0, 0, 0, 0, meterLocation)
+
+	readings := []model.FixedReading{}
+	for i := 0; i < 48; i++ {
+		t := date.Add(time.Duration(i) * 30 * time.Minute)
+		v, ok, err := cumulativeValue(edt[4+i*8:4+i*8+8], unit)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || t.After(now) {
+			continue
+		}
+		readings = append(readings, model.FixedReading{Time: t, CumulativeKWh: v})
+	}
+	return readings, nil
+}
+
+// asciiString decodes the hex encoded ascii, e.g. the serial number.
+func asciiString(edt string) string {
+	s := []byte{}
+	for i := 0; i+2 <= len(edt); i += 2 {
+		c, err := strconv.ParseUint(edt[i:i+2], 16, 8)
+		if err != nil || c == 0 {
+			continue
+		}
+		s = append(s, byte(c))
+	}
+	return strings.TrimSpace(string(s))
+}
@@ -0,0 +1,114 @@
+package dongle
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// response of E1, E0, D7, E7 and E8
+const readingFrame = "1081000102880105FF017205E10101E00400001234D70106E70400000258E804001E0014"
+
+func TestErxudpData(t *testing.T) {
+	for name, line := range map[string]string{
+		"BP35A1": "ERXUDP FE80:0000:0000:0000:0280:8700:3000:0001 FE80:0000:0000:0000:021D:1290:0003:8041 0E1A 0E1A 00808700300000001 1 0024 " + readingFrame,
+		"BP35C0": "ERXUDP FE80:0000:0000:0000:0280:8700:3000:0001 FE80:0000:0000:0000:021D:1290:0003:8041 0E1A 0E1A 00808700300000001 E4 1 01 0024 " + readingFrame + "\r\n",
+	} {
+		data, err := erxudpData(line)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		frame, err := parseEchonetFrame(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if frame.SEOJ != smartMeterEOJ || frame.ESV != "72" {
+			t.Errorf("%s: seoj %s, esv %s", name, frame.SEOJ, frame.ESV)
+		}
+		for epc, edt := range map[string]string{"E1": "01", "E0": "00001234", "D7": "06", "E7": "00000258", "E8": "001E0014"} {
+			if frame.Properties[epc] != edt {
+				t.Errorf("%s: %s is %s, not %s", name, epc, frame.Properties[epc], edt)
+			}
+		}
+	}
+
+	if _, err := erxudpData("ERXUDP FE80::1 FE80::2 0E1A 0E1A 00808700300000001 1 0024"); err == nil || errors.Is(err, errDataLength) {
+		t.Errorf("short line: %v", err)
+	}
+	if _, err := erxudpData("ERXUDP FE80::1 FE80::2 0E1A 0E1A 00808700300000001 1 0012 " + readingFrame); !errors.Is(err, errDataLength) {
+		t.Errorf("datalen mismatch: %v", err)
+	}
+}
+
+func TestFixedReading(t *testing.T) {
+	// 2026-10-18 12:30:00, 1234.5 kWh by 0.1 kWh
+	r, err := fixedReading("07EA0A120C1E0000003039", 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Time.Equal(time.Date(2026, 10, 18, 12, 30, 0, 0, meterLocation)) || r.CumulativeKWh != 1234.5 {
+		t.Errorf("reading %+v", r)
+	}
+	if r, err := fixedReading("07EA0A120C1E00FFFFFFFE", 0.1); r != nil || err != nil {
+		t.Errorf("not recorded value is %+v, %v", r, err)
+	}
+	if _, err := fixedReading("07EA0A120C1E00", 0.1); err == nil {
+		t.Error("short edt is parsed")
+	}
+}
+
+func TestHistoryReadings(t *testing.T) {
+	now := time.Date(2026, 10, 18, 1, 10, 0, 0, meterLocation)
+	if day := historyDay(time.Date(2026, 10, 17, 23, 30, 0, 0, meterLocation), now); day != 1 {
+		t.Errorf("day is %d", day)
+	}
+	// UTC is still the day before
+	if day := historyDay(now.UTC(), now); day != 0 {
+		t.Errorf("day is %d", day)
+	}
+
+	values := []string{"00000064", "00000065", "00000067"}
+	for i := len(values); i < 48; i++ {
+		values = append(values, noValue)
+	}
+	readings, err := historyReadings("0000"+strings.Join(values, ""), 0.01, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 3 {
+		t.Fatalf("%d readings", len(readings))
+	}
+	for i, v := range []float32{1, 1.01, 1.03} {
+		if r := readings[i]; !r.Time.Equal(time.Date(2026, 10, 18, 0, 30*i, 0, 0, meterLocation)) || r.CumulativeKWh != v {
+			t.Errorf("reading %d is %+v", i, r)
+		}
+	}
+	if _, err := historyReadings("0000", 0.01, now); err == nil {
+		t.Error("short edt is parsed")
+	}
+}
+
+func TestPhaseCurrent(t *testing.T) {
+	for edt, want := range map[string]struct {
+		current  int
+		measured bool
+	}{
+		"00C8": {200, true},
+		"FFF6": {-10, true},
+		"7FFE": {0, false},
+		"7FFF": {0, false},
+		"8000": {0, false},
+	} {
+		current, measured, err := phaseCurrent(edt)
+		if err != nil {
+			t.Fatalf("%s: %v", edt, err)
+		}
+		if current != want.current || measured != want.measured {
+			t.Errorf("%s is %d, %v", edt, current, measured)
+		}
+	}
+	if _, _, err := phaseCurrent("7FFE00"); err == nil {
+		t.Error("long edt is parsed")
+	}
+}
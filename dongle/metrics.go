@@ -0,0 +1,207 @@
+package dongle
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is the health of the dongle and the radio link, a prometheus.Collector.
+// The methods are nil safe, so that a Dongle without metrics (e.g. the probe) records nothing.
+type Metrics struct {
+	scans           *prometheus.CounterVec
+	scanDuration    prometheus.Histogram
+	joins           *prometheus.CounterVec
+	panaReauth      prometheus.Counter
+	sendtoLatency   prometheus.Histogram
+	timeouts        *prometheus.CounterVec
+	malformedFrames *prometheus.CounterVec
+	lqi             *prometheus.GaugeVec
+	rssi            *prometheus.GaugeVec
+	info            *prometheus.GaugeVec
+	serialErrors    *prometheus.CounterVec
+}
+
+func NewMetrics(namespace string) *Metrics {
+	const subsystem = "dongle"
+	return &Metrics{
+		scans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "scan_attempts_total",
+			Help: "SKSCAN attempts by result",
+		}, []string{"result"}),
+		scanDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name:    "scan_duration_seconds",
+			Help:    "Duration of SKSCAN",
+			Buckets: []float64{5, 10, 20, 30, 45, 60, 90, 120, 180},
+		}),
+		joins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "joins_total",
+			Help: "SKJOIN (PANA authentication) by result",
+		}, []string{"result"}),
+		panaReauth: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "pana_reauth_total",
+			Help: "PANA re-authentications on the session lifetime expiry (EVENT 29)",
+		}),
+		sendtoLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name:    "sendto_latency_seconds",
+			Help:    "Latency from SKSENDTO to the ERXUDP response",
+			Buckets: []float64{0.1, 0.25, 0.5, 1, 1.5, 2, 3, 5, 10},
+		}),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "timeouts_total",
+			Help: "Timeouts by command",
+		}, []string{"command"}),
+		malformedFrames: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "malformed_frames_total",
+			Help: "Malformed responses by reason",
+		}, []string{"reason"}),
+		// without labels, so that nothing is reported before the first scan
+		lqi: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "lqi",
+			Help: "LQI of the meter from EPANDESC",
+		}, []string{}),
+		rssi: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "rssi_dbm",
+			Help: "RSSI of the meter [dBm], from ERXUDP when the dongle reports it, or estimated from the LQI",
+		}, []string{}),
+		info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "info",
+			Help: "Firmware version of the dongle from SKVER",
+		}, []string{"version"}),
+		serialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: subsystem,
+			Name: "serial_errors_total",
+			Help: "Serial port I/O errors by operation",
+		}, []string{"op"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.scans, m.scanDuration, m.joins, m.panaReauth, m.sendtoLatency,
+		m.timeouts, m.malformedFrames, m.lqi, m.rssi, m.info, m.serialErrors}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func (m *Metrics) scan(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.scans.WithLabelValues(result(err)).Inc()
+	m.scanDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) join(err error) {
+	if m == nil {
+		return
+	}
+	m.joins.WithLabelValues(result(err)).Inc()
+}
+
+func (m *Metrics) sendto(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.sendtoLatency.Observe(time.Since(start).Seconds())
+}
+
+func (m *Metrics) timeout(command string) {
+	if m == nil {
+		return
+	}
+	m.timeouts.WithLabelValues(command).Inc()
+}
+
+func (m *Metrics) malformed(reason string) {
+	if m == nil {
+		return
+	}
+	m.malformedFrames.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) serialError(op string) {
+	if m == nil {
+		return
+	}
+	m.serialErrors.WithLabelValues(op).Inc()
+}
+
+func (m *Metrics) version(v string) {
+	if m == nil {
+		return
+	}
+	m.info.Reset()
+	m.info.WithLabelValues(v).Set(1)
+}
+
+// pan records the LQI of EPANDESC (hex), the RSSI is estimated with the formula of BP35A1.
+func (m *Metrics) pan(lqi string) {
+	if m == nil {
+		return
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(lqi), 16, 8)
+	if err != nil {
+		m.malformed("epandesc")
+		return
+	}
+	m.lqi.WithLabelValues().Set(float64(v))
+	m.rssi.WithLabelValues().Set(0.275*float64(v) - 104.27)
+}
+
+// event records the asynchronous events seen in the responses.
+func (m *Metrics) event(line string) {
+	if m == nil {
+		return
+	}
+	// EVENT 29 = the session lifetime expired, the dongle re-authenticates
+	if strings.HasPrefix(line, "EVENT 29 ") {
+		m.panaReauth.Inc()
+	}
+}
+
+// erxudp records the RSSI when the dongle reports it in ERXUDP,
+// e.g. BP35C0: ERXUDP SENDER DEST RPORT LPORT SENDERLLA RSSI SECURED SIDE DATALEN DATA
+func (m *Metrics) erxudp(line string) {
+	if m == nil {
+		return
+	}
+	a := strings.Split(line, " ")
+	if len(a) != 11 {
+		return
+	}
+	// two's complement, 1 or 2 bytes
+	if v, err := strconv.ParseUint(a[6], 16, 16); err == nil {
+		m.rssi.WithLabelValues().Set(float64(int8(v)))
+	}
+}
@@ -0,0 +1,25 @@
+package dongle
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const tracerName = "github.com/michibiki-io/hems-metrics-go/dongle"
+
+// command starts the span of a dongle command, the returned func ends it with the result.
+// The spans are exported only when a tracer provider is set, e.g. by the otlp sink.
+func command(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name)
+	span.SetAttributes(attrs...)
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
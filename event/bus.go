@@ -0,0 +1,273 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+// Event is a reading or a connection status change, one of them is set.
+type Event struct {
+	Reading *model.HemsData
+	Status  *model.ConnectionStatus
+}
+
+type Handler func(e Event) error
+
+type DropPolicy int
+
+const (
+	// DropOldest drops the oldest queued event to make room for the new one
+	DropOldest DropPolicy = iota
+	// DropNewest drops the new event when the queue is full
+	DropNewest
+	// KeepBoundaries drops the new event when the queue is full, except a reading which ends a unit time.
+	// It is kept in order in an overflow list, for the subscribers which account the unit times.
+	KeepBoundaries
+)
+
+type Options struct {
+	QueueSize  int
+	DropPolicy DropPolicy
+}
+
+var DefaultOptions = Options{
+	QueueSize:  64,
+	DropPolicy: DropOldest,
+}
+
+// AccountingOptions are for the storage, the rollups and the tariff, which lose a unit time by a drop.
+var AccountingOptions = Options{
+	QueueSize:  1024,
+	DropPolicy: KeepBoundaries,
+}
+
+type Stats struct {
+	Delivered uint64
+	Dropped   uint64
+	Failed    uint64
+}
+
+// Subscription delivers the events to its handler on its own goroutine, so that a slow or
+// failing subscriber never stalls the polling nor the other subscribers.
+type Subscription struct {
+	name    string
+	logger  *zap.Logger
+	options Options
+	handler Handler
+	queue   chan Event
+	done    chan struct{}
+
+	mutex sync.Mutex
+	stats Stats
+	// overflow is newer than the queue, see KeepBoundaries
+	overflow []Event
+	dropping bool
+}
+
+func (s *Subscription) Name() string {
+	return s.name
+}
+
+func (s *Subscription) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+func (s *Subscription) push(e Event) {
+	if s.options.DropPolicy == KeepBoundaries {
+		s.keepBoundary(e)
+		return
+	}
+	for {
+		select {
+		case s.queue <- e:
+			return
+		default:
+		}
+
+		if s.options.DropPolicy == DropNewest {
+			s.drop()
+			return
+		}
+		select {
+		case <-s.queue:
+			s.drop()
+		default:
+		}
+	}
+}
+
+func (s *Subscription) keepBoundary(e Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// the queue is used only when nothing overflows, so that the order is kept
+	if len(s.overflow) == 0 {
+		select {
+		case s.queue <- e:
+			return
+		default:
+		}
+	}
+	if e.Reading != nil && len(e.Reading.Slots) > 0 {
+		if len(s.overflow) == 0 {
+			s.logger.Warn(fmt.Sprintf("queue of %s is full, the unit times are kept until it is drained", s.name))
+		}
+		s.overflow = append(s.overflow, e)
+		return
+	}
+	s.dropLocked()
+}
+
+func (s *Subscription) drop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropLocked()
+}
+
+// dropLocked counts a dropped event, and warns when the subscriber starts dropping.
+func (s *Subscription) dropLocked() {
+	s.stats.Dropped++
+	if !s.dropping {
+		s.dropping = true
+		s.logger.Warn(fmt.Sprintf("queue of %s is full, the events are dropped", s.name))
+	}
+}
+
+func (s *Subscription) count(f func(st *Stats)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(&s.stats)
+}
+
+func (s *Subscription) run() {
+	defer close(s.done)
+	for e := range s.queue {
+		s.handle(e)
+		if len(s.queue) == 0 {
+			s.drainOverflow()
+		}
+	}
+	s.drainOverflow()
+}
+
+// drainOverflow delivers the kept events once the queue is empty, the new events go to the queue meanwhile.
+func (s *Subscription) drainOverflow() {
+	s.mutex.Lock()
+	overflow := s.overflow
+	s.overflow = nil
+	s.dropping = false
+	s.mutex.Unlock()
+
+	for _, e := range overflow {
+		s.handle(e)
+	}
+}
+
+func (s *Subscription) handle(e Event) {
+	if err := s.deliver(e); err != nil {
+		s.count(func(st *Stats) { st.Failed++ })
+		s.logger.Warn("subscriber is failed", zap.String("subscriber", s.name), zap.Error(err))
+	} else {
+		s.count(func(st *Stats) { st.Delivered++ })
+	}
+}
+
+func (s *Subscription) deliver(e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.handler(e)
+}
+
+// Bus fans out the events to the subscribers.
+type Bus struct {
+	logger *zap.Logger
+
+	mutex         sync.RWMutex
+	subscriptions []*Subscription
+	closed        bool
+}
+
+func NewBus(l *zap.Logger) *Bus {
+	return &Bus{logger: l}
+}
+
+func (b *Bus) Subscribe(name string, options Options, handler Handler) *Subscription {
+	if options.QueueSize < 1 {
+		options.QueueSize = DefaultOptions.QueueSize
+	}
+
+	s := &Subscription{
+		name:    name,
+		logger:  b.logger,
+		options: options,
+		handler: handler,
+		queue:   make(chan Event, options.QueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscriptions = append(b.subscriptions, s)
+
+	return s
+}
+
+// SubscribeReading subscribes the readings only.
+func (b *Bus) SubscribeReading(name string, options Options, handler func(data *model.HemsData) error) *Subscription {
+	return b.Subscribe(name, options, func(e Event) error {
+		if e.Reading == nil {
+			return nil
+		}
+		return handler(e.Reading)
+	})
+}
+
+// Publish never blocks.
+func (b *Bus) Publish(e Event) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		return
+	}
+	for _, s := range b.subscriptions {
+		s.push(e)
+	}
+}
+
+func (b *Bus) Subscriptions() []*Subscription {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return append([]*Subscription{}, b.subscriptions...)
+}
+
+// Close stops the publishing and waits until the subscribers drain their queues or ctx is done.
+func (b *Bus) Close(ctx context.Context) error {
+	b.mutex.Lock()
+	if !b.closed {
+		b.closed = true
+		for _, s := range b.subscriptions {
+			close(s.queue)
+		}
+	}
+	subscriptions := append([]*Subscription{}, b.subscriptions...)
+	b.mutex.Unlock()
+
+	for _, s := range subscriptions {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return fmt.Errorf("subscriber %s is not drained: %w", s.name, ctx.Err())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package event
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+func TestKeepBoundaries(t *testing.T) {
+	b := NewBus(zap.NewNop())
+
+	blocked := make(chan struct{})
+	received := []*model.HemsData{}
+	b.SubscribeReading("storage", Options{QueueSize: 4, DropPolicy: KeepBoundaries}, func(data *model.HemsData) error {
+		<-blocked
+		received = append(received, data)
+		return nil
+	})
+
+	// a stalled subscriber, every 10th reading ends a unit time
+	start := time.Now()
+	boundaries := 0
+	for i := 0; i < 100; i++ {
+		data := &model.HemsData{DateTime: start.Add(time.Duration(i) * time.Second)}
+		if i%10 == 9 {
+			data.Slots = []model.Slot{{End: data.DateTime}}
+			boundaries++
+		}
+		b.Publish(Event{Reading: data})
+	}
+	close(blocked)
+	if err := b.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := 0
+	for i, data := range received {
+		if i > 0 && !data.DateTime.After(received[i-1].DateTime) {
+			t.Errorf("reading at %d is out of order", i)
+		}
+		if len(data.Slots) > 0 {
+			kept++
+		}
+	}
+	if kept != boundaries {
+		t.Errorf("%d of %d unit times are delivered", kept, boundaries)
+	}
+	stats := b.Subscriptions()[0].Stats()
+	if stats.Dropped == 0 || int(stats.Delivered+stats.Dropped) != 100 {
+		t.Errorf("stats %+v", stats)
+	}
+}
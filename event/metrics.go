@@ -0,0 +1,53 @@
+package event
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exposes the stats of the subscribers, it is a prometheus.Collector.
+type Metrics struct {
+	bus *Bus
+
+	events   *prometheus.Desc
+	queued   *prometheus.Desc
+	overflow *prometheus.Desc
+}
+
+func NewMetrics(b *Bus, namespace string) *Metrics {
+	name := func(name string) string {
+		return prometheus.BuildFQName(namespace, "subscriber", name)
+	}
+	return &Metrics{
+		bus: b,
+		events: prometheus.NewDesc(name("events_total"),
+			"Events by subscriber and result, delivered, failed or dropped by the full queue", []string{"subscriber", "result"}, nil),
+		queued: prometheus.NewDesc(name("queue_length"),
+			"Events waiting in the queue by subscriber", []string{"subscriber"}, nil),
+		overflow: prometheus.NewDesc(name("overflow_length"),
+			"Unit times kept out of the full queue by subscriber", []string{"subscriber"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.events
+	ch <- m.queued
+	ch <- m.overflow
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range m.bus.Subscriptions() {
+		s.mutex.Lock()
+		stats, overflow := s.stats, len(s.overflow)
+		s.mutex.Unlock()
+
+		ch <- prometheus.MustNewConstMetric(m.events, prometheus.CounterValue, float64(stats.Delivered), s.name, "delivered")
+		ch <- prometheus.MustNewConstMetric(m.events, prometheus.CounterValue, float64(stats.Failed), s.name, "failed")
+		ch <- prometheus.MustNewConstMetric(m.events, prometheus.CounterValue, float64(stats.Dropped), s.name, "dropped")
+		ch <- prometheus.MustNewConstMetric(m.queued, prometheus.GaugeValue, float64(len(s.queue)), s.name)
+		if s.options.DropPolicy == KeepBoundaries {
+			ch <- prometheus.MustNewConstMetric(m.overflow, prometheus.GaugeValue, float64(overflow), s.name)
+		}
+	}
+}
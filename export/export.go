@@ -0,0 +1,288 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/rollup"
+	"github.com/michibiki-io/hems-metrics-go/storage"
+	"github.com/michibiki-io/hems-metrics-go/tariff"
+)
+
+// Resolution is the rows of an export, the readings of the store or the aggregates of the slots.
+type Resolution string
+
+const (
+	Raw    Resolution = "raw"
+	Minute Resolution = "1m"
+	Slot   Resolution = "30m"
+	Day    Resolution = "daily"
+	Month  Resolution = "monthly"
+	// Billing is from the meter reading day to the one of the next month
+	Billing Resolution = "billing"
+)
+
+var Resolutions = []Resolution{Raw, Minute, Slot, Day, Month, Billing}
+
+func ParseResolution(s string) (Resolution, error) {
+	for _, r := range Resolutions {
+		if string(r) == s {
+			return r, nil
+		}
+	}
+	return "", fmt.Errorf("resolution must be raw, 1m, 30m, daily, monthly or billing: %s", s)
+}
+
+// ParseTime parses RFC3339, or a date (2006-01-02) in loc.
+func ParseTime(v string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, loc); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("time must be RFC3339 or 2006-01-02: %s", v)
+}
+
+// DefaultSpan is the range when from is omitted.
+func (r Resolution) DefaultSpan() time.Duration {
+	switch r {
+	case Day:
+		return 31 * 24 * time.Hour
+	case Month, Billing:
+		return 366 * 24 * time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+type kind int
+
+const (
+	timeKind kind = iota
+	floatKind
+	intKind
+)
+
+// Column of a table, a value of a row is time.Time, float64, int64 or nil.
+type Column struct {
+	Name string
+	kind kind
+}
+
+type Table struct {
+	Columns []Column
+	Rows    [][]any
+}
+
+// Exporter reads the history from the store and writes it as a file.
+type Exporter struct {
+	store    *storage.Store
+	calendar rollup.Calendar
+	location *time.Location
+	// tariff prices the slots, nil without the cost
+	tariff *tariff.Engine
+}
+
+// NewExporter creates an exporter, the times are in the timezone of the calendar.
+// The slots are priced by the tariff when it is not nil and enabled.
+func NewExporter(store *storage.Store, calendar rollup.Calendar, engine *tariff.Engine) *Exporter {
+	return &Exporter{
+		store:    store,
+		calendar: calendar,
+		location: calendar.Location,
+		tariff:   engine,
+	}
+}
+
+// Export writes the rows in [from, to) in the format.
+func (e *Exporter) Export(w io.Writer, f Format, r Resolution, from, to time.Time) error {
+	t, err := e.Table(r, from, to)
+	if err != nil {
+		return err
+	}
+	switch f {
+	case CSV:
+		return writeCSV(w, t, e.location)
+	case JSONLines:
+		return writeJSONLines(w, t, e.location)
+	case Parquet:
+		return writeParquet(w, t, e.location)
+	}
+	return fmt.Errorf("format is not supported: %s", f)
+}
+
+// Table returns the rows in [from, to). The daily, monthly and billing ones are extended to the whole periods.
+func (e *Exporter) Table(r Resolution, from, to time.Time) (*Table, error) {
+	switch r {
+	case Raw:
+		return e.readings(storage.Raw, from, to)
+	case Minute:
+		return e.readings(storage.Minute, from, to)
+	case Slot:
+		records, costs, err := e.slots(from, to)
+		if err != nil {
+			return nil, err
+		}
+		t := &Table{Columns: slotColumns(costs != nil)}
+		for i, record := range records {
+			row := []any{
+				record.Time, record.End, rollup.Value(record.Energy), rollup.Value(record.ExportedEnergy), rollup.Value(record.CumulativeEnergy), int64(1),
+			}
+			if costs != nil {
+				row = append(row, rollup.Round(costs[i]))
+			}
+			t.Rows = append(t.Rows, row)
+		}
+		return t, nil
+	case Day, Month, Billing:
+		if !from.IsZero() {
+			from = e.periodStart(r, from)
+		}
+		if !to.IsZero() {
+			to = e.periodEnd(r, e.periodStart(r, to.Add(-time.Nanosecond)))
+		}
+		records, costs, err := e.slots(from, to)
+		if err != nil {
+			return nil, err
+		}
+		return e.aggregate(r, records, costs), nil
+	}
+	return nil, fmt.Errorf("resolution is not supported: %s", r)
+}
+
+var readingColumns = []Column{
+	{"time", timeKind},
+	{"cumulative_energy_kwh", floatKind},
+	{"cumulative_exported_energy_kwh", floatKind},
+	{"power_w", floatKind},
+	{"power_min_w", floatKind},
+	{"power_max_w", floatKind},
+	{"current_a", floatKind},
+	{"r_phase_current_a", floatKind},
+	{"t_phase_current_a", floatKind},
+	{"power_factor_percent", floatKind},
+	{"count", intKind},
+}
+
+// slotColumns are the 30 minutes slots and their aggregates, count is the number of the slots.
+// cost is added when the slots are priced.
+func slotColumns(cost bool) []Column {
+	columns := []Column{
+		{"start", timeKind},
+		{"end", timeKind},
+		{"imported_energy_kwh", floatKind},
+		{"exported_energy_kwh", floatKind},
+		{"cumulative_energy_kwh", floatKind},
+		{"count", intKind},
+	}
+	if cost {
+		columns = append(columns, Column{"cost", floatKind})
+	}
+	return columns
+}
+
+// slots returns the slots in [from, to), and the costs of them when the tariff is enabled.
+func (e *Exporter) slots(from, to time.Time) ([]storage.Record, []float64, error) {
+	if e.tariff == nil || !e.tariff.Enabled() {
+		records, err := e.store.Query(storage.Slot, from, to)
+		return records, nil, err
+	}
+
+	// the tiers are counted from the start of the billing period
+	start := from
+	if !start.IsZero() {
+		start = e.calendar.Start(rollup.Billing, from)
+	}
+	records, err := e.store.Query(storage.Slot, start, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	slots := make([]tariff.Slot, len(records))
+	for i, record := range records {
+		slots[i] = tariff.Slot{Start: record.Time, End: record.End, ImportedKWh: rollup.Value(record.Energy), ExportedKWh: rollup.Value(record.ExportedEnergy)}
+	}
+	costs := e.tariff.Costs(slots)
+	if costs == nil {
+		return records, nil, nil
+	}
+
+	result, totals := []storage.Record{}, []float64{}
+	for i, record := range records {
+		if record.Time.Before(from) {
+			continue
+		}
+		result = append(result, record)
+		totals = append(totals, costs[i].Total())
+	}
+	return result, totals, nil
+}
+
+func (e *Exporter) readings(r storage.Resolution, from, to time.Time) (*Table, error) {
+	records, err := e.store.Query(r, from, to)
+	if err != nil {
+		return nil, err
+	}
+	t := &Table{Columns: readingColumns}
+	for _, record := range records {
+		t.Rows = append(t.Rows, []any{
+			record.Time,
+			rollup.Value(record.CumulativeEnergy),
+			rollup.Value(record.ExportedEnergy),
+			rollup.Value(record.Power),
+			rollup.Value(record.PowerMin),
+			rollup.Value(record.PowerMax),
+			rollup.Value(record.Current),
+			rollup.Value(record.RPhaseCurrent),
+			rollup.Value(record.TPhaseCurrent),
+			rollup.Value(record.PowerFactor),
+			int64(record.Count),
+		})
+	}
+	return t, nil
+}
+
+// aggregate sums the slots and the costs by the period of their start.
+func (e *Exporter) aggregate(r Resolution, records []storage.Record, costs []float64) *Table {
+	t := &Table{Columns: slotColumns(costs != nil)}
+	var row []any
+	for i, record := range records {
+		start := e.periodStart(r, record.Time)
+		if row == nil || !row[0].(time.Time).Equal(start) {
+			row = []any{start, e.periodEnd(r, start), 0.0, 0.0, 0.0, int64(0)}
+			if costs != nil {
+				row = append(row, 0.0)
+			}
+			t.Rows = append(t.Rows, row)
+		}
+		row[2] = rollup.Round(row[2].(float64) + rollup.Value(record.Energy))
+		row[3] = rollup.Round(row[3].(float64) + rollup.Value(record.ExportedEnergy))
+		row[4] = rollup.Value(record.CumulativeEnergy)
+		row[5] = row[5].(int64) + 1
+		if costs != nil {
+			row[6] = rollup.Round(row[6].(float64) + costs[i])
+		}
+	}
+	return t
+}
+
+// period is the rollup of the daily, monthly and billing resolutions
+func (r Resolution) period() rollup.Period {
+	switch r {
+	case Month:
+		return rollup.Month
+	case Billing:
+		return rollup.Billing
+	default:
+		return rollup.Day
+	}
+}
+
+func (e *Exporter) periodStart(r Resolution, t time.Time) time.Time {
+	return e.calendar.Start(r.period(), t)
+}
+
+func (e *Exporter) periodEnd(r Resolution, start time.Time) time.Time {
+	return e.calendar.End(r.period(), start)
+}
@@ -0,0 +1,162 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+type Format string
+
+const (
+	CSV       Format = "csv"
+	JSONLines Format = "jsonl"
+	Parquet   Format = "parquet"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case CSV, JSONLines, Parquet:
+		return Format(s), nil
+	}
+	return "", fmt.Errorf("format must be csv, jsonl or parquet: %s", s)
+}
+
+func (f Format) ContentType() string {
+	switch f {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case JSONLines:
+		return "application/x-ndjson"
+	default:
+		return "application/vnd.apache.parquet"
+	}
+}
+
+// Filename is the name of the file of the export, e.g. hems-30m-20261001-20261101.csv
+func (f Format) Filename(r Resolution, from, to time.Time, loc *time.Location) string {
+	return fmt.Sprintf("hems-%s-%s-%s.%s", r, from.In(loc).Format("20060102"), to.In(loc).Format("20060102"), f)
+}
+
+// formatValue is the text of a value, empty for nil
+func formatValue(v any, loc *time.Location) string {
+	switch v := v.(type) {
+	case time.Time:
+		return v.In(loc).Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return ""
+}
+
+func writeCSV(w io.Writer, t *Table, loc *time.Location) error {
+	cw := csv.NewWriter(w)
+	header := []string{}
+	for _, c := range t.Columns {
+		header = append(header, c.Name)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	record := make([]string, len(t.Columns))
+	for _, row := range t.Rows {
+		for i, v := range row {
+			record[i] = formatValue(v, loc)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSONLines writes a JSON object per row, the keys are in the order of the columns.
+func writeJSONLines(w io.Writer, t *Table, loc *time.Location) error {
+	bw := bufio.NewWriter(w)
+	for _, row := range t.Rows {
+		bw.WriteString("{")
+		for i, v := range row {
+			if i > 0 {
+				bw.WriteString(",")
+			}
+			name, _ := json.Marshal(t.Columns[i].Name)
+			bw.Write(name)
+			bw.WriteString(":")
+			bw.Write(jsonValue(v, loc))
+		}
+		if _, err := bw.WriteString("}\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func jsonValue(v any, loc *time.Location) []byte {
+	if v == nil {
+		return []byte("null")
+	}
+	if t, ok := v.(time.Time); ok {
+		v = t.In(loc).Format(time.RFC3339)
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// writeParquet writes the times as local timestamps (not adjusted to UTC) in loc,
+// the name of the timezone is in the key value metadata.
+func writeParquet(w io.Writer, t *Table, loc *time.Location) error {
+	fields := []string{}
+	for _, c := range t.Columns {
+		tag := ""
+		switch c.kind {
+		case timeKind:
+			tag = "type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=false, logicaltype.unit=MILLIS"
+		case floatKind:
+			tag = "type=DOUBLE"
+		default:
+			tag = "type=INT64"
+		}
+		fields = append(fields, fmt.Sprintf(`{"Tag":"name=%s, %s, repetitiontype=OPTIONAL"}`, c.Name, tag))
+	}
+	schema := fmt.Sprintf(`{"Tag":"name=hems, repetitiontype=REQUIRED","Fields":[%s]}`, strings.Join(fields, ","))
+
+	pw, err := writer.NewJSONWriterFromWriter(schema, w, 1)
+	if err != nil {
+		return fmt.Errorf("create parquet writer is failed: %w", err)
+	}
+	for _, row := range t.Rows {
+		values := map[string]any{}
+		for i, v := range row {
+			if tm, ok := v.(time.Time); ok {
+				// the wall clock of loc
+				tm = tm.In(loc)
+				v = time.Date(tm.Year(), tm.Month(), tm.Day(), tm.Hour(), tm.Minute(), tm.Second(), tm.Nanosecond(), time.UTC).UnixMilli()
+			}
+			values[t.Columns[i].Name] = v
+		}
+		b, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		if err := pw.Write(string(b)); err != nil {
+			return fmt.Errorf("write parquet is failed: %w", err)
+		}
+	}
+	if err := pw.Flush(true); err != nil {
+		return err
+	}
+	timezone := loc.String()
+	pw.Footer.KeyValueMetadata = append(pw.Footer.KeyValueMetadata, &parquet.KeyValue{Key: "timezone", Value: &timezone})
+	return pw.WriteStop()
+}
@@ -2,64 +2,254 @@ package main
 
 import (
 	"context"
-	"strings"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	_ "time/tzdata"
 
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 
 	"github.com/gin-gonic/gin"
+	"github.com/michibiki-io/hems-metrics-go/alert"
+	"github.com/michibiki-io/hems-metrics-go/config"
 	"github.com/michibiki-io/hems-metrics-go/controller"
-
-	"github.com/michibiki-io/goutils"
+	"github.com/michibiki-io/hems-metrics-go/dongle"
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/export"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"github.com/michibiki-io/hems-metrics-go/rollup"
+	"github.com/michibiki-io/hems-metrics-go/sink"
+	"github.com/michibiki-io/hems-metrics-go/storage"
+	"github.com/michibiki-io/hems-metrics-go/tariff"
+	"github.com/michibiki-io/hems-metrics-go/utility/logging"
+	"github.com/michibiki-io/hems-metrics-go/utility/redact"
 )
 
 func main() {
 
-	var logger *zap.Logger = nil
-
-	if strings.ToLower(goutils.GetEnv("MODE", "release")) == "debug" {
-		logger, _ = zap.NewDevelopment()
-	} else {
-		logCfg := zap.NewProductionConfig()
-		logCfg.EncoderConfig.EncodeTime = func(t time.Time, pae zapcore.PrimitiveArrayEncoder) {
-			const layout = "2006-01-02 15:04:05 JST"
-			jst := time.FixedZone("Asia/Tokyo", 9*60*60)
-			pae.AppendString(t.In(jst).Format(layout))
+	// sub command
+	args := os.Args[1:]
+	command := ""
+	if len(args) >= 2 && args[0] == "config" && args[1] == "check" {
+		command = "config check"
+		args = args[2:]
+	}
+	if len(args) >= 1 && args[0] == "export" {
+		// export the history of the storage, e.g. export -resolution daily -from 2026-01-01 -o 2026.csv
+		if err := exportCommand(args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		logger, _ = logCfg.Build()
+		return
+	}
+	if len(args) >= 2 && args[0] == "credentials" && args[1] == "encrypt" {
+		// encrypt B_ROUTE_ID / B_ROUTE_PASSWORD for meter.credentials_file
+		fs := flag.NewFlagSet("credentials encrypt", flag.ExitOnError)
+		keyFile := fs.String("key-file", os.Getenv("CREDENTIALS_KEY_FILE"), "path to the key file")
+		fs.Parse(args[2:])
+		if err := config.EncryptCredentials(os.Stdout, *keyFile,
+			os.Getenv("B_ROUTE_ID"), os.Getenv("B_ROUTE_PASSWORD")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := config.Load(os.Args[0], args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if command == "config check" {
+		// effective config, secrets are redacted
+		fmt.Println(cfg.String())
+		return
+	}
+
+	// the credentials never appear in the log, including the dongle traces
+	redactor := redact.NewRedactor()
+	redactor.SetSecrets(secrets(cfg)...)
+
+	logger, logLevel, err := logging.NewLogger(cfg.Log, cfg.Location(), zap.WrapCore(redactor.Core))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
 	defer logger.Sync()
 
-	// Bルート認証パスワード
-	rbpwd := goutils.GetEnv("B_ROUTE_PASSWORD", "0123456789AB")
+	logger.Info("config", zap.Stringer("config", cfg))
 
-	// Bルート認証ID
-	rbid := goutils.GetEnv("B_ROUTE_ID", "0123456789ABCDEF0123456789ABCDEF")
+	// metrics server
+	metricsController := controller.CreateMetricsController(logger, cfg.Metrics)
+	dongleMetrics := dongle.NewMetrics(cfg.Metrics.Namespace)
+	metricsController.Registry().MustRegister(dongleMetrics)
 
 	// controller
-	hemsDataController := controller.CreateHemsDataController(logger)
+	hemsDataController := controller.CreateHemsDataController(logger, cfg, dongleMetrics)
+	bus := hemsDataController.Bus()
+	metricsController.Registry().MustRegister(event.NewMetrics(bus, cfg.Metrics.Namespace))
 
-	// metrics server
-	metricsController := controller.CreateMetricsController(logger)
+	// the state of the last run, the values resume until the first live reading
+	restored, err := hemsDataController.RestoreState()
+	if err != nil {
+		logger.Warn("state is not restored", zap.Error(err))
+	}
+	if restored != nil {
+		metricsController.Restore(restored)
+	}
 
-	// set handler
-	hemsDataController.RegistHandler(metricsController.Update)
+	// on-disk store of the readings
+	var store *storage.Store
+	if cfg.Storage.Enabled {
+		if store, err = storage.Open(logger, cfg.Storage); err != nil {
+			logger.Error("storage is not opened", zap.Error(err))
+			os.Exit(1)
+		}
+		bus.SubscribeReading("storage", event.AccountingOptions, store.Append)
+	}
+
+	// energy per day, month and billing period, from the unit times
+	rollups := rollup.NewRollups(calendar(cfg), cfg.Metrics.Namespace)
+	metricsController.Registry().MustRegister(rollups)
+
+	// cost of every unit time, and the bill of the billing period
+	tariffEngine, err := tariff.NewEngine(logger, cfg.Tariff, calendar(cfg), cfg.Metrics.Namespace)
+	if err != nil {
+		logger.Error("tariff is not created", zap.Error(err))
+		os.Exit(1)
+	}
+	metricsController.Registry().MustRegister(tariffEngine)
 
-	// context
-	ctx := context.Background()
+	if store != nil {
+		// the periods of the history
+		if records, err := store.Query(storage.Slot, time.Now().AddDate(-2, -1, 0), time.Time{}); err != nil {
+			logger.Warn("unit times are not loaded from the storage", zap.Error(err))
+		} else {
+			for _, record := range records {
+				rollups.AddSlot(record.Time, record.End, record.Energy)
+				tariffEngine.AddSlot(tariff.Slot{Start: record.Time, End: record.End, ImportedKWh: rollup.Value(record.Energy), ExportedKWh: rollup.Value(record.ExportedEnergy)})
+			}
+		}
+	}
+	bus.SubscribeReading("rollups", event.AccountingOptions, rollups.Update)
+	bus.SubscribeReading("tariff", event.AccountingOptions, tariffEngine.Update)
+
+	// rest api
+	apiController := controller.CreateApiController(logger, cfg, hemsDataController, rollups, tariffEngine, store)
+	if restored != nil {
+		apiController.Update(restored)
+	}
+	streamController := controller.CreateStreamController(logger, cfg.API, apiController)
+
+	// sinks, each one has its own queue
+	bus.SubscribeReading("prometheus", event.DefaultOptions, func(data *model.HemsData) error {
+		metricsController.Update(data)
+		return nil
+	})
+	bus.SubscribeReading("api", event.DefaultOptions, func(data *model.HemsData) error {
+		apiController.Update(data)
+		return nil
+	})
+	bus.Subscribe("stream", event.DefaultOptions, func(e event.Event) error {
+		if e.Reading != nil {
+			streamController.Update(e.Reading)
+		}
+		if e.Status != nil {
+			streamController.UpdateStatus(*e.Status)
+		}
+		return nil
+	})
+
+	// mqtt
+	mqttSink := sink.NewMQTTSink(logger, cfg.Sinks.MQTT)
+	homeAssistant := sink.NewHomeAssistant(logger, mqttSink)
+	if err := mqttSink.Start(); err != nil {
+		logger.Error("mqtt is not started", zap.Error(err))
+	}
+	bus.Subscribe("mqtt", event.DefaultOptions, mqttSink.Handle)
+	bus.Subscribe("home_assistant", event.DefaultOptions, homeAssistant.Handle)
+
+	// contract breaker warnings, the phase currents of every reading
+	breaker := alert.NewBreaker(logger, cfg.Breaker, cfg.Metrics.StaleAfter.Duration(), mqttSink, cfg.Metrics.Namespace)
+	metricsController.Registry().MustRegister(breaker)
+	bus.SubscribeReading("breaker", event.DefaultOptions, breaker.Update)
+
+	// influxdb
+	influxDBSink := sink.NewInfluxDBSink(logger, cfg.Sinks.InfluxDB, cfg.Metrics.Namespace)
+	metricsController.Registry().MustRegister(influxDBSink)
+	if err := influxDBSink.Start(); err != nil {
+		logger.Error("influxdb is not started", zap.Error(err))
+	}
+	bus.Subscribe("influxdb", event.DefaultOptions, influxDBSink.Handle)
+
+	// prometheus remote_write
+	remoteWriteSink := sink.NewRemoteWriteSink(logger, cfg.Sinks.RemoteWrite, cfg.Metrics.Namespace)
+	if err := remoteWriteSink.Start(); err != nil {
+		logger.Error("remote_write is not started", zap.Error(err))
+	}
+	bus.Subscribe("remote_write", event.DefaultOptions, remoteWriteSink.Handle)
+
+	// opentelemetry
+	otlpSink := sink.NewOTLPSink(logger, cfg.Sinks.OTLP, cfg.Metrics.Namespace)
+	if err := otlpSink.Start(); err != nil {
+		logger.Error("otlp is not started", zap.Error(err))
+	}
+	bus.Subscribe("otlp", event.DefaultOptions, otlpSink.Handle)
+
+	// context, canceled by SIGINT / SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	// Main routine for get meter data
+	collected := make(chan struct{})
 	go func() {
+		defer close(collected)
 		for {
-			if hemsDataController.Initialize(ctx, rbpwd, rbid) == nil {
+			if hemsDataController.Initialize(ctx) == nil {
 				hemsDataController.Collect(ctx)
 			}
-			time.Sleep(time.Duration(5) * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(5) * time.Second):
+			}
 		}
 	}()
 
+	// config reload, compared with the last applied one
+	applied := cfg
+	go config.Watch(ctx, logger, cfg, os.Args[0], args, func(c *config.Config) {
+		if c.Log != applied.Log || c.Metrics != applied.Metrics || c.HTTP != applied.HTTP || c.Storage != applied.Storage || c.Billing != applied.Billing {
+			logger.Warn("log, metrics, http, storage and billing settings are applied after restart")
+		}
+		redactor.SetSecrets(secrets(c)...)
+		hemsDataController.ApplyConfig(c)
+		if err := mqttSink.ApplyConfig(c.Sinks.MQTT); err != nil {
+			logger.Error("mqtt config is not applied", zap.Error(err))
+		}
+		if err := influxDBSink.ApplyConfig(c.Sinks.InfluxDB); err != nil {
+			logger.Error("influxdb config is not applied", zap.Error(err))
+		}
+		if err := remoteWriteSink.ApplyConfig(c.Sinks.RemoteWrite); err != nil {
+			logger.Error("remote_write config is not applied", zap.Error(err))
+		}
+		if err := otlpSink.ApplyConfig(c.Sinks.OTLP); err != nil {
+			logger.Error("otlp config is not applied", zap.Error(err))
+		}
+		if err := tariffEngine.ApplyConfig(c.Tariff); err != nil {
+			logger.Error("tariff config is not applied", zap.Error(err))
+		}
+		breaker.ApplyConfig(c.Breaker)
+		applied = c
+		logger.Info("config is reloaded", zap.Stringer("config", c))
+	})
+
 	engine := gin.Default()
 	engine.GET("/", func(c *gin.Context) {
 		c.JSON(200, "ok")
@@ -71,6 +261,183 @@ func main() {
 			c.JSON(404, "ng")
 		}
 	})
-	engine.GET("/metrics", controller.CreatePrometheusHandler())
-	engine.Run(":9000")
+	engine.GET(cfg.Metrics.Path, metricsController.CreatePrometheusHandler())
+
+	apiV1 := engine.Group("/api/v1")
+	apiController.Route(apiV1)
+	streamController.Route(apiV1)
+
+	server := &http.Server{
+		Addr:    cfg.HTTP.Listen,
+		Handler: engine,
+	}
+	server.RegisterOnShutdown(streamController.Close)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("http server is failed", zap.Error(err))
+			stop()
+		}
+	}()
+
+	// admin endpoints, not on the public listener: the debug log has the raw dongle traffic
+	var adminServer *http.Server
+	if len(cfg.HTTP.AdminListen) > 0 {
+		admin := http.NewServeMux()
+		// runtime log level, GET / PUT {"level":"debug"}
+		admin.Handle("/admin/log/level", logLevel)
+		adminServer = &http.Server{
+			Addr:    cfg.HTTP.AdminListen,
+			Handler: admin,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("admin http server is failed", zap.Error(err))
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	logger.Info("Shutdown...")
+
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout.Duration())
+	defer cancel()
+
+	// wait for the collector, it ends the PANA session and closes the port
+	select {
+	case <-collected:
+	case <-sctx.Done():
+		logger.Warn("collector did not stop in time")
+	}
+
+	hemsDataController.SaveState()
+
+	// drain the sinks
+	if err := bus.Close(sctx); err != nil {
+		logger.Warn("sinks are not drained", zap.Error(err))
+	}
+	// the warnings are sent before the mqtt is disconnected
+	if err := breaker.Close(sctx); err != nil {
+		logger.Warn("breaker notifications are not sent", zap.Error(err))
+	}
+	mqttSink.Close()
+	influxDBSink.Close()
+	remoteWriteSink.Close()
+	otlpSink.Close()
+	if store != nil {
+		if err := store.Close(); err != nil {
+			logger.Warn("storage is not closed", zap.Error(err))
+		}
+	}
+
+	if err := server.Shutdown(sctx); err != nil {
+		logger.Warn("http server shutdown is failed", zap.Error(err))
+	}
+	if adminServer != nil {
+		adminServer.Shutdown(sctx)
+	}
+	logger.Info("Shutdown OK.")
+}
+
+// calendar is the days, months and billing periods of the rollups
+func calendar(c *config.Config) rollup.Calendar {
+	return rollup.Calendar{Location: c.Location(), BillingDay: c.Billing.ReadingDay}
+}
+
+// secrets are masked in the log output
+func secrets(c *config.Config) []string {
+	s := []string{
+		c.Meter.BRouteID,
+		c.Meter.BRoutePassword,
+		c.Sinks.MQTT.Password,
+		c.Sinks.InfluxDB.Password,
+		c.Sinks.InfluxDB.Token,
+		c.Sinks.RemoteWrite.Password,
+		c.Sinks.RemoteWrite.BearerToken,
+	}
+	for _, v := range c.Sinks.OTLP.Headers {
+		s = append(s, v)
+	}
+	for _, v := range c.Breaker.Notify.Webhook.Headers {
+		s = append(s, v)
+	}
+	return s
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "path to the config file (yaml)")
+	resolution := fs.String("resolution", string(export.Slot), "raw, 1m, 30m, daily, monthly or billing")
+	format := fs.String("format", string(export.CSV), "csv, jsonl or parquet")
+	from := fs.String("from", "", "start, RFC3339 or 2006-01-02 (default: the span before -to)")
+	to := fs.String("to", "", "end, RFC3339 or 2006-01-02 (default: now)")
+	output := fs.String("o", "-", "output file, - is stdout")
+	dir := fs.String("storage.dir", "", "directory of the storage (default: storage.dir of the config)")
+	fs.Parse(args)
+
+	// the meter is not required, only the storage and the export are validated
+	configArgs := []string{}
+	if len(*file) > 0 {
+		configArgs = append(configArgs, "-config", *file)
+	}
+	if len(*dir) > 0 {
+		configArgs = append(configArgs, "-storage.dir", *dir)
+	}
+	cfg, err := config.LoadForExport(os.Args[0], configArgs)
+	if err != nil {
+		return err
+	}
+	loc := cfg.Location()
+
+	r, err := export.ParseResolution(*resolution)
+	if err != nil {
+		return err
+	}
+	f, err := export.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+	end := time.Now()
+	if len(*to) > 0 {
+		if end, err = export.ParseTime(*to, loc); err != nil {
+			return err
+		}
+	}
+	start := end.Add(-r.DefaultSpan())
+	if len(*from) > 0 {
+		if start, err = export.ParseTime(*from, loc); err != nil {
+			return err
+		}
+	}
+
+	if !start.Before(end) {
+		return fmt.Errorf("from must be before to")
+	}
+
+	// read only, the server may be running on the same storage
+	store, err := storage.OpenReadOnly(zap.NewNop(), cfg.Storage.Dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// the cost column with the tariff
+	var tariffEngine *tariff.Engine
+	if cfg.Tariff.Enabled {
+		if tariffEngine, err = tariff.NewEngine(zap.NewNop(), cfg.Tariff, calendar(cfg), cfg.Metrics.Namespace); err != nil {
+			return err
+		}
+	}
+
+	w := os.Stdout
+	if *output != "-" {
+		if w, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	if err := export.NewExporter(store, calendar(cfg), tariffEngine).Export(w, f, r, start, end); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
 }
@@ -6,14 +6,54 @@ import (
 )
 
 type HemsData struct {
-	DateTime                      time.Time
-	CumulativePowerConsumption    float32
+	DateTime                   time.Time
+	CumulativePowerConsumption float32
+	// CumulativePowerExport is the exported energy (逆方向), 0 when the meter does not measure it
+	CumulativePowerExport         float32
 	PowerConsumptionPerUnitTime   float32
 	InstantaneousPowerConsumption int
 	Current                       float32
 	RphaseCurrent                 float32
 	TpahseCurrent                 float32
 	PowerFactor                   float32
+	// the meter does not measure the phase, e.g. T相 of 単相2線式, the current above is 0
+	RphaseUnmeasured bool
+	TphaseUnmeasured bool
+
+	// the unit time which PowerConsumptionPerUnitTime belongs to, zero until the first one ends
+	UnitTimeStart time.Time
+	UnitTimeEnd   time.Time
+
+	// Fixed is the cumulative energy of the meter at the last fixed time (EPC EA), nil when it is not read
+	Fixed *FixedReading
+	// Slots are the unit times ended by this reading, one per boundary, usually one.
+	// The last one is the unit time above.
+	Slots []Slot
+}
+
+// FixedReading is the cumulative energy which the meter records at every 30 minutes, :00 and :30.
+// The invoice is calculated from them.
+type FixedReading struct {
+	Time          time.Time
+	CumulativeKWh float32
+	// ExportKWh is the exported one, Partial is true when the meter measures the export
+	// but it is not recorded at the time
+	ExportKWh float32
+	Partial   bool
+}
+
+// Slot is an ended unit time.
+type Slot struct {
+	Start time.Time
+	End   time.Time
+	// EnergyKWh is the energy of the unit time, CumulativeKWh is the cumulative energy at the end
+	EnergyKWh     float32
+	CumulativeKWh float32
+	// ExportedKWh is the exported energy of the unit time
+	ExportedKWh float32
+	// Metered is true when both ends are the fixed time values of the meter, otherwise the energy
+	// is from the readings around the boundaries
+	Metered bool
 }
 
 func CreateHemsData(
@@ -30,3 +70,33 @@ func CreateHemsData(
 		PowerFactor:                   float32(math.Round(float64(ipc)*1000.0/(10.0*float64(rCurrent+tCurrent))) * 0.1),
 	}
 }
+
+// PhaseCurrent is the current of the phase r or t, false when the meter does not measure it.
+func (data *HemsData) PhaseCurrent(phase string) (float32, bool) {
+	switch phase {
+	case "r":
+		return data.RphaseCurrent, !data.RphaseUnmeasured
+	case "t":
+		return data.TpahseCurrent, !data.TphaseUnmeasured
+	}
+	return 0, false
+}
+
+type MeterInfo struct {
+	// ManufacturerCode is the ECHONET maker code (EPC 0x8A), hex
+	ManufacturerCode string
+	// SerialNumber is EPC 0x8D, empty when the meter does not support it
+	SerialNumber string
+	// DongleVersion is the firmware version of the dongle from SKVER
+	DongleVersion string
+}
+
+type ConnectionStatus struct {
+	Ready       bool
+	Connected   bool
+	ConnectedAt time.Time
+	LastReadAt  time.Time
+	LastError   string
+	LastErrorAt time.Time
+	Meter       *MeterInfo
+}
@@ -0,0 +1,76 @@
+package rollup
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period is the span of a rollup.
+type Period string
+
+const (
+	Day   Period = "day"
+	Month Period = "month"
+	// Billing is from the meter reading day of a month to the one of the next month
+	Billing Period = "billing"
+)
+
+var Periods = []Period{Day, Month, Billing}
+
+func ParsePeriod(s string) (Period, error) {
+	for _, p := range Periods {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("period must be day, month or billing: %s", s)
+}
+
+// Calendar is the days and months of the timezone, and the billing periods of the meter reading day.
+type Calendar struct {
+	Location *time.Location
+	// BillingDay is the meter reading day, 1-31. A day after the end of a month is the last day of it.
+	BillingDay int
+}
+
+// Start returns the start of the period which t belongs to.
+func (c Calendar) Start(p Period, t time.Time) time.Time {
+	t = t.In(c.Location)
+	switch p {
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, c.Location)
+	case Billing:
+		start := c.billingStart(t.Year(), t.Month())
+		if t.Before(start) {
+			start = c.billingStart(t.Year(), t.Month()-1)
+		}
+		return start
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, c.Location)
+	}
+}
+
+// End returns the end of the period which starts at start.
+func (c Calendar) End(p Period, start time.Time) time.Time {
+	start = start.In(c.Location)
+	switch p {
+	case Month:
+		return start.AddDate(0, 1, 0)
+	case Billing:
+		return c.billingStart(start.Year(), start.Month()+1)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+func (c Calendar) billingStart(year int, month time.Month) time.Time {
+	day := c.BillingDay
+	if day < 1 {
+		day = 1
+	}
+	// the last day of the month
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, c.Location).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, c.Location)
+}
@@ -0,0 +1,176 @@
+package rollup
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// closed periods kept in memory
+var historySize = map[Period]int{
+	Day:     62,
+	Month:   24,
+	Billing: 24,
+}
+
+// Total is the energy of the unit times which start in the period.
+type Total struct {
+	Period    Period
+	Start     time.Time
+	End       time.Time
+	EnergyKWh float64
+	// Slots is the number of the unit times
+	Slots int
+}
+
+// Rollups sums the 30 minutes unit times of the meter by day, month and billing period,
+// so that the totals are the ones of the invoice. It is a prometheus.Collector.
+type Rollups struct {
+	calendar Calendar
+
+	mutex   sync.RWMutex
+	totals  map[Period][]*Total
+	lastEnd time.Time
+
+	energy *prometheus.Desc
+	start  *prometheus.Desc
+}
+
+func NewRollups(calendar Calendar, namespace string) *Rollups {
+	labels := []string{"period", "range"}
+	return &Rollups{
+		calendar: calendar,
+		totals:   map[Period][]*Total{},
+		energy: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "period_energy_kwh"),
+			"Energy of the unit times in the current or the previous day / month / billing period [kWh]", labels, nil),
+		start: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "period_start_timestamp_seconds"),
+			"Unix time of the start of the period", labels, nil),
+	}
+}
+
+// Calendar returns the calendar of the periods.
+func (r *Rollups) Calendar() Calendar {
+	return r.calendar
+}
+
+// Update adds the unit times which the reading ended, the event bus subscriber.
+func (r *Rollups) Update(data *model.HemsData) error {
+	if data == nil {
+		return nil
+	}
+	for _, slot := range data.Slots {
+		r.AddSlot(slot.Start, slot.End, slot.EnergyKWh)
+	}
+	return nil
+}
+
+// AddSlot adds a unit time, it is ignored unless it ends after the last one.
+func (r *Rollups) AddSlot(start time.Time, end time.Time, energy float32) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !end.After(r.lastEnd) {
+		return
+	}
+	r.lastEnd = end
+
+	// the partial first unit time after a start has no start
+	if start.IsZero() {
+		start = end.Add(-time.Nanosecond)
+	}
+	for _, p := range Periods {
+		t := r.total(p, r.calendar.Start(p, start))
+		t.EnergyKWh = Round(t.EnergyKWh + Value(energy))
+		t.Slots++
+	}
+}
+
+// total returns the total of the period, a new one is added after the last.
+func (r *Rollups) total(p Period, start time.Time) *Total {
+	totals := r.totals[p]
+	for i := len(totals) - 1; i >= 0; i-- {
+		if totals[i].Start.Equal(start) {
+			return totals[i]
+		}
+	}
+	t := &Total{Period: p, Start: start, End: r.calendar.End(p, start)}
+	totals = append(totals, t)
+	if len(totals) > historySize[p]+1 {
+		totals = totals[len(totals)-historySize[p]-1:]
+	}
+	r.totals[p] = totals
+	return t
+}
+
+// Totals returns the closed periods and the current one, oldest first. The current one is zero until a unit time ends in it.
+func (r *Rollups) Totals(p Period, now time.Time) []Total {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	current := r.calendar.Start(p, now)
+	result := []Total{}
+	for _, t := range r.totals[p] {
+		if t.Start.After(current) {
+			continue
+		}
+		result = append(result, *t)
+	}
+	if len(result) == 0 || !result[len(result)-1].Start.Equal(current) {
+		result = append(result, Total{Period: p, Start: current, End: r.calendar.End(p, current)})
+	}
+	return result
+}
+
+// Current returns the total of the period which now belongs to, and the previous one.
+func (r *Rollups) Current(p Period, now time.Time) (Total, Total) {
+	current := r.calendar.Start(p, now)
+	previous := r.calendar.Start(p, current.Add(-time.Nanosecond))
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	find := func(start time.Time) Total {
+		for _, t := range r.totals[p] {
+			if t.Start.Equal(start) {
+				return *t
+			}
+		}
+		return Total{Period: p, Start: start, End: r.calendar.End(p, start)}
+	}
+	return find(current), find(previous)
+}
+
+// Describe implements prometheus.Collector.
+func (r *Rollups) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.energy
+	ch <- r.start
+}
+
+// Collect implements prometheus.Collector.
+func (r *Rollups) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, p := range Periods {
+		current, previous := r.Current(p, now)
+		for _, t := range []struct {
+			total Total
+			name  string
+		}{{current, "current"}, {previous, "previous"}} {
+			ch <- prometheus.MustNewConstMetric(r.energy, prometheus.GaugeValue, t.total.EnergyKWh, string(p), t.name)
+			ch <- prometheus.MustNewConstMetric(r.start, prometheus.GaugeValue, float64(t.total.Start.Unix()), string(p), t.name)
+		}
+	}
+}
+
+// Value converts the value as it is printed in 32 bits, e.g. 0.1 instead of 0.10000000149011612
+func Value(v float32) float64 {
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'f', -1, 32), 64)
+	return f
+}
+
+// Round cuts the error of the sums
+func Round(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
@@ -0,0 +1,170 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+// ECHONET maker codes (EPC 0x8A) of the common smart meters
+var echonetManufacturers = map[string]string{
+	"000005": "Sharp",
+	"000006": "Mitsubishi Electric",
+	"00000B": "Panasonic",
+	"000016": "Toshiba",
+}
+
+type haSensor struct {
+	key           string
+	name          string
+	deviceClass   string
+	stateClass    string
+	unit          string
+	valueTemplate string
+	precision     int
+}
+
+var haSensors = []haSensor{
+	{"power", "Power", "power", "measurement", "W", "{{ value_json.instantaneous_power_w }}", 0},
+	{"current", "Current", "current", "measurement", "A", "{{ value_json.current_a }}", 1},
+	{"r_phase_current", "R phase current", "current", "measurement", "A", "{{ value_json.r_phase_current_a }}", 1},
+	{"t_phase_current", "T phase current", "current", "measurement", "A", "{{ value_json.t_phase_current_a }}", 1},
+	{"power_factor", "Power factor", "power_factor", "measurement", "%", "{{ value_json.power_factor_percent }}", 1},
+	// the cumulative energy is usable in the energy dashboard
+	{"energy", "Energy", "energy", "total_increasing", "kWh", "{{ value_json.cumulative_energy_kwh }}", 2},
+	{"unit_time_energy", "Energy last unit time", "", "measurement", "kWh", "{{ value_json.unit_time_energy_kwh }}", 2},
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+	SwVersion    string   `json:"sw_version,omitempty"`
+}
+
+type haSensorConfig struct {
+	Name                      string   `json:"name"`
+	UniqueID                  string   `json:"unique_id"`
+	ObjectID                  string   `json:"object_id"`
+	StateTopic                string   `json:"state_topic"`
+	ValueTemplate             string   `json:"value_template"`
+	AvailabilityTopic         string   `json:"availability_topic"`
+	DeviceClass               string   `json:"device_class,omitempty"`
+	StateClass                string   `json:"state_class"`
+	UnitOfMeasurement         string   `json:"unit_of_measurement"`
+	SuggestedDisplayPrecision int      `json:"suggested_display_precision"`
+	Device                    haDevice `json:"device"`
+}
+
+// HomeAssistant publishes the MQTT discovery configs of Home Assistant through the MQTT sink,
+// on every connection and when the meter identity becomes known.
+type HomeAssistant struct {
+	logger *zap.Logger
+	mqtt   *MQTTSink
+
+	mutex sync.Mutex
+	meter *model.MeterInfo
+}
+
+func NewHomeAssistant(l *zap.Logger, mqttSink *MQTTSink) *HomeAssistant {
+	h := &HomeAssistant{
+		logger: l.With(zap.String("sink", "home_assistant")),
+		mqtt:   mqttSink,
+	}
+	mqttSink.OnConnect(func(s *MQTTSink) {
+		if err := h.publishDiscovery(); err != nil {
+			h.logger.Warn("publish discovery is failed", zap.Error(err))
+		}
+	})
+	return h
+}
+
+// Handle is the event bus subscriber, the discovery is published again when the meter is changed.
+func (h *HomeAssistant) Handle(e event.Event) error {
+	if e.Status == nil || e.Status.Meter == nil {
+		return nil
+	}
+
+	h.mutex.Lock()
+	changed := h.meter == nil || *h.meter != *e.Status.Meter
+	if changed {
+		m := *e.Status.Meter
+		h.meter = &m
+	}
+	h.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return h.publishDiscovery()
+}
+
+func (h *HomeAssistant) publishDiscovery() error {
+	cfg := h.mqtt.Config()
+	ha := cfg.HomeAssistant
+	if !cfg.Enabled || !ha.Enabled {
+		return nil
+	}
+
+	device := haDevice{
+		Identifiers: []string{ha.NodeID},
+		Name:        ha.DeviceName,
+		Model:       "Low-voltage smart electric energy meter",
+	}
+	h.mutex.Lock()
+	if h.meter != nil {
+		device.Manufacturer = manufacturerName(h.meter.ManufacturerCode)
+		device.SerialNumber = h.meter.SerialNumber
+		device.SwVersion = h.meter.DongleVersion
+	}
+	h.mutex.Unlock()
+
+	errs := []string{}
+	for _, sensor := range haSensors {
+		c := haSensorConfig{
+			Name:                      sensor.name,
+			UniqueID:                  ha.NodeID + "_" + sensor.key,
+			ObjectID:                  ha.NodeID + "_" + sensor.key,
+			StateTopic:                mqttTopic(cfg, cfg.Topics.State),
+			ValueTemplate:             sensor.valueTemplate,
+			AvailabilityTopic:         mqttTopic(cfg, cfg.Topics.Availability),
+			DeviceClass:               sensor.deviceClass,
+			StateClass:                sensor.stateClass,
+			UnitOfMeasurement:         sensor.unit,
+			SuggestedDisplayPrecision: sensor.precision,
+			Device:                    device,
+		}
+		b, err := json.Marshal(c)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", strings.TrimSuffix(ha.DiscoveryPrefix, "/"), ha.NodeID, sensor.key)
+		if err := h.mqtt.Publish(topic, string(b), true); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("publish discovery is failed: %s", strings.Join(errs, ", "))
+	}
+	h.logger.Debug("discovery is published")
+	return nil
+}
+
+func manufacturerName(code string) string {
+	if name, ok := echonetManufacturers[strings.ToUpper(code)]; ok {
+		return name
+	}
+	if len(code) > 0 {
+		return "ECHONET maker 0x" + code
+	}
+	return ""
+}
@@ -0,0 +1,389 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// max payload of a UDP datagram to the InfluxDB UDP listener
+const influxUDPPayload = 8192
+
+// InfluxDBSink writes every reading in line protocol, with the meter timestamp.
+// The batches which could not be written are spooled on disk and retried, and the ones which
+// are rejected by the endpoint are dropped. It is a prometheus.Collector.
+type InfluxDBSink struct {
+	logger *zap.Logger
+
+	mutex  sync.Mutex
+	cfg    config.InfluxDBConfig
+	client *http.Client
+	spool  *spool
+	lines  []string
+	meter  *model.MeterInfo
+
+	// writeMutex keeps the order of the batches
+	writeMutex sync.Mutex
+	stop       chan struct{}
+	done       chan struct{}
+
+	rejected     uint64
+	rejectedDesc *prometheus.Desc
+}
+
+func NewInfluxDBSink(l *zap.Logger, cfg config.InfluxDBConfig, namespace string) *InfluxDBSink {
+	return &InfluxDBSink{
+		logger: l.With(zap.String("sink", "influxdb")),
+		cfg:    cfg,
+		rejectedDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "influxdb", "rejected_batches_total"),
+			"Batches which are rejected by the endpoint with 4xx and dropped", nil, nil),
+	}
+}
+
+// Start starts the flush and the retry loop when enabled.
+func (s *InfluxDBSink) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.cfg.Enabled {
+		return nil
+	}
+	return s.start()
+}
+
+func (s *InfluxDBSink) start() error {
+	tlsConfig, err := newTLSConfig(s.cfg.TLS)
+	if err != nil {
+		return err
+	}
+	s.client = &http.Client{
+		Timeout:   s.cfg.Timeout.Duration(),
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	if len(s.cfg.SpoolDir) > 0 {
+		sp, err := newSpool(s.cfg.SpoolDir, s.cfg.SpoolMaxBytes)
+		if err != nil {
+			return err
+		}
+		s.spool = sp
+	} else {
+		s.spool = nil
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.cfg, s.stop, s.done)
+
+	return nil
+}
+
+func (s *InfluxDBSink) run(cfg config.InfluxDBConfig, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	flush := time.NewTicker(cfg.FlushInterval.Duration())
+	defer flush.Stop()
+	retry := time.NewTicker(cfg.RetryInterval.Duration())
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-flush.C:
+			s.Flush()
+		case <-retry.C:
+			s.retry()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close flushes the buffer and stops, what can not be written is spooled.
+func (s *InfluxDBSink) Close() {
+	s.mutex.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+		s.Flush()
+	}
+}
+
+// ApplyConfig restarts the sink only when the config is changed.
+func (s *InfluxDBSink) ApplyConfig(cfg config.InfluxDBConfig) error {
+	s.mutex.Lock()
+	changed := !reflect.DeepEqual(cfg, s.cfg)
+	s.mutex.Unlock()
+	if !changed {
+		return nil
+	}
+
+	s.logger.Info("config is changed, restarting")
+	s.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cfg = cfg
+	if !cfg.Enabled {
+		return nil
+	}
+	return s.start()
+}
+
+// Handle is the event bus subscriber.
+func (s *InfluxDBSink) Handle(e event.Event) error {
+	s.mutex.Lock()
+
+	if !s.cfg.Enabled || s.stop == nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	if e.Status != nil && e.Status.Meter != nil {
+		m := *e.Status.Meter
+		s.meter = &m
+	}
+	if e.Reading == nil {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	s.lines = append(s.lines, s.point(e.Reading).line())
+	full := len(s.lines) >= s.cfg.BatchSize
+	s.mutex.Unlock()
+
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+func (s *InfluxDBSink) point(data *model.HemsData) *point {
+	tags := map[string]string{}
+	for k, v := range s.cfg.Tags {
+		tags[k] = v
+	}
+	if s.meter != nil && len(s.meter.SerialNumber) > 0 {
+		tags["meter"] = s.meter.SerialNumber
+	}
+
+	fields := map[string]interface{}{
+		"cumulative_energy_kwh": float32Value(data.CumulativePowerConsumption),
+		"instantaneous_power_w": int64(data.InstantaneousPowerConsumption),
+		"current_a":             float32Value(data.Current),
+		"power_factor_percent":  float32Value(data.PowerFactor),
+		"unit_time_energy_kwh":  float32Value(data.PowerConsumptionPerUnitTime),
+	}
+	// the phase which the meter does not measure has no field
+	if !data.RphaseUnmeasured {
+		fields["r_phase_current_a"] = float32Value(data.RphaseCurrent)
+	}
+	if !data.TphaseUnmeasured {
+		fields["t_phase_current_a"] = float32Value(data.TpahseCurrent)
+	}
+
+	return &point{
+		measurement: s.cfg.Measurement,
+		tags:        tags,
+		fields:      fields,
+		time:        data.DateTime,
+	}
+}
+
+// Flush writes the buffered lines, they are spooled when the write is failed.
+func (s *InfluxDBSink) Flush() error {
+	s.mutex.Lock()
+	lines := s.lines
+	s.lines = nil
+	cfg, client, sp := s.cfg, s.client, s.spool
+	s.mutex.Unlock()
+
+	if len(lines) == 0 || client == nil {
+		return nil
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	data := []byte(strings.Join(lines, "\n") + "\n")
+
+	// the spooled batches first, to keep the order
+	if sp != nil && sp.len() > 0 {
+		if err := s.drain(cfg, client, sp); err == nil {
+			return s.writeOrSpool(cfg, client, sp, data)
+		}
+		return s.spoolBatch(sp, data, fmt.Errorf("endpoint is still unreachable"))
+	}
+
+	return s.writeOrSpool(cfg, client, sp, data)
+}
+
+func (s *InfluxDBSink) writeOrSpool(cfg config.InfluxDBConfig, client *http.Client, sp *spool, data []byte) error {
+	err := s.write(cfg, client, data)
+	if err == nil || s.rejectedBatch(err) {
+		return nil
+	}
+	if sp == nil {
+		return err
+	}
+	return s.spoolBatch(sp, data, err)
+}
+
+func (s *InfluxDBSink) spoolBatch(sp *spool, data []byte, cause error) error {
+	if err := sp.put(data); err != nil {
+		return fmt.Errorf("%v, and spool is failed: %w", cause, err)
+	}
+	s.logger.Warn("write is failed, the batch is spooled", zap.Error(cause))
+	return nil
+}
+
+// retry writes the spooled batches.
+func (s *InfluxDBSink) retry() {
+	s.mutex.Lock()
+	cfg, client, sp := s.cfg, s.client, s.spool
+	s.mutex.Unlock()
+	if sp == nil || client == nil {
+		return
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.drain(cfg, client, sp)
+}
+
+func (s *InfluxDBSink) drain(cfg config.InfluxDBConfig, client *http.Client, sp *spool) error {
+	sent, err := sp.drain(func(data []byte) error {
+		if err := s.write(cfg, client, data); !s.rejectedBatch(err) {
+			return err
+		}
+		return nil
+	})
+	if sent > 0 {
+		s.logger.Info(fmt.Sprintf("%d spooled batches are written", sent))
+	}
+	return err
+}
+
+// rejectedBatch drops the batch which the endpoint never accepts, e.g. a bad line or a missing bucket,
+// otherwise it blocks the spool forever.
+func (s *InfluxDBSink) rejectedBatch(err error) bool {
+	if _, ok := err.(permanentError); !ok {
+		return false
+	}
+	s.logger.Error("batch is rejected and dropped", zap.Error(err))
+	s.mutex.Lock()
+	s.rejected++
+	s.mutex.Unlock()
+	return true
+}
+
+// Describe implements prometheus.Collector.
+func (s *InfluxDBSink) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.rejectedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *InfluxDBSink) Collect(ch chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(s.rejectedDesc, prometheus.CounterValue, float64(s.rejected))
+}
+
+func (s *InfluxDBSink) write(cfg config.InfluxDBConfig, client *http.Client, data []byte) error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "udp" {
+		return s.writeUDP(cfg, u.Host, data)
+	}
+
+	q := url.Values{}
+	q.Set("precision", "ns")
+	switch cfg.Version {
+	case 1:
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		q.Set("db", cfg.Database)
+		if len(cfg.RetentionPolicy) > 0 {
+			q.Set("rp", cfg.RetentionPolicy)
+		}
+	default:
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		q.Set("org", cfg.Org)
+		q.Set("bucket", cfg.Bucket)
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout.Duration())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if cfg.Version == 1 && len(cfg.Username) > 0 {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	if cfg.Version != 1 && len(cfg.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+cfg.Token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode/100 != 2 {
+		err := fmt.Errorf("write is failed: %s %s", res.Status, strings.TrimSpace(string(body)))
+		if res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *InfluxDBSink) writeUDP(cfg config.InfluxDBConfig, host string, data []byte) error {
+	conn, err := net.DialTimeout("udp", host, cfg.Timeout.Duration())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// split at the line ends, a line is never split
+	for len(data) > 0 {
+		n := len(data)
+		if n > influxUDPPayload {
+			n = bytes.LastIndexByte(data[:influxUDPPayload], '\n') + 1
+			if n <= 0 {
+				n = bytes.IndexByte(data, '\n') + 1
+			}
+			if n <= 0 {
+				n = len(data)
+			}
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
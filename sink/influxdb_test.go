@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+func TestInfluxDBRejectedBatch(t *testing.T) {
+	var mutex sync.Mutex
+	status := http.StatusServiceUnavailable
+	writes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		writes++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	setStatus := func(s int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		status = s
+	}
+
+	cfg := config.Default().Sinks.InfluxDB
+	cfg.Enabled = true
+	cfg.URL = server.URL
+	cfg.Org, cfg.Bucket = "home", "hems"
+	cfg.SpoolDir = t.TempDir()
+	cfg.FlushInterval = config.Duration(time.Hour)
+	cfg.RetryInterval = config.Duration(time.Hour)
+	s := NewInfluxDBSink(zap.NewNop(), cfg, "hems")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	write := func() error {
+		if err := s.Handle(event.Event{Reading: model.CreateHemsData(time.Now(), 1, 600, 30, 30)}); err != nil {
+			return err
+		}
+		return s.Flush()
+	}
+
+	// unavailable, spooled and retried
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		setStatus(code)
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.spool.len(); n != 2 {
+		t.Fatalf("%d batches are spooled, not 2", n)
+	}
+
+	// the spooled batches are rejected, they are dropped and the new one is written
+	setStatus(http.StatusBadRequest)
+	if err := write(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.spool.len(); n != 0 {
+		t.Errorf("%d rejected batches are left in the spool", n)
+	}
+	if s.rejected != 3 {
+		t.Errorf("%d batches are counted as rejected, not 3", s.rejected)
+	}
+
+	setStatus(http.StatusNoContent)
+	if err := write(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.spool.len(); n != 0 || writes != 6 {
+		t.Errorf("%d batches are spooled after %d writes", n, writes)
+	}
+}
@@ -0,0 +1,79 @@
+package sink
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// point is a line of the InfluxDB line protocol. The field values are float64, int64 or string.
+type point struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]interface{}
+	time        time.Time
+}
+
+// line encodes the point with nanosecond precision.
+func (p *point) line() string {
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.measurement))
+
+	keys := make([]string, 0, len(p.tags))
+	for k, v := range p.tags {
+		if len(k) > 0 && len(v) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(",")
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteString("=")
+		b.WriteString(keyEscaper.Replace(p.tags[k]))
+	}
+
+	keys = keys[:0]
+	for k := range p.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(keyEscaper.Replace(k))
+		b.WriteString("=")
+		switch v := p.fields[k].(type) {
+		case int64:
+			b.WriteString(strconv.FormatInt(v, 10))
+			b.WriteString("i")
+		case float64:
+			b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case string:
+			b.WriteString(`"` + stringEscaper.Replace(v) + `"`)
+		default:
+			b.WriteString(fmt.Sprintf(`"%v"`, v))
+		}
+	}
+
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(p.time.UnixNano(), 10))
+	return b.String()
+}
+
+// float32 is converted through its shortest decimal representation, so that 0.1 is not 0.10000000149011612
+func float32Value(v float32) float64 {
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'f', -1, 32), 64)
+	return f
+}
@@ -0,0 +1,302 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+type mqttState struct {
+	Timestamp           time.Time  `json:"timestamp"`
+	CumulativeEnergyKWh float32    `json:"cumulative_energy_kwh"`
+	InstantaneousPowerW int        `json:"instantaneous_power_w"`
+	CurrentA            float32    `json:"current_a"`
+	RPhaseCurrentA      float32    `json:"r_phase_current_a"`
+	TPhaseCurrentA      float32    `json:"t_phase_current_a"`
+	PowerFactorPercent  float32    `json:"power_factor_percent"`
+	UnitTimeEnergyKWh   float32    `json:"unit_time_energy_kwh"`
+	UnitTimeEnd         *time.Time `json:"unit_time_end,omitempty"`
+}
+
+type mqttConnection struct {
+	Ready     bool   `json:"ready"`
+	Connected bool   `json:"connected"`
+	LastError string `json:"last_error"`
+}
+
+// MQTTSink publishes the readings and the connection state to a MQTT broker.
+type MQTTSink struct {
+	logger *zap.Logger
+
+	mutex  sync.RWMutex
+	cfg    config.MQTTConfig
+	client mqtt.Client
+	// onConnect is called on every (re)connection, after the availability is published
+	onConnect []func(s *MQTTSink)
+}
+
+func NewMQTTSink(l *zap.Logger, cfg config.MQTTConfig) *MQTTSink {
+	return &MQTTSink{
+		logger: l.With(zap.String("sink", "mqtt")),
+		cfg:    cfg,
+	}
+}
+
+// OnConnect registers f to be called on every connection, e.g. to publish discovery configs.
+func (s *MQTTSink) OnConnect(f func(s *MQTTSink)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onConnect = append(s.onConnect, f)
+}
+
+// Start connects in background when enabled, the client keeps reconnecting until Close.
+func (s *MQTTSink) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.cfg.Enabled {
+		return nil
+	}
+	return s.connect()
+}
+
+func (s *MQTTSink) connect() error {
+	cfg := s.cfg
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetKeepAlive(cfg.KeepAlive.Duration()).
+		SetConnectTimeout(cfg.ConnectTimeout.Duration()).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(cfg.MaxReconnectInterval.Duration()).
+		SetOrderMatters(false)
+
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if availability := mqttTopic(cfg, cfg.Topics.Availability); len(availability) > 0 {
+		opts.SetWill(availability, mqttOffline, cfg.QoS, true)
+	}
+
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		s.logger.Info(fmt.Sprintf("connected to %s", cfg.Broker))
+		publish(c, cfg, cfg.Topics.Availability, mqttOnline, true)
+
+		s.mutex.RLock()
+		onConnect := append([]func(s *MQTTSink){}, s.onConnect...)
+		s.mutex.RUnlock()
+		for _, f := range onConnect {
+			f(s)
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		s.logger.Warn("connection is lost, reconnecting", zap.Error(err))
+	})
+	opts.SetReconnectingHandler(func(c mqtt.Client, o *mqtt.ClientOptions) {
+		s.logger.Debug("reconnecting...")
+	})
+
+	s.client = mqtt.NewClient(opts)
+	// with ConnectRetry the token completes once connected, do not wait for it
+	s.client.Connect()
+
+	return nil
+}
+
+func (s *MQTTSink) disconnect() {
+	if s.client == nil {
+		return
+	}
+	if s.client.IsConnectionOpen() {
+		publish(s.client, s.cfg, s.cfg.Topics.Availability, mqttOffline, true)
+	}
+	s.client.Disconnect(250)
+	s.client = nil
+}
+
+// ApplyConfig reconnects only when the config is changed.
+func (s *MQTTSink) ApplyConfig(cfg config.MQTTConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if cfg == s.cfg {
+		return nil
+	}
+	s.logger.Info("config is changed, reconnecting")
+	s.disconnect()
+	s.cfg = cfg
+	if !cfg.Enabled {
+		return nil
+	}
+	return s.connect()
+}
+
+// Close publishes offline and disconnects.
+func (s *MQTTSink) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.disconnect()
+}
+
+// Handle is the event bus subscriber.
+func (s *MQTTSink) Handle(e event.Event) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.client == nil || !s.cfg.Enabled {
+		return nil
+	}
+	if !s.client.IsConnectionOpen() {
+		// the client reconnects by itself, the readings meanwhile are dropped
+		return nil
+	}
+
+	if e.Reading != nil {
+		return s.publishReading(e.Reading)
+	}
+	if e.Status != nil {
+		return s.publishStatus(e.Status)
+	}
+	return nil
+}
+
+func (s *MQTTSink) publishReading(data *model.HemsData) error {
+	c, cfg := s.client, s.cfg
+	topics := cfg.Topics
+	retain := cfg.Retain
+
+	errs := []string{}
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	add(publish(c, cfg, topics.Power, strconv.Itoa(data.InstantaneousPowerConsumption), retain))
+	add(publish(c, cfg, topics.Current, formatFloat(data.Current), retain))
+	if !data.RphaseUnmeasured {
+		add(publish(c, cfg, topics.RPhaseCurrent, formatFloat(data.RphaseCurrent), retain))
+	}
+	if !data.TphaseUnmeasured {
+		add(publish(c, cfg, topics.TPhaseCurrent, formatFloat(data.TpahseCurrent), retain))
+	}
+	add(publish(c, cfg, topics.PowerFactor, formatFloat(data.PowerFactor), retain))
+	add(publish(c, cfg, topics.Energy, formatFloat(data.CumulativePowerConsumption), retain))
+	add(publish(c, cfg, topics.UnitTime, formatFloat(data.PowerConsumptionPerUnitTime), retain))
+
+	if len(topics.State) > 0 {
+		state := mqttState{
+			Timestamp:           data.DateTime,
+			CumulativeEnergyKWh: data.CumulativePowerConsumption,
+			InstantaneousPowerW: data.InstantaneousPowerConsumption,
+			CurrentA:            data.Current,
+			RPhaseCurrentA:      data.RphaseCurrent,
+			TPhaseCurrentA:      data.TpahseCurrent,
+			PowerFactorPercent:  data.PowerFactor,
+			UnitTimeEnergyKWh:   data.PowerConsumptionPerUnitTime,
+		}
+		if !data.UnitTimeEnd.IsZero() {
+			state.UnitTimeEnd = &data.UnitTimeEnd
+		}
+		b, err := json.Marshal(state)
+		add(err)
+		add(publish(c, cfg, topics.State, string(b), retain))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("publish is failed: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s *MQTTSink) publishStatus(status *model.ConnectionStatus) error {
+	b, err := json.Marshal(mqttConnection{
+		Ready:     status.Ready,
+		Connected: status.Connected,
+		LastError: status.LastError,
+	})
+	if err != nil {
+		return err
+	}
+	// the connection state is always retained, so that a new subscriber knows it
+	return publish(s.client, s.cfg, s.cfg.Topics.Connection, string(b), true)
+}
+
+// Publish publishes the payload to the absolute topic, for the extensions of this sink.
+func (s *MQTTSink) Publish(topic string, payload string, retain bool) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.client == nil || !s.client.IsConnectionOpen() {
+		return fmt.Errorf("mqtt is not connected")
+	}
+	cfg := s.cfg
+	cfg.TopicPrefix = ""
+	return publish(s.client, cfg, topic, payload, retain)
+}
+
+// Config returns the current config.
+func (s *MQTTSink) Config() config.MQTTConfig {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.cfg
+}
+
+// Topic returns the full topic of topic relative to the prefix.
+func (s *MQTTSink) Topic(topic string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return mqttTopic(s.cfg, topic)
+}
+
+// publish publishes to the topic relative to the prefix, an empty topic is skipped.
+func publish(c mqtt.Client, cfg config.MQTTConfig, topic string, payload string, retain bool) error {
+	if len(topic) == 0 {
+		return nil
+	}
+	token := c.Publish(mqttTopic(cfg, topic), cfg.QoS, retain, payload)
+	if cfg.QoS == 0 {
+		return nil
+	}
+	if !token.WaitTimeout(cfg.ConnectTimeout.Duration()) {
+		return fmt.Errorf("publish %s is timeout", topic)
+	}
+	return token.Error()
+}
+
+// mqttTopic is the full topic with the prefix, empty when the topic is disabled.
+func mqttTopic(cfg config.MQTTConfig, topic string) string {
+	if len(topic) == 0 {
+		return ""
+	}
+	if len(cfg.TopicPrefix) == 0 {
+		return topic
+	}
+	return strings.TrimSuffix(cfg.TopicPrefix, "/") + "/" + topic
+}
+
+func formatFloat(v float32) string {
+	return strconv.FormatFloat(float64(v), 'f', -1, 32)
+}
@@ -0,0 +1,240 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/rs/zerolog"
+	"go.uber.org/zap"
+)
+
+type message struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
+	will    bool
+}
+
+// recorder is a hook of the broker which records the publishes of the clients and the wills.
+type recorder struct {
+	mochi.HookBase
+
+	mutex    sync.Mutex
+	messages []message
+}
+
+func (r *recorder) ID() string {
+	return "recorder"
+}
+
+func (r *recorder) Provides(b byte) bool {
+	return bytes.Contains([]byte{mochi.OnPublished, mochi.OnWillSent}, []byte{b})
+}
+
+func (r *recorder) OnPublished(cl *mochi.Client, pk packets.Packet) {
+	r.add(pk, false)
+}
+
+func (r *recorder) OnWillSent(cl *mochi.Client, pk packets.Packet) {
+	r.add(pk, true)
+}
+
+func (r *recorder) add(pk packets.Packet, will bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.messages = append(r.messages, message{pk.TopicName, string(pk.Payload), pk.FixedHeader.Qos, pk.FixedHeader.Retain, will})
+}
+
+// wait returns the n-th message of the topic.
+func (r *recorder) wait(t *testing.T, topic string, n int) message {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mutex.Lock()
+		found := []message{}
+		for _, m := range r.messages {
+			if m.topic == topic {
+				found = append(found, m)
+			}
+		}
+		r.mutex.Unlock()
+		if len(found) >= n {
+			return found[n-1]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is not published %d times", topic, n)
+	return message{}
+}
+
+// newBroker starts an in-process broker on a free port.
+func newBroker(t *testing.T) (*mochi.Server, *recorder, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	logger := zerolog.Nop()
+	server := mochi.New(&mochi.Options{Logger: &logger})
+	r := &recorder{}
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddHook(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewTCP("tcp", address, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return server, r, "tcp://" + address
+}
+
+func newTestMQTTConfig(broker string) config.MQTTConfig {
+	cfg := config.Default().Sinks.MQTT
+	cfg.Enabled = true
+	cfg.Broker = broker
+	cfg.ClientID = "hems-test"
+	cfg.QoS = 1
+	cfg.Retain = true
+	cfg.ConnectTimeout = config.Duration(2 * time.Second)
+	cfg.MaxReconnectInterval = config.Duration(time.Second)
+	return cfg
+}
+
+func TestMQTTPublish(t *testing.T) {
+	_, r, broker := newBroker(t)
+	s := NewMQTTSink(zap.NewNop(), newTestMQTTConfig(broker))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if m := r.wait(t, "hems/availability", 1); m.payload != mqttOnline || !m.retain {
+		t.Errorf("availability %+v", m)
+	}
+
+	data := model.CreateHemsData(time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), 1234.5, 600, 30, 20)
+	data.PowerConsumptionPerUnitTime = 0.3
+	if err := s.Handle(event.Event{Reading: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	for topic, payload := range map[string]string{
+		"hems/power":            "600",
+		"hems/current":          "5",
+		"hems/current/r":        "3",
+		"hems/current/t":        "2",
+		"hems/energy":           "1234.5",
+		"hems/energy/unit_time": "0.3",
+	} {
+		m := r.wait(t, topic, 1)
+		if m.payload != payload || m.qos != 1 || !m.retain {
+			t.Errorf("%s is %+v, not %s with qos 1 and retain", topic, m, payload)
+		}
+	}
+	state := mqttState{}
+	if err := json.Unmarshal([]byte(r.wait(t, "hems/state", 1).payload), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.InstantaneousPowerW != 600 || state.UnitTimeEnd != nil {
+		t.Errorf("state %+v", state)
+	}
+
+	// the connection state is retained regardless of the retain option
+	cfg := newTestMQTTConfig(broker)
+	cfg.Retain = false
+	cfg.QoS = 0
+	if err := s.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	r.wait(t, "hems/availability", 3)
+	if err := s.Handle(event.Event{Status: &model.ConnectionStatus{Ready: true, Connected: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if m := r.wait(t, "hems/connection", 1); !m.retain || m.qos != 0 || m.payload != `{"ready":true,"connected":true,"last_error":""}` {
+		t.Errorf("connection %+v", m)
+	}
+	if err := s.Handle(event.Event{Reading: data}); err != nil {
+		t.Fatal(err)
+	}
+	if m := r.wait(t, "hems/power", 2); m.retain || m.qos != 0 {
+		t.Errorf("power is published with the old options %+v", m)
+	}
+}
+
+func TestMQTTWillAndReconnect(t *testing.T) {
+	server, r, broker := newBroker(t)
+	s := NewMQTTSink(zap.NewNop(), newTestMQTTConfig(broker))
+	connected := make(chan struct{}, 4)
+	s.OnConnect(func(s *MQTTSink) {
+		connected <- struct{}{}
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-connected
+	r.wait(t, "hems/availability", 1)
+
+	// the connection is lost without a disconnect, the broker publishes the will
+	cl, ok := server.Clients.Get("hems-test")
+	if !ok {
+		t.Fatal("client is not connected")
+	}
+	cl.Stop(errors.New("connection is lost"))
+	if m := r.wait(t, "hems/availability", 2); !m.will || m.payload != mqttOffline || !m.retain {
+		t.Errorf("will %+v", m)
+	}
+
+	// reconnected by itself
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("not reconnected")
+	}
+	if m := r.wait(t, "hems/availability", 3); m.will || m.payload != mqttOnline {
+		t.Errorf("availability after reconnect %+v", m)
+	}
+	if err := s.Publish("hems/test", "ok", false); err != nil {
+		t.Errorf("publish after reconnect: %v", err)
+	}
+
+	// a graceful close publishes offline itself, without the will
+	s.Close()
+	if m := r.wait(t, "hems/availability", 4); m.will || m.payload != mqttOffline {
+		t.Errorf("availability after close %+v", m)
+	}
+	time.Sleep(100 * time.Millisecond)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	wills := 0
+	for _, m := range r.messages {
+		if m.will {
+			wills++
+		}
+	}
+	if wills != 1 {
+		t.Errorf("%d wills are sent", wills)
+	}
+}
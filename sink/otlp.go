@@ -0,0 +1,343 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+const otlpScope = "github.com/michibiki-io/hems-metrics-go"
+
+// OTLPSink exports the latest reading as OpenTelemetry metrics, and the spans of the
+// dongle commands when traces is enabled. The meter identity is the resource, so the
+// meter provider is restarted when the meter is changed.
+type OTLPSink struct {
+	logger    *zap.Logger
+	namespace string
+
+	mutex          sync.Mutex
+	cfg            config.OTLPConfig
+	meter          *model.MeterInfo
+	meterProvider  *sdkmetric.MeterProvider
+	tracerProvider *sdktrace.TracerProvider
+
+	// latest is read by the callback on every export
+	latest atomic.Pointer[model.HemsData]
+}
+
+func NewOTLPSink(l *zap.Logger, cfg config.OTLPConfig, namespace string) *OTLPSink {
+	return &OTLPSink{
+		logger:    l.With(zap.String("sink", "otlp")),
+		namespace: namespace,
+		cfg:       cfg,
+	}
+}
+
+// Start starts the exporters when enabled.
+func (s *OTLPSink) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.cfg.Enabled {
+		return nil
+	}
+	return s.start()
+}
+
+func (s *OTLPSink) start() error {
+	if err := s.startMetrics(); err != nil {
+		return err
+	}
+	if s.cfg.Traces {
+		if err := s.startTraces(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *OTLPSink) resource() (*resource.Resource, error) {
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(s.cfg.ServiceName),
+	}
+	if m := s.meter; m != nil {
+		attrs = append(attrs,
+			attribute.String("hems.meter.manufacturer_code", m.ManufacturerCode),
+			attribute.String("hems.meter.serial_number", m.SerialNumber),
+			attribute.String("hems.dongle.firmware_version", m.DongleVersion))
+		if name := manufacturerName(m.ManufacturerCode); len(name) > 0 {
+			attrs = append(attrs, attribute.String("hems.meter.manufacturer", name))
+		}
+	}
+	return resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, attrs...))
+}
+
+func (s *OTLPSink) startMetrics() error {
+	res, err := s.resource()
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig(s.cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout.Duration())
+	defer cancel()
+
+	var exporter sdkmetric.Exporter
+	switch s.cfg.Protocol {
+	case "http":
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(s.cfg.Endpoint),
+			otlpmetrichttp.WithURLPath(s.cfg.URLPath),
+			otlpmetrichttp.WithHeaders(s.cfg.Headers),
+			otlpmetrichttp.WithTimeout(s.cfg.Timeout.Duration()),
+		}
+		if s.cfg.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else if tlsConfig != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsConfig))
+		}
+		exporter, err = otlpmetrichttp.New(ctx, opts...)
+	default:
+		opts := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpoint(s.cfg.Endpoint),
+			otlpmetricgrpc.WithHeaders(s.cfg.Headers),
+			otlpmetricgrpc.WithTimeout(s.cfg.Timeout.Duration()),
+		}
+		if s.cfg.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		} else if tlsConfig != nil {
+			opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		exporter, err = otlpmetricgrpc.New(ctx, opts...)
+	}
+	if err != nil {
+		return fmt.Errorf("create otlp metric exporter is failed: %w", err)
+	}
+
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter,
+			sdkmetric.WithInterval(s.cfg.ExportInterval.Duration()),
+			sdkmetric.WithTimeout(s.cfg.Timeout.Duration()))),
+	)
+	if err := s.registerInstruments(provider.Meter(otlpScope)); err != nil {
+		provider.Shutdown(ctx)
+		return err
+	}
+	s.meterProvider = provider
+
+	return nil
+}
+
+func (s *OTLPSink) registerInstruments(meter metric.Meter) error {
+	power, err := meter.Int64ObservableGauge(s.name("power"),
+		instrument.WithUnit("W"), instrument.WithDescription("Instantaneous power consumption"))
+	if err != nil {
+		return err
+	}
+	current, err := meter.Float64ObservableGauge(s.name("current"),
+		instrument.WithUnit("A"), instrument.WithDescription("Instantaneous current, phase is r or t"))
+	if err != nil {
+		return err
+	}
+	powerFactor, err := meter.Float64ObservableGauge(s.name("power_factor"),
+		instrument.WithUnit("%"), instrument.WithDescription("Power factor"))
+	if err != nil {
+		return err
+	}
+	energy, err := meter.Float64ObservableCounter(s.name("energy.imported"),
+		instrument.WithUnit("kWh"), instrument.WithDescription("Cumulative imported energy"))
+	if err != nil {
+		return err
+	}
+	exported, err := meter.Float64ObservableCounter(s.name("energy.exported"),
+		instrument.WithUnit("kWh"), instrument.WithDescription("Cumulative exported energy"))
+	if err != nil {
+		return err
+	}
+	unitTime, err := meter.Float64ObservableGauge(s.name("energy.unit_time"),
+		instrument.WithUnit("kWh"), instrument.WithDescription("Energy of the latest unit time slot"))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		data := s.latest.Load()
+		if data == nil {
+			return nil
+		}
+		o.ObserveInt64(power, int64(data.InstantaneousPowerConsumption))
+		o.ObserveFloat64(current, float32Value(data.Current))
+		for _, phase := range []string{"r", "t"} {
+			// the phase which the meter does not measure is not reported
+			if v, ok := data.PhaseCurrent(phase); ok {
+				o.ObserveFloat64(current, float32Value(v), attribute.String("phase", phase))
+			}
+		}
+		o.ObserveFloat64(powerFactor, float32Value(data.PowerFactor))
+		o.ObserveFloat64(energy, float32Value(data.CumulativePowerConsumption))
+		o.ObserveFloat64(exported, float32Value(data.CumulativePowerExport))
+		o.ObserveFloat64(unitTime, float32Value(data.PowerConsumptionPerUnitTime))
+		return nil
+	}, power, current, powerFactor, energy, exported, unitTime)
+
+	return err
+}
+
+func (s *OTLPSink) name(name string) string {
+	if len(s.namespace) == 0 {
+		return name
+	}
+	return s.namespace + "." + name
+}
+
+func (s *OTLPSink) startTraces() error {
+	res, err := s.resource()
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig(s.cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout.Duration())
+	defer cancel()
+
+	var exporter sdktrace.SpanExporter
+	switch s.cfg.Protocol {
+	case "http":
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(s.cfg.Endpoint),
+			otlptracehttp.WithHeaders(s.cfg.Headers),
+			otlptracehttp.WithTimeout(s.cfg.Timeout.Duration()),
+		}
+		if s.cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else if tlsConfig != nil {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		opts := []otlptracegrpc.Option{
+			otlptracegrpc.WithEndpoint(s.cfg.Endpoint),
+			otlptracegrpc.WithHeaders(s.cfg.Headers),
+			otlptracegrpc.WithTimeout(s.cfg.Timeout.Duration()),
+		}
+		if s.cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		} else if tlsConfig != nil {
+			opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	}
+	if err != nil {
+		return fmt.Errorf("create otlp trace exporter is failed: %w", err)
+	}
+
+	s.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithBatcher(exporter),
+	)
+	// the dongle commands are traced through the global provider
+	otel.SetTracerProvider(s.tracerProvider)
+
+	return nil
+}
+
+func (s *OTLPSink) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout.Duration())
+	defer cancel()
+
+	if s.meterProvider != nil {
+		if err := s.meterProvider.Shutdown(ctx); err != nil {
+			s.logger.Warn("shutdown meter provider is failed", zap.Error(err))
+		}
+		s.meterProvider = nil
+	}
+	if s.tracerProvider != nil {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		if err := s.tracerProvider.Shutdown(ctx); err != nil {
+			s.logger.Warn("shutdown tracer provider is failed", zap.Error(err))
+		}
+		s.tracerProvider = nil
+	}
+}
+
+// Close exports the pending metrics and spans, and stops.
+func (s *OTLPSink) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stop()
+}
+
+// ApplyConfig restarts the exporters only when the config is changed.
+func (s *OTLPSink) ApplyConfig(cfg config.OTLPConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if reflect.DeepEqual(cfg, s.cfg) {
+		return nil
+	}
+	s.logger.Info("config is changed, restarting")
+	s.stop()
+	s.cfg = cfg
+	if !cfg.Enabled {
+		return nil
+	}
+	return s.start()
+}
+
+// Handle is the event bus subscriber.
+func (s *OTLPSink) Handle(e event.Event) error {
+	if e.Reading != nil {
+		s.latest.Store(e.Reading)
+	}
+	if e.Status == nil || e.Status.Meter == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.meter != nil && *s.meter == *e.Status.Meter {
+		return nil
+	}
+	m := *e.Status.Meter
+	s.meter = &m
+
+	if s.meterProvider == nil {
+		return nil
+	}
+	// the resource has the meter identity
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout.Duration())
+	defer cancel()
+	if err := s.meterProvider.Shutdown(ctx); err != nil {
+		s.logger.Warn("shutdown meter provider is failed", zap.Error(err))
+	}
+	s.meterProvider = nil
+	return s.startMetrics()
+}
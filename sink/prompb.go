@@ -0,0 +1,105 @@
+package sink
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// the messages of prometheus/prompb, encoded by hand to avoid the whole prometheus module
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSample struct {
+	value float64
+	time  time.Time
+}
+
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+// promSeriesSet groups the samples by the labels, in the order of the first sample.
+type promSeriesSet struct {
+	keys   []string
+	series map[string]*promSeries
+}
+
+func newPromSeriesSet() *promSeriesSet {
+	return &promSeriesSet{series: map[string]*promSeries{}}
+}
+
+// add adds a sample of the metric, the labels are sorted by name as the protocol requires.
+func (set *promSeriesSet) add(name string, labels map[string]string, value float64, t time.Time) {
+	ls := []promLabel{{name: "__name__", value: name}}
+	for k, v := range labels {
+		if len(k) > 0 && len(v) > 0 {
+			ls = append(ls, promLabel{name: k, value: v})
+		}
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].name < ls[j].name })
+
+	key := ""
+	for _, l := range ls {
+		key += l.name + "\xff" + l.value + "\xff"
+	}
+	s, ok := set.series[key]
+	if !ok {
+		s = &promSeries{labels: ls}
+		set.series[key] = s
+		set.keys = append(set.keys, key)
+	}
+	s.samples = append(s.samples, promSample{value: value, time: t})
+}
+
+func (set *promSeriesSet) len() int {
+	n := 0
+	for _, s := range set.series {
+		n += len(s.samples)
+	}
+	return n
+}
+
+// marshal encodes the WriteRequest, the samples of a series are sorted by time.
+func (set *promSeriesSet) marshal() []byte {
+	var b []byte
+	for _, key := range set.keys {
+		s := set.series[key]
+		sort.SliceStable(s.samples, func(i, j int) bool { return s.samples[i].time.Before(s.samples[j].time) })
+
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+		for _, sample := range s.samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(sample.value))
+			sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(sample.time.UnixMilli()))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sb)
+		}
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
@@ -0,0 +1,285 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/event"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+// RemoteWriteSink pushes the readings with the Prometheus remote_write protocol,
+// with the meter timestamps. Every request is written to the WAL first and
+// removed once accepted, so that the samples of an outage are pushed later in order.
+type RemoteWriteSink struct {
+	logger    *zap.Logger
+	namespace string
+
+	mutex   sync.Mutex
+	cfg     config.RemoteWriteConfig
+	client  *http.Client
+	wal     *spool
+	set     *promSeriesSet
+	slotEnd time.Time
+
+	// sendMutex keeps the order of the requests
+	sendMutex sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewRemoteWriteSink(l *zap.Logger, cfg config.RemoteWriteConfig, namespace string) *RemoteWriteSink {
+	return &RemoteWriteSink{
+		logger:    l.With(zap.String("sink", "remote_write")),
+		namespace: namespace,
+		cfg:       cfg,
+		set:       newPromSeriesSet(),
+	}
+}
+
+// Start opens the WAL and starts the flush and the retry loop when enabled.
+func (s *RemoteWriteSink) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.cfg.Enabled {
+		return nil
+	}
+	return s.start()
+}
+
+func (s *RemoteWriteSink) start() error {
+	tlsConfig, err := newTLSConfig(s.cfg.TLS)
+	if err != nil {
+		return err
+	}
+	s.client = &http.Client{
+		Timeout:   s.cfg.Timeout.Duration(),
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	wal, err := newSpool(s.cfg.WALDir, s.cfg.WALMaxBytes)
+	if err != nil {
+		return err
+	}
+	s.wal = wal
+	if n := wal.len(); n > 0 {
+		s.logger.Info(fmt.Sprintf("%d requests in the wal are pushed", n))
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.cfg, s.stop, s.done)
+
+	return nil
+}
+
+func (s *RemoteWriteSink) run(cfg config.RemoteWriteConfig, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	flush := time.NewTicker(cfg.FlushInterval.Duration())
+	defer flush.Stop()
+	retry := time.NewTicker(cfg.RetryInterval.Duration())
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-flush.C:
+			s.Flush()
+		case <-retry.C:
+			s.retry()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close flushes the buffer into the WAL and stops.
+func (s *RemoteWriteSink) Close() {
+	s.mutex.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+		s.Flush()
+	}
+}
+
+// ApplyConfig restarts the sink only when the config is changed.
+func (s *RemoteWriteSink) ApplyConfig(cfg config.RemoteWriteConfig) error {
+	s.mutex.Lock()
+	changed := !reflect.DeepEqual(cfg, s.cfg)
+	s.mutex.Unlock()
+	if !changed {
+		return nil
+	}
+
+	s.logger.Info("config is changed, restarting")
+	s.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cfg = cfg
+	if !cfg.Enabled {
+		return nil
+	}
+	return s.start()
+}
+
+// Handle is the event bus subscriber.
+func (s *RemoteWriteSink) Handle(e event.Event) error {
+	if e.Reading == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	if !s.cfg.Enabled || s.stop == nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.add(e.Reading)
+	full := s.set.len() >= s.cfg.BatchSize
+	s.mutex.Unlock()
+
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+func (s *RemoteWriteSink) add(data *model.HemsData) {
+	labels := s.cfg.ExternalLabels
+	t := data.DateTime
+
+	s.set.add(s.name("energy_imported_kwh_total"), labels, float32Value(data.CumulativePowerConsumption), t)
+	s.set.add(s.name("cumulative_power_consumption"), labels, float32Value(data.CumulativePowerConsumption), t)
+	s.set.add(s.name("latest_cumulative_power_consumption_per_unit_time"), labels, float32Value(data.PowerConsumptionPerUnitTime), t)
+	s.set.add(s.name("instantaneous_power_consumption"), labels, float64(data.InstantaneousPowerConsumption), t)
+	s.set.add(s.name("current"), labels, float32Value(data.Current), t)
+	s.set.add(s.name("power_factor"), labels, float32Value(data.PowerFactor), t)
+	s.set.add(s.name("last_successful_read_timestamp_seconds"), labels, float64(t.UnixNano())/1e9, t)
+
+	// the 30 minutes slots once, stamped at the end of the slot
+	for _, slot := range data.Slots {
+		if slot.End.After(s.slotEnd) {
+			s.slotEnd = slot.End
+			s.set.add(s.name("power_consumption_per_unit_time"), labels, float32Value(slot.EnergyKWh), slot.End)
+		}
+	}
+}
+
+func (s *RemoteWriteSink) name(name string) string {
+	if len(s.namespace) == 0 {
+		return name
+	}
+	return s.namespace + "_" + name
+}
+
+// Flush writes the buffered samples to the WAL and pushes the WAL.
+func (s *RemoteWriteSink) Flush() error {
+	s.mutex.Lock()
+	set := s.set
+	s.set = newPromSeriesSet()
+	cfg, client, wal := s.cfg, s.client, s.wal
+	s.mutex.Unlock()
+
+	if wal == nil {
+		return nil
+	}
+
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+
+	if set.len() > 0 {
+		if err := wal.put(snappy.Encode(nil, set.marshal())); err != nil {
+			return fmt.Errorf("write to wal is failed: %w", err)
+		}
+	}
+	return s.push(cfg, client, wal)
+}
+
+// retry pushes the requests left in the WAL.
+func (s *RemoteWriteSink) retry() {
+	s.mutex.Lock()
+	cfg, client, wal := s.cfg, s.client, s.wal
+	s.mutex.Unlock()
+	if wal == nil {
+		return
+	}
+
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+	if err := s.push(cfg, client, wal); err != nil {
+		s.logger.Warn("push is failed, retrying later", zap.Error(err))
+	}
+}
+
+func (s *RemoteWriteSink) push(cfg config.RemoteWriteConfig, client *http.Client, wal *spool) error {
+	_, err := wal.drain(func(data []byte) error {
+		err := s.send(cfg, client, data)
+		if _, ok := err.(permanentError); ok {
+			// the receiver never accepts it, e.g. out of order samples
+			s.logger.Error("request is rejected and dropped", zap.Error(err))
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+// permanentError is the 4xx response which must not be retried.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (s *RemoteWriteSink) send(cfg config.RemoteWriteConfig, client *http.Client, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout.Duration())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", "hems-metrics-go")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if len(cfg.Username) > 0 {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	if len(cfg.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+cfg.BearerToken)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("push is failed: %s %s", res.Status, strings.TrimSpace(string(body)))
+	if res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
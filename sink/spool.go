@@ -0,0 +1,126 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const spoolExt = ".batch"
+
+// spool keeps the batches which could not be sent on disk, one file per batch.
+// A file is written to a temporary name and renamed, so that a crash never leaves a partial batch.
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	mutex sync.Mutex
+	seq   int
+}
+
+func newSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create spool dir is failed: %w", err)
+	}
+	// partial writes of a crash
+	if tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+	return &spool{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func (s *spool) put(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spoolExt))
+
+	f, err := os.CreateTemp(s.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	s.trim()
+	return nil
+}
+
+// files returns the batches, oldest first.
+func (s *spool) files() []string {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolExt))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(files)
+	return files
+}
+
+// trim drops the oldest batches over maxBytes.
+func (s *spool) trim() {
+	if s.maxBytes <= 0 {
+		return
+	}
+	files := s.files()
+	sizes := make([]int64, len(files))
+	total := int64(0)
+	for i, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; i < len(files) && total > s.maxBytes; i++ {
+		os.Remove(files[i])
+		total -= sizes[i]
+	}
+}
+
+// drain passes the batches to send oldest first, and removes the sent ones.
+// It stops at the first error, so that the order is kept.
+func (s *spool) drain(send func(data []byte) error) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sent := 0
+	for _, file := range s.files() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return sent, err
+		}
+		if err := send(data); err != nil {
+			return sent, err
+		}
+		if err := os.Remove(file); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func (s *spool) len() int {
+	return len(s.files())
+}
@@ -0,0 +1,43 @@
+package sink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+)
+
+// newTLSConfig builds the client tls config, nil when nothing is configured.
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if len(cfg.CAFile) == 0 && len(cfg.CertFile) == 0 && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	t := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if len(cfg.CAFile) > 0 {
+		b, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca_file is failed: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("ca_file has no certificate: %s", cfg.CAFile)
+		}
+		t.RootCAs = pool
+	}
+
+	if len(cfg.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate is failed: %w", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	return t, nil
+}
@@ -0,0 +1,87 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/model"
+)
+
+// version of the file format, a file of another version is ignored
+const version = 1
+
+// State is the controller state which survives a restart.
+type State struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+	// LastReading is the latest reading
+	LastReading *model.HemsData `json:"last_reading"`
+	// Baseline is the reading at the last unit time boundary, the current unit time is counted from it.
+	// Its PowerConsumptionPerUnitTime is the energy of the last ended unit time.
+	Baseline      *model.HemsData `json:"baseline"`
+	UnitTimeStart time.Time       `json:"unit_time_start"`
+	NextCronTime  time.Time       `json:"next_cron_time"`
+	// Meter is the identity of the meter which the readings belong to
+	Meter *model.MeterInfo `json:"meter"`
+}
+
+// Load reads the state, nil without error when the file does not exist.
+func Load(path string) (*State, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state is failed: %w", err)
+	}
+	s := &State{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("parse state is failed: %w", err)
+	}
+	if s.Version != version {
+		return nil, fmt.Errorf("state version %d is not supported", s.Version)
+	}
+	return s, nil
+}
+
+// Save writes the state to a temporary file and renames it, so that a crash never leaves a partial state.
+func Save(path string, s *State) error {
+	s.Version = version
+	s.SavedAt = time.Now()
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create state dir is failed: %w", err)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
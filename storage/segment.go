@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// a record is fixed size, so that a torn write at the end of a segment is detected and cut
+//
+//	0  time    int64, unix ns
+//	8  end     int64, unix ns, the end of the slot, 0 otherwise
+//	16 values  9 x float32
+//	52 exported float32, 0 in the records before it was added
+//	56 count   uint32
+//	60 crc32   of the bytes above
+const recordSize = 64
+
+// Record is a reading, a 1 minute aggregate or a 30 minutes slot.
+// Power / current / power factor are the average of the aggregate.
+type Record struct {
+	Time time.Time
+	// End is the end of the slot
+	End time.Time
+	// CumulativeEnergy is the last reading, the one at the end of the slot [kWh]
+	CumulativeEnergy float32
+	Power            float32
+	PowerMin         float32
+	PowerMax         float32
+	Current          float32
+	RPhaseCurrent    float32
+	TPhaseCurrent    float32
+	PowerFactor      float32
+	// Energy is the energy of the slot [kWh]
+	Energy float32
+	// ExportedEnergy is the exported energy of the slot, or the cumulative one of a reading [kWh]
+	ExportedEnergy float32
+	// Count is the number of the readings
+	Count uint32
+}
+
+func (r *Record) marshal(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:], uint64(r.Time.UnixNano()))
+	end := int64(0)
+	if !r.End.IsZero() {
+		end = r.End.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(b[8:], uint64(end))
+	values := []float32{r.CumulativeEnergy, r.Power, r.PowerMin, r.PowerMax, r.Current,
+		r.RPhaseCurrent, r.TPhaseCurrent, r.PowerFactor, r.Energy}
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[16+i*4:], math.Float32bits(v))
+	}
+	binary.LittleEndian.PutUint32(b[52:], math.Float32bits(r.ExportedEnergy))
+	binary.LittleEndian.PutUint32(b[56:], r.Count)
+	binary.LittleEndian.PutUint32(b[60:], crc32.ChecksumIEEE(b[:60]))
+}
+
+func (r *Record) unmarshal(b []byte) error {
+	if crc32.ChecksumIEEE(b[:60]) != binary.LittleEndian.Uint32(b[60:]) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	r.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(b[0:])))
+	if end := int64(binary.LittleEndian.Uint64(b[8:])); end != 0 {
+		r.End = time.Unix(0, end)
+	} else {
+		r.End = time.Time{}
+	}
+	values := []*float32{&r.CumulativeEnergy, &r.Power, &r.PowerMin, &r.PowerMax, &r.Current,
+		&r.RPhaseCurrent, &r.TPhaseCurrent, &r.PowerFactor, &r.Energy}
+	for i, v := range values {
+		*v = math.Float32frombits(binary.LittleEndian.Uint32(b[16+i*4:]))
+	}
+	r.ExportedEnergy = math.Float32frombits(binary.LittleEndian.Uint32(b[52:]))
+	r.Count = binary.LittleEndian.Uint32(b[56:])
+	return nil
+}
+
+// segment is an append-only file of records.
+type segment struct {
+	file *os.File
+	// dirty is true when written after the last sync
+	dirty bool
+}
+
+// openSegment opens the segment to append, the records after the first broken one are cut.
+func openSegment(path string) (*segment, int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	records, valid, err := readRecords(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() != valid {
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return &segment{file: f}, len(records), nil
+}
+
+func (s *segment) append(r *Record) error {
+	b := make([]byte, recordSize)
+	r.marshal(b)
+	if _, err := s.file.Write(b); err != nil {
+		return err
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *segment) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	s.dirty = false
+	return s.file.Sync()
+}
+
+func (s *segment) close() error {
+	s.sync()
+	return s.file.Close()
+}
+
+// readSegment reads the valid records of the segment file.
+func readSegment(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records, _, err := readRecords(f)
+	return records, err
+}
+
+// readRecords reads from the start until the first broken record, and returns the valid size.
+func readRecords(f *os.File) ([]Record, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records := make([]Record, 0, len(data)/recordSize)
+	valid := int64(0)
+	for len(data) >= recordSize {
+		var r Record
+		if err := r.unmarshal(data[:recordSize]); err != nil {
+			break
+		}
+		records = append(records, r)
+		data = data[recordSize:]
+		valid += recordSize
+	}
+	return records, valid, nil
+}
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"go.uber.org/zap"
+)
+
+const segmentExt = ".seg"
+
+// Resolution is a series of the store, each one has its own segments and retention.
+type Resolution string
+
+const (
+	// Raw is every reading
+	Raw Resolution = "raw"
+	// Minute is the 1 minute aggregate of the readings
+	Minute Resolution = "1m"
+	// Slot is the 30 minutes unit time of the meter
+	Slot Resolution = "30m"
+)
+
+var Resolutions = []Resolution{Raw, Minute, Slot}
+
+func ParseResolution(s string) (Resolution, error) {
+	for _, r := range Resolutions {
+		if string(r) == s {
+			return r, nil
+		}
+	}
+	return "", fmt.Errorf("resolution must be raw, 1m or 30m: %s", s)
+}
+
+// layout is the period of a segment file, raw is daily, 1m is monthly and 30m is yearly, in UTC.
+func (r Resolution) layout() string {
+	switch r {
+	case Raw:
+		return "20060102"
+	case Minute:
+		return "200601"
+	default:
+		return "2006"
+	}
+}
+
+func (r Resolution) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	switch r {
+	case Raw:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case Minute:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func (r Resolution) periodEnd(start time.Time) time.Time {
+	switch r {
+	case Raw:
+		return start.AddDate(0, 0, 1)
+	case Minute:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(1, 0, 0)
+	}
+}
+
+type currentSegment struct {
+	name    string
+	segment *segment
+}
+
+// Store keeps the readings in append-only segment files, with the downsampling to
+// 1 minute and the 30 minutes slots. A record is fixed size with a checksum, and a
+// broken tail of a crash is cut on open.
+type Store struct {
+	logger       *zap.Logger
+	dir          string
+	retention    map[Resolution]time.Duration
+	syncInterval time.Duration
+
+	mutex    sync.Mutex
+	segments map[Resolution]*currentSegment
+	lastSync time.Time
+	// the aggregate of the current minute
+	minute     *minuteAggregate
+	lastMinute time.Time
+	lastSlot   time.Time
+	closed     bool
+	readOnly   bool
+}
+
+func Open(l *zap.Logger, cfg config.StorageConfig) (*Store, error) {
+	s := &Store{
+		logger: l.With(zap.String("component", "storage")),
+		dir:    cfg.Dir,
+		retention: map[Resolution]time.Duration{
+			Raw:    cfg.RawRetention.Duration(),
+			Minute: cfg.MinuteRetention.Duration(),
+			Slot:   cfg.SlotRetention.Duration(),
+		},
+		syncInterval: cfg.SyncInterval.Duration(),
+		segments:     map[Resolution]*currentSegment{},
+	}
+
+	for _, r := range Resolutions {
+		if err := os.MkdirAll(filepath.Join(s.dir, string(r)), 0o700); err != nil {
+			return nil, fmt.Errorf("create storage dir is failed: %w", err)
+		}
+	}
+	s.applyRetention(time.Now())
+
+	// resume after the last records, so that nothing is written twice
+	if r, err := s.last(Minute); err != nil {
+		return nil, err
+	} else if r != nil {
+		s.lastMinute = r.Time
+	}
+	if r, err := s.last(Slot); err != nil {
+		return nil, err
+	} else if r != nil {
+		s.lastSlot = r.End
+	}
+
+	return s, nil
+}
+
+// OpenReadOnly opens the store only for the queries, e.g. for the export while the server is running.
+// Nothing is written nor removed.
+func OpenReadOnly(l *zap.Logger, dir string) (*Store, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("storage dir is not found: %w", err)
+	}
+	return &Store{
+		logger:   l.With(zap.String("component", "storage")),
+		dir:      dir,
+		segments: map[Resolution]*currentSegment{},
+		readOnly: true,
+	}, nil
+}
+
+// Append records the reading, the 1 minute aggregate when a minute is ended
+// and the slot when a unit time is ended.
+func (s *Store) Append(data *model.HemsData) error {
+	if data == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return fmt.Errorf("storage is closed")
+	}
+	if s.readOnly {
+		return fmt.Errorf("storage is read only")
+	}
+
+	errs := []string{}
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	add(s.append(Raw, &Record{
+		Time:             data.DateTime,
+		CumulativeEnergy: data.CumulativePowerConsumption,
+		ExportedEnergy:   data.CumulativePowerExport,
+		Power:            float32(data.InstantaneousPowerConsumption),
+		PowerMin:         float32(data.InstantaneousPowerConsumption),
+		PowerMax:         float32(data.InstantaneousPowerConsumption),
+		Current:          data.Current,
+		RPhaseCurrent:    data.RphaseCurrent,
+		TPhaseCurrent:    data.TpahseCurrent,
+		PowerFactor:      data.PowerFactor,
+		Count:            1,
+	}))
+
+	bucket := data.DateTime.Truncate(time.Minute)
+	if s.minute != nil && !bucket.Equal(s.minute.time) {
+		add(s.flushMinute())
+	}
+	if bucket.After(s.lastMinute) {
+		if s.minute == nil {
+			s.minute = &minuteAggregate{time: bucket}
+		}
+		s.minute.add(data)
+	}
+
+	synced := false
+	for _, slot := range data.Slots {
+		if !slot.End.After(s.lastSlot) {
+			continue
+		}
+		add(s.append(Slot, &Record{
+			Time:             slot.Start,
+			End:              slot.End,
+			CumulativeEnergy: slot.CumulativeKWh,
+			Energy:           slot.EnergyKWh,
+			ExportedEnergy:   slot.ExportedKWh,
+			Count:            1,
+		}))
+		s.lastSlot = slot.End
+		synced = true
+	}
+	if synced {
+		// a slot is never lost
+		add(s.sync(Slot))
+	}
+
+	if time.Since(s.lastSync) >= s.syncInterval {
+		for _, r := range Resolutions {
+			add(s.sync(r))
+		}
+		s.lastSync = time.Now()
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("write to storage is failed: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s *Store) flushMinute() error {
+	m := s.minute
+	s.minute = nil
+	if m == nil || m.count == 0 {
+		return nil
+	}
+	s.lastMinute = m.time
+	return s.append(Minute, m.record())
+}
+
+// append writes the record to the segment of its period, the segment is switched on a new period.
+func (s *Store) append(r Resolution, record *Record) error {
+	name := record.Time.UTC().Format(r.layout()) + segmentExt
+	open := s.segments[r]
+	if open == nil || open.name != name {
+		if open != nil {
+			open.segment.close()
+			delete(s.segments, r)
+			s.applyRetention(time.Now())
+		}
+		seg, n, err := openSegment(filepath.Join(s.dir, string(r), name))
+		if err != nil {
+			return err
+		}
+		s.logger.Debug(fmt.Sprintf("segment %s/%s is opened, %d records", r, name, n))
+		open = &currentSegment{name: name, segment: seg}
+		s.segments[r] = open
+	}
+	return open.segment.append(record)
+}
+
+func (s *Store) sync(r Resolution) error {
+	if open := s.segments[r]; open != nil {
+		return open.segment.sync()
+	}
+	return nil
+}
+
+// applyRetention removes the segments which are entirely older than the retention, 0 keeps forever.
+func (s *Store) applyRetention(now time.Time) {
+	for _, r := range Resolutions {
+		retention := s.retention[r]
+		if retention <= 0 {
+			continue
+		}
+		for _, file := range s.files(r) {
+			start, err := time.ParseInLocation(r.layout(), strings.TrimSuffix(filepath.Base(file), segmentExt), time.UTC)
+			if err != nil {
+				continue
+			}
+			if r.periodEnd(start).Before(now.Add(-retention)) {
+				if err := os.Remove(file); err != nil {
+					s.logger.Warn("remove segment is failed", zap.Error(err))
+				} else {
+					s.logger.Info(fmt.Sprintf("segment %s is removed by the retention", file))
+				}
+			}
+		}
+	}
+}
+
+// files returns the segment files of the resolution, oldest first.
+func (s *Store) files(r Resolution) []string {
+	files, err := filepath.Glob(filepath.Join(s.dir, string(r), "*"+segmentExt))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Query returns the records in [from, to), oldest first. A zero from or to is unbounded.
+func (s *Store) Query(r Resolution, from, to time.Time) ([]Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := []Record{}
+	for _, file := range s.files(r) {
+		start, err := time.ParseInLocation(r.layout(), strings.TrimSuffix(filepath.Base(file), segmentExt), time.UTC)
+		if err != nil {
+			continue
+		}
+		if (!from.IsZero() && !r.periodEnd(start).After(from)) || (!to.IsZero() && !start.Before(to)) {
+			continue
+		}
+		records, err := readSegment(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if (!from.IsZero() && record.Time.Before(from)) || (!to.IsZero() && !record.Time.Before(to)) {
+				continue
+			}
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
+// Last returns the latest record of the resolution, nil when there is none.
+func (s *Store) Last(r Resolution) (*Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last(r)
+}
+
+func (s *Store) last(r Resolution) (*Record, error) {
+	files := s.files(r)
+	for i := len(files) - 1; i >= 0; i-- {
+		records, err := readSegment(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			return &records[len(records)-1], nil
+		}
+	}
+	return nil, nil
+}
+
+// Close writes the current minute and syncs the segments.
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.flushMinute()
+	for r, open := range s.segments {
+		if e := open.segment.close(); e != nil && err == nil {
+			err = e
+		}
+		delete(s.segments, r)
+	}
+	return err
+}
+
+type minuteAggregate struct {
+	time                               time.Time
+	count                              int
+	energy, exported                   float32
+	power, current, rPhase, tPhase, pf float64
+	powerMin, powerMax                 float32
+}
+
+func (m *minuteAggregate) add(data *model.HemsData) {
+	power := float32(data.InstantaneousPowerConsumption)
+	if m.count == 0 || power < m.powerMin {
+		m.powerMin = power
+	}
+	if m.count == 0 || power > m.powerMax {
+		m.powerMax = power
+	}
+	m.count++
+	m.energy = data.CumulativePowerConsumption
+	m.exported = data.CumulativePowerExport
+	m.power += float64(data.InstantaneousPowerConsumption)
+	m.current += float64(data.Current)
+	m.rPhase += float64(data.RphaseCurrent)
+	m.tPhase += float64(data.TpahseCurrent)
+	m.pf += float64(data.PowerFactor)
+}
+
+func (m *minuteAggregate) record() *Record {
+	n := float64(m.count)
+	return &Record{
+		Time:             m.time,
+		CumulativeEnergy: m.energy,
+		ExportedEnergy:   m.exported,
+		Power:            float32(m.power / n),
+		PowerMin:         m.powerMin,
+		PowerMax:         m.powerMax,
+		Current:          float32(m.current / n),
+		RPhaseCurrent:    float32(m.rPhase / n),
+		TPhaseCurrent:    float32(m.tPhase / n),
+		PowerFactor:      float32(m.pf / n),
+		Count:            uint32(m.count),
+	}
+}
@@ -0,0 +1,263 @@
+package tariff
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/model"
+	"github.com/michibiki-io/hems-metrics-go/rollup"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Bill is the cost of a billing period, to date and projected to the end of it.
+type Bill struct {
+	Start    time.Time
+	End      time.Time
+	Currency string
+	// Slots is the number of the priced unit times
+	Slots       int
+	ImportedKWh float64
+	ExportedKWh float64
+
+	BasicCharge        float64
+	Energy             float64
+	FuelCostAdjustment float64
+	RenewableSurcharge float64
+	FeedIn             float64
+	// Amount is the total to date, the feed in is subtracted
+	Amount float64
+
+	// ProjectedKWh and ProjectedAmount are extrapolated from the covered time of the period,
+	// from the first slot to the last one
+	ProjectedKWh    float64
+	ProjectedAmount float64
+}
+
+// Engine prices every unit time of the meter, and keeps the ones of the current billing period
+// for the bill to date. It is a prometheus.Collector.
+type Engine struct {
+	logger   *zap.Logger
+	calendar rollup.Calendar
+
+	mutex   sync.RWMutex
+	cfg     config.TariffConfig
+	tariff  *Tariff
+	slots   []Slot
+	lastEnd time.Time
+
+	cost        *prometheus.Desc
+	amount      *prometheus.Desc
+	energy      *prometheus.Desc
+	unitTime    *prometheus.Desc
+	currentRate *prometheus.Desc
+}
+
+func NewEngine(l *zap.Logger, cfg config.TariffConfig, calendar rollup.Calendar, namespace string) (*Engine, error) {
+	name := func(name string) string {
+		return prometheus.BuildFQName(namespace, "", name)
+	}
+	e := &Engine{
+		logger:   l.With(zap.String("component", "tariff")),
+		calendar: calendar,
+		cost: prometheus.NewDesc(name("bill_cost"),
+			"Cost of the current billing period to date by component, the feed in is negative [currency]", []string{"component", "currency"}, nil),
+		amount: prometheus.NewDesc(name("bill_amount"),
+			"Bill of the current billing period, to date and projected to the end [currency]", []string{"estimate", "currency"}, nil),
+		energy: prometheus.NewDesc(name("bill_energy_kwh"),
+			"Imported energy of the current billing period, to date and projected to the end [kWh]", []string{"estimate"}, nil),
+		unitTime: prometheus.NewDesc(name("unit_time_cost"),
+			"Cost of the last ended unit time, without the basic charge [currency]", []string{"currency"}, nil),
+		currentRate: prometheus.NewDesc(name("tariff_rate_per_kwh"),
+			"Rate per kWh of now [currency]", []string{"rate", "currency"}, nil),
+	}
+	if err := e.ApplyConfig(cfg); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ApplyConfig replaces the plan, the bill to date is priced again.
+func (e *Engine) ApplyConfig(cfg config.TariffConfig) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.tariff != nil && reflect.DeepEqual(cfg, e.cfg) {
+		return nil
+	}
+	t, err := NewTariff(cfg, e.calendar)
+	if err != nil {
+		return err
+	}
+	e.cfg = cfg
+	e.tariff = t
+	return nil
+}
+
+// Enabled reports whether the tariff is enabled.
+func (e *Engine) Enabled() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.cfg.Enabled
+}
+
+// Update adds the unit times which the reading ended, the event bus subscriber.
+func (e *Engine) Update(data *model.HemsData) error {
+	if data == nil {
+		return nil
+	}
+	for _, slot := range data.Slots {
+		e.AddSlot(Slot{
+			Start:       slot.Start,
+			End:         slot.End,
+			ImportedKWh: rollup.Value(slot.EnergyKWh),
+			ExportedKWh: rollup.Value(slot.ExportedKWh),
+		})
+	}
+	return nil
+}
+
+// AddSlot adds a unit time, it is ignored unless it ends after the last one.
+// The slots before the billing period of it are dropped.
+func (e *Engine) AddSlot(slot Slot) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !slot.End.After(e.lastEnd) {
+		return
+	}
+	e.lastEnd = slot.End
+	// the partial first unit time after a start has no start
+	if slot.Start.IsZero() {
+		slot.Start = slot.End.Add(-time.Nanosecond)
+	}
+
+	period := e.calendar.Start(rollup.Billing, slot.Start)
+	i := 0
+	for i < len(e.slots) && e.slots[i].Start.Before(period) {
+		i++
+	}
+	e.slots = append(e.slots[i:], slot)
+}
+
+// Costs prices the slots, nil when the tariff is disabled.
+func (e *Engine) Costs(slots []Slot) []Cost {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if !e.cfg.Enabled {
+		return nil
+	}
+	return e.tariff.Costs(slots)
+}
+
+// Bill returns the bill of the billing period of now, false when the tariff is disabled.
+func (e *Engine) Bill(now time.Time) (Bill, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if !e.cfg.Enabled {
+		return Bill{}, false
+	}
+	return e.bill(now), true
+}
+
+func (e *Engine) bill(now time.Time) Bill {
+	t := e.tariff
+	start := e.calendar.Start(rollup.Billing, now)
+	b := Bill{
+		Start:       start,
+		End:         e.calendar.End(rollup.Billing, start),
+		Currency:    t.Currency(),
+		BasicCharge: t.BasicCharge(),
+	}
+
+	slots := []Slot{}
+	for _, slot := range e.slots {
+		if !slot.Start.Before(start) {
+			slots = append(slots, slot)
+		}
+	}
+	tieredKWh, timeOfUseEnergy := 0.0, 0.0
+	// the slots may begin after the start, e.g. after a restart without the storage
+	first, covered := time.Time{}, time.Time{}
+	for i, cost := range t.Costs(slots) {
+		b.Slots++
+		b.ImportedKWh += slots[i].ImportedKWh
+		b.ExportedKWh += slots[i].ExportedKWh
+		b.Energy += cost.Energy
+		b.FuelCostAdjustment += cost.FuelCostAdjustment
+		b.RenewableSurcharge += cost.RenewableSurcharge
+		b.FeedIn += cost.FeedIn
+		if cost.tiered {
+			tieredKWh += slots[i].ImportedKWh
+		} else {
+			timeOfUseEnergy += cost.Energy
+		}
+		if first.IsZero() || slots[i].Start.Before(first) {
+			first = slots[i].Start
+		}
+		if slots[i].End.After(covered) {
+			covered = slots[i].End
+		}
+	}
+	b.Amount = b.BasicCharge + b.Energy + b.FuelCostAdjustment + b.RenewableSurcharge - b.FeedIn
+
+	// the tiers are priced on the projected energy, the others are linear
+	b.ProjectedKWh, b.ProjectedAmount = b.ImportedKWh, b.Amount
+	if elapsed := covered.Sub(first); elapsed > 0 {
+		ratio := float64(b.End.Sub(start)) / float64(elapsed)
+		b.ProjectedKWh = b.ImportedKWh * ratio
+		b.ProjectedAmount = b.BasicCharge + t.TieredCharge(tieredKWh*ratio) + timeOfUseEnergy*ratio +
+			(b.FuelCostAdjustment+b.RenewableSurcharge-b.FeedIn)*ratio
+	}
+	return b
+}
+
+// Describe implements prometheus.Collector.
+func (e *Engine) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.cost
+	ch <- e.amount
+	ch <- e.energy
+	ch <- e.unitTime
+	ch <- e.currentRate
+}
+
+// Collect implements prometheus.Collector, nothing is reported when the tariff is disabled.
+func (e *Engine) Collect(ch chan<- prometheus.Metric) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if !e.cfg.Enabled {
+		return
+	}
+	now := time.Now()
+	b := e.bill(now)
+	currency := b.Currency
+
+	for _, c := range []struct {
+		component string
+		value     float64
+	}{
+		{"basic", b.BasicCharge},
+		{"energy", b.Energy},
+		{"fuel_cost_adjustment", b.FuelCostAdjustment},
+		{"renewable_surcharge", b.RenewableSurcharge},
+		{"feed_in", -b.FeedIn},
+	} {
+		ch <- prometheus.MustNewConstMetric(e.cost, prometheus.GaugeValue, c.value, c.component, currency)
+	}
+	ch <- prometheus.MustNewConstMetric(e.amount, prometheus.GaugeValue, b.Amount, "to_date", currency)
+	ch <- prometheus.MustNewConstMetric(e.amount, prometheus.GaugeValue, b.ProjectedAmount, "projected", currency)
+	ch <- prometheus.MustNewConstMetric(e.energy, prometheus.GaugeValue, b.ImportedKWh, "to_date")
+	ch <- prometheus.MustNewConstMetric(e.energy, prometheus.GaugeValue, b.ProjectedKWh, "projected")
+
+	if n := len(e.slots); n > 0 {
+		// priced with the slots of its billing period for the tier
+		costs := e.tariff.Costs(e.slots)
+		ch <- prometheus.MustNewConstMetric(e.unitTime, prometheus.GaugeValue, costs[n-1].Total(), currency)
+	}
+	rate, name := e.tariff.Rate(now, b.ImportedKWh)
+	ch <- prometheus.MustNewConstMetric(e.currentRate, prometheus.GaugeValue, rate, name, currency)
+}
@@ -0,0 +1,71 @@
+package tariff
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/rollup"
+	"go.uber.org/zap"
+)
+
+func newTestEngine(t *testing.T) *Engine {
+	cfg := config.Default().Tariff
+	cfg.Enabled = true
+	cfg.Tiers = []config.TariffTier{{Rate: 30}}
+	location := time.FixedZone("JST", 9*60*60)
+	e, err := NewEngine(zap.NewNop(), cfg, rollup.Calendar{Location: location, BillingDay: 1}, "hems")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestBillFromMiddleOfPeriod(t *testing.T) {
+	e := newTestEngine(t)
+	location := e.calendar.Location
+
+	// a restart without the storage, the slots begin on the 16th day of 31
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, location)
+	for i := 0; i < 48; i++ {
+		e.AddSlot(Slot{
+			Start:       start.Add(time.Duration(i) * 30 * time.Minute),
+			End:         start.Add(time.Duration(i+1) * 30 * time.Minute),
+			ImportedKWh: 0.5,
+		})
+	}
+
+	b, ok := e.Bill(start.Add(24 * time.Hour))
+	if !ok {
+		t.Fatal("tariff is disabled")
+	}
+	if b.Slots != 48 || b.ImportedKWh != 24 {
+		t.Fatalf("%d slots, %v kWh", b.Slots, b.ImportedKWh)
+	}
+	// a day of 24 kWh for 31 days
+	if math.Abs(b.ProjectedKWh-744) > 1e-6 {
+		t.Errorf("projected %v kWh", b.ProjectedKWh)
+	}
+	if want := b.BasicCharge + 744*30; math.Abs(b.ProjectedAmount-want) > 1e-6 {
+		t.Errorf("projected %v, not %v", b.ProjectedAmount, want)
+	}
+}
+
+func TestMonthOfMeterReading(t *testing.T) {
+	cfg := config.Default().Tariff
+	cfg.FuelCostAdjustment = map[string]float64{"2026-09": -100, "2026-10": -1}
+	cfg.RenewableSurcharge = map[string]float64{"2026-09": 100, "2026-10": 3}
+	location := time.FixedZone("JST", 9*60*60)
+	tariff, err := NewTariff(cfg, rollup.Calendar{Location: location, BillingDay: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2026-09-15 to 2026-10-14 is read on 2026-10-15
+	start := time.Date(2026, 9, 20, 0, 0, 0, 0, location)
+	costs := tariff.Costs([]Slot{{Start: start, End: start.Add(30 * time.Minute), ImportedKWh: 2}})
+	if c := costs[0]; c.FuelCostAdjustment != -2 || c.RenewableSurcharge != 6 {
+		t.Errorf("cost %+v", c)
+	}
+}
@@ -0,0 +1,207 @@
+package tariff
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"github.com/michibiki-io/hems-metrics-go/rollup"
+)
+
+// Slot is a 30 minutes unit time of the meter.
+type Slot struct {
+	Start time.Time
+	End   time.Time
+	// ImportedKWh and ExportedKWh are the energy of the unit time
+	ImportedKWh float64
+	ExportedKWh float64
+}
+
+// Cost is the cost of a unit time, the basic charge is per billing period and not included.
+type Cost struct {
+	Energy             float64
+	FuelCostAdjustment float64
+	RenewableSurcharge float64
+	// FeedIn is the credit of the exported energy, subtracted from the total
+	FeedIn float64
+	// Rate is the name of the rate, the time of use name or tier1, tier2 ...
+	Rate string
+	// tiered is priced by the tiers, not by a time of use rate
+	tiered bool
+}
+
+func (c Cost) Total() float64 {
+	return c.Energy + c.FuelCostAdjustment + c.RenewableSurcharge - c.FeedIn
+}
+
+type timeOfUse struct {
+	name     string
+	start    time.Duration
+	end      time.Duration
+	allDay   bool
+	weekdays [7]bool
+	holiday  bool
+	rate     float64
+}
+
+// Tariff prices the unit times by a plan.
+type Tariff struct {
+	cfg       config.TariffConfig
+	calendar  rollup.Calendar
+	timeOfUse []timeOfUse
+	holidays  map[string]bool
+}
+
+// NewTariff creates the tariff of the plan, the billing periods are the ones of the calendar.
+// The plan is validated by config.Validate.
+func NewTariff(cfg config.TariffConfig, calendar rollup.Calendar) (*Tariff, error) {
+	t := &Tariff{
+		cfg:      cfg,
+		calendar: calendar,
+		holidays: map[string]bool{},
+	}
+	for _, rate := range cfg.TimeOfUse {
+		tou := timeOfUse{name: rate.Name, rate: rate.Rate, allDay: len(rate.Start) == 0}
+		var err error
+		if !tou.allDay {
+			if tou.start, err = config.ParseClock(rate.Start); err != nil {
+				return nil, err
+			}
+			if tou.end, err = config.ParseClock(rate.End); err != nil {
+				return nil, err
+			}
+		}
+		if tou.weekdays, tou.holiday, err = config.ParseDays(rate.Days); err != nil {
+			return nil, err
+		}
+		t.timeOfUse = append(t.timeOfUse, tou)
+	}
+	for _, day := range cfg.Holidays {
+		t.holidays[day] = true
+	}
+	return t, nil
+}
+
+// Currency of the costs.
+func (t *Tariff) Currency() string {
+	return t.cfg.Currency
+}
+
+// BasicCharge is the charge of a billing period.
+func (t *Tariff) BasicCharge() float64 {
+	return t.cfg.BasicCharges[t.cfg.ContractAmperes]
+}
+
+// Costs prices the slots. The tiers are counted from the first slot of each billing period in slots,
+// so the slots should begin at the start of a billing period.
+func (t *Tariff) Costs(slots []Slot) []Cost {
+	sorted := make([]int, len(slots))
+	for i := range sorted {
+		sorted[i] = i
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return slots[sorted[i]].Start.Before(slots[sorted[j]].Start) })
+
+	costs := make([]Cost, len(slots))
+	var period time.Time
+	used := 0.0
+	for _, i := range sorted {
+		slot := slots[i]
+		if start := t.calendar.Start(rollup.Billing, slot.Start); !start.Equal(period) {
+			period, used = start, 0
+		}
+		// 検針月, the month of the meter reading day which ends the period
+		month := t.calendar.End(rollup.Billing, period).Format("2006-01")
+
+		cost := Cost{
+			FuelCostAdjustment: slot.ImportedKWh * t.cfg.FuelCostAdjustment[month],
+			RenewableSurcharge: slot.ImportedKWh * t.cfg.RenewableSurcharge[month],
+			FeedIn:             slot.ExportedKWh * t.cfg.FeedInRate,
+		}
+		if tou, ok := t.rateOf(slot.Start); ok {
+			cost.Energy = slot.ImportedKWh * tou.rate
+			cost.Rate = tou.name
+		} else {
+			cost.Energy, cost.Rate = t.tiered(used, slot.ImportedKWh)
+			cost.tiered = true
+		}
+		used += slot.ImportedKWh
+		costs[i] = cost
+	}
+	return costs
+}
+
+// TieredCharge is the charge of the energy of a billing period by the tiers.
+func (t *Tariff) TieredCharge(kwh float64) float64 {
+	charge, _ := t.tiered(0, kwh)
+	return charge
+}
+
+// tiered is the charge of kwh after used kWh in the billing period, split by the tiers.
+// The rate is the tier of the end.
+func (t *Tariff) tiered(used float64, kwh float64) (float64, string) {
+	charge := 0.0
+	lower := 0.0
+	for _, tier := range t.cfg.Tiers {
+		upper := tier.UpTo
+		if upper == 0 {
+			upper = math.Inf(1)
+		}
+		// the part of [used, used+kwh) in [lower, upper)
+		if from, to := math.Max(used, lower), math.Min(used+kwh, upper); to > from {
+			charge += (to - from) * tier.Rate
+		}
+		lower = upper
+	}
+	_, rate := t.tier(used + kwh)
+	return charge, rate
+}
+
+// tier returns the rate of the tier of used kWh in the billing period.
+func (t *Tariff) tier(used float64) (float64, string) {
+	for i, tier := range t.cfg.Tiers {
+		if tier.UpTo == 0 || used < tier.UpTo {
+			return tier.Rate, "tier" + strconv.Itoa(i+1)
+		}
+	}
+	return 0, ""
+}
+
+// rateOf returns the time of use rate of the slot start, the first match.
+func (t *Tariff) rateOf(start time.Time) (timeOfUse, bool) {
+	local := start.In(t.calendar.Location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, t.calendar.Location)
+	clock := local.Sub(midnight)
+	holiday := t.holidays[local.Format("2006-01-02")]
+
+	for _, tou := range t.timeOfUse {
+		if holiday {
+			if !tou.holiday {
+				continue
+			}
+		} else if !tou.weekdays[local.Weekday()] {
+			continue
+		}
+		if tou.allDay {
+			return tou, true
+		}
+		if tou.start < tou.end {
+			if clock >= tou.start && clock < tou.end {
+				return tou, true
+			}
+		} else if clock >= tou.start || clock < tou.end {
+			// over midnight
+			return tou, true
+		}
+	}
+	return timeOfUse{}, false
+}
+
+// Rate returns the rate per kWh of the time, with the tier of used kWh in the billing period.
+func (t *Tariff) Rate(now time.Time, used float64) (float64, string) {
+	if tou, ok := t.rateOf(now); ok {
+		return tou.rate, tou.name
+	}
+	return t.tier(used)
+}
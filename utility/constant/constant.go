@@ -3,4 +3,5 @@ package constant
 const (
 	MinimumSkscanDurationSeoncds = 6
 	ScanTimeoutSecond            = 25
+	ProbeTimeoutSecond           = 3
 )
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"strings"
+	"time"
+
+	zaplogfmt "github.com/jsternberg/zap-logfmt"
+	"github.com/michibiki-io/hems-metrics-go/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func init() {
+	zap.RegisterEncoder("logfmt", func(cfg zapcore.EncoderConfig) (zapcore.Encoder, error) {
+		return zaplogfmt.NewEncoder(cfg), nil
+	})
+}
+
+// NewLogger builds the logger, the timestamps are written in location.
+// The level can be changed at runtime through the returned AtomicLevel.
+func NewLogger(cfg config.LogConfig, location *time.Location, opts ...zap.Option) (*zap.Logger, zap.AtomicLevel, error) {
+
+	var logCfg zap.Config
+	if strings.ToLower(cfg.Mode) == "debug" {
+		logCfg = zap.NewDevelopmentConfig()
+	} else {
+		logCfg = zap.NewProductionConfig()
+	}
+
+	if len(cfg.Format) > 0 {
+		logCfg.Encoding = strings.ToLower(cfg.Format)
+	}
+	if len(cfg.Level) > 0 {
+		level, err := zap.ParseAtomicLevel(cfg.Level)
+		if err != nil {
+			return nil, logCfg.Level, err
+		}
+		logCfg.Level = level
+	}
+
+	logCfg.EncoderConfig.EncodeTime = func(t time.Time, pae zapcore.PrimitiveArrayEncoder) {
+		const layout = "2006-01-02 15:04:05 MST"
+		pae.AppendString(t.In(location).Format(layout))
+	}
+
+	logger, err := logCfg.Build(opts...)
+	return logger, logCfg.Level, err
+}
@@ -0,0 +1,93 @@
+package redact
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const Mask = "********"
+
+// Redactor masks the registered secrets in the log output.
+type Redactor struct {
+	mutex   sync.RWMutex
+	secrets []string
+}
+
+func NewRedactor() *Redactor {
+	return &Redactor{}
+}
+
+// SetSecrets replaces the secrets, empty ones are ignored.
+func (r *Redactor) SetSecrets(secrets ...string) {
+	s := []string{}
+	for _, secret := range secrets {
+		if len(secret) > 0 {
+			s = append(s, secret)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.secrets = s
+}
+
+func (r *Redactor) Redact(s string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, Mask)
+	}
+	return s
+}
+
+// Core wraps the core, so that every message and field is redacted before encoding.
+func (r *Redactor) Core(core zapcore.Core) zapcore.Core {
+	return &redactCore{Core: core, redactor: r}
+}
+
+type redactCore struct {
+	zapcore.Core
+	redactor *Redactor
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(c.redactFields(fields)), redactor: c.redactor}
+}
+
+func (c *redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.redactor.Redact(ent.Message)
+	return c.Core.Write(ent, c.redactFields(fields))
+}
+
+func (c *redactCore) redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = c.redactor.Redact(f.String)
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f.Interface = errors.New(c.redactor.Redact(err.Error()))
+			}
+		case zapcore.StringerType:
+			if s, ok := f.Interface.(fmt.Stringer); ok {
+				f = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: c.redactor.Redact(s.String())}
+			}
+		case zapcore.ReflectType:
+			f = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: c.redactor.Redact(fmt.Sprintf("%+v", f.Interface))}
+		}
+		redacted[i] = f
+	}
+	return redacted
+}
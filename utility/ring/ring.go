@@ -0,0 +1,57 @@
+package ring
+
+import "sync"
+
+// Ring keeps the latest size items, it is safe for concurrent use.
+type Ring[T any] struct {
+	mutex sync.RWMutex
+	items []T
+	next  int
+	full  bool
+}
+
+func NewRing[T any](size int) *Ring[T] {
+	if size < 1 {
+		size = 1
+	}
+	return &Ring[T]{items: make([]T, size)}
+}
+
+func (r *Ring[T]) Push(item T) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.items[r.next] = item
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Last returns the latest n items, oldest first. n <= 0 returns all.
+func (r *Ring[T]) Last(n int) []T {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	count := r.next
+	if r.full {
+		count = len(r.items)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+
+	result := make([]T, 0, n)
+	for i := n; i > 0; i-- {
+		result = append(result, r.items[(r.next-i+len(r.items))%len(r.items)])
+	}
+	return result
+}
+
+func (r *Ring[T]) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.full {
+		return len(r.items)
+	}
+	return r.next
+}